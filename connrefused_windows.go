@@ -0,0 +1,18 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// wsaeConnRefused is Winsock's WSAECONNREFUSED. syscall.ECONNREFUSED is an
+// invented value on Windows that socket calls never return.
+const wsaeConnRefused = syscall.Errno(10061)
+
+// isConnRefused reports whether err is a refused TCP connection, which means
+// AnkiConnect isn't listening yet.
+func isConnRefused(err error) bool {
+	return errors.Is(err, wsaeConnRefused) || errors.Is(err, syscall.ECONNREFUSED)
+}
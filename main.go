@@ -3,14 +3,26 @@ package main
 import (
 	"context"
 	"encoding/base64"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"html"
 	"log"
+	"math"
+	"math/rand"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 
 	"github.com/modelcontextprotocol/go-sdk/mcp"
 )
@@ -18,11 +30,20 @@ import (
 var (
 	httpAddr       = flag.String("http", "", "if set, use streamable HTTP at this address, instead of stdin/stdout")
 	ankiConnectURL = flag.String("anki-connect", "http://localhost:8765", "AnkiConnect URL")
+	defaultDeck    = flag.String("default-deck", "", "deck used for created notes that omit deckName")
+	defaultModel   = flag.String("default-model", "", "model used for created notes that omit modelName")
+	keyCase        = flag.String("normalize-keys", "", "if set to 'snake' or 'camel', convert keys in returned JSON to that case")
+	maxRetries     = flag.Int("max-retries", 2, "how many times to retry AnkiConnect requests that fail with connection refused, or read-only ones that get a 5xx response")
 )
 
 type AnkiServer struct {
 	ankiConnectURL string
 	client         *http.Client
+	defaultDeck    string
+	defaultModel   string
+	keyCase        string
+	maxRetries     int
+	retryDelay     time.Duration
 }
 
 type AnkiRequest struct {
@@ -36,10 +57,113 @@ type AnkiResponse struct {
 	Error  string      `json:"error,omitempty"`
 }
 
+// ConnectionError is returned by ankiRequest when AnkiConnect could not be
+// reached, e.g. because Anki is not running.
+type ConnectionError struct {
+	Err error
+}
+
+func (e *ConnectionError) Error() string {
+	return fmt.Sprintf("failed to make request: %v", e.Err)
+}
+
+func (e *ConnectionError) Unwrap() error {
+	return e.Err
+}
+
+// AnkiConnectError is returned by ankiRequest when AnkiConnect processed the
+// request but reported an error for the action.
+type AnkiConnectError struct {
+	Action  string
+	Message string
+}
+
+func (e *AnkiConnectError) Error() string {
+	return fmt.Sprintf("AnkiConnect error: %s", e.Message)
+}
+
+// ResponseError is returned by ankiRequest when the AnkiConnect response
+// could not be decoded.
+type ResponseError struct {
+	Err error
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("failed to decode response: %v", e.Err)
+}
+
+func (e *ResponseError) Unwrap() error {
+	return e.Err
+}
+
+// HTTPStatusError is returned by ankiRequest when AnkiConnect answered with
+// a 5xx status, e.g. while Anki is busy syncing.
+type HTTPStatusError struct {
+	StatusCode int
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("AnkiConnect returned HTTP status %d", e.StatusCode)
+}
+
+// retryBaseDelay is the wait before the first retry of a failed request;
+// it doubles with each further attempt.
+const retryBaseDelay = 250 * time.Millisecond
+
+// readOnlyActions are the AnkiConnect actions that don't change the
+// collection, media or GUI, so repeating them is harmless.
+var readOnlyActions = map[string]bool{
+	"canAddNotes":                true,
+	"canAddNotesWithErrorDetail": true,
+	"cardsInfo":                  true,
+	"cardsModTime":               true,
+	"deckNames":                  true,
+	"deckNamesAndIds":            true,
+	"findCards":                  true,
+	"findModelsById":             true,
+	"findNotes":                  true,
+	"getCollectionStatsHTML":     true,
+	"getDeckConfig":              true,
+	"getDeckStats":               true,
+	"getEaseFactors":             true,
+	"getMediaDirPath":            true,
+	"getMediaFilesNames":         true,
+	"getNumCardsReviewedByDay":   true,
+	"getNumCardsReviewedToday":   true,
+	"getPreferences":             true,
+	"getReviewsOfCards":          true,
+	"getTags":                    true,
+	"guiCurrentCard":             true,
+	"modelFieldFonts":            true,
+	"modelFieldNames":            true,
+	"modelFieldsOnTemplates":     true,
+	"modelNamesAndIds":           true,
+	"modelStyling":               true,
+	"modelTemplates":             true,
+	"notesInfo":                  true,
+	"notesModTime":               true,
+	"retrieveMediaFile":          true,
+	"version":                    true,
+}
+
+// isRetryable reports whether a failed request for action may succeed when
+// repeated. A refused connection never reached Anki, so any action can be
+// retried; a 5xx status may come after Anki applied the change, so only
+// read-only actions are. Errors reported by AnkiConnect itself are never
+// retried.
+func isRetryable(action string, err error) bool {
+	if isConnRefused(err) {
+		return true
+	}
+	var statusErr *HTTPStatusError
+	return errors.As(err, &statusErr) && readOnlyActions[action]
+}
+
 func NewAnkiServer(ankiConnectURL string) *AnkiServer {
 	return &AnkiServer{
 		ankiConnectURL: ankiConnectURL,
 		client:         &http.Client{Timeout: 30 * time.Second},
+		retryDelay:     retryBaseDelay,
 	}
 }
 
@@ -58,6 +182,28 @@ func (s *AnkiServer) ankiRequest(ctx context.Context, action string, params inte
 		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
+	delay := s.retryDelay
+	for attempt := 0; ; attempt++ {
+		result, err := s.sendAnkiRequest(ctx, action, reqBody)
+		if err == nil || attempt >= s.maxRetries || !isRetryable(action, err) {
+			return result, err
+		}
+		// Give up early rather than sleep past the caller's deadline
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return nil, err
+		}
+		log.Printf("Retrying %s after error: %v", action, err)
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// sendAnkiRequest makes a single attempt at an AnkiConnect request.
+func (s *AnkiServer) sendAnkiRequest(ctx context.Context, action string, reqBody []byte) (interface{}, error) {
 	httpReq, err := http.NewRequestWithContext(ctx, "POST", s.ankiConnectURL, strings.NewReader(string(reqBody)))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
@@ -66,529 +212,7661 @@ func (s *AnkiServer) ankiRequest(ctx context.Context, action string, params inte
 
 	resp, err := s.client.Do(httpReq)
 	if err != nil {
-		return nil, fmt.Errorf("failed to make request: %w", err)
+		return nil, &ConnectionError{Err: err}
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return nil, &HTTPStatusError{StatusCode: resp.StatusCode}
+	}
+
 	var ankiResp AnkiResponse
 	if err := json.NewDecoder(resp.Body).Decode(&ankiResp); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %w", err)
+		return nil, &ResponseError{Err: err}
 	}
 
 	if ankiResp.Error != "" {
-		return nil, fmt.Errorf("AnkiConnect error: %s", ankiResp.Error)
+		return nil, &AnkiConnectError{Action: action, Message: ankiResp.Error}
 	}
 
 	return ankiResp.Result, nil
 }
 
-func parseIDsFromPath(path string) []string {
-	if path == "" {
-		return nil
+// applyNoteDefaults fills in deckName and modelName on a note when they are
+// absent and a default has been configured.
+func (s *AnkiServer) applyNoteDefaults(note map[string]interface{}) {
+	if _, ok := note["deckName"]; !ok && s.defaultDeck != "" {
+		note["deckName"] = s.defaultDeck
+		log.Printf("Using default deck %q for note", s.defaultDeck)
 	}
-	parts := strings.Split(path, ",")
-	var ids []string
-	for _, part := range parts {
-		if trimmed := strings.TrimSpace(part); trimmed != "" {
-			ids = append(ids, trimmed)
-		}
+	if _, ok := note["modelName"]; !ok && s.defaultModel != "" {
+		note["modelName"] = s.defaultModel
+		log.Printf("Using default model %q for note", s.defaultModel)
 	}
-	return ids
 }
 
-func encodeCursor(data map[string]interface{}) (string, error) {
-	jsonData, err := json.Marshal(data)
+// maxConcurrentRequests bounds how many AnkiConnect requests a single tool
+// call issues in parallel.
+const maxConcurrentRequests = 8
+
+// searchTerm builds a quoted Anki search term such as "deck:My Deck",
+// escaping characters that Anki would otherwise treat as syntax or wildcards.
+func searchTerm(key, value string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `*`, `\*`, `_`, `\_`)
+	return `"` + key + ":" + replacer.Replace(value) + `"`
+}
+
+// deckOnlyTerm searches a deck without its subdecks. deck: searches include
+// subdecks, so excluding them takes a second term; searchTerm escapes
+// wildcards, so the subdeck wildcard is appended.
+func deckOnlyTerm(deck string) string {
+	term := searchTerm("deck", deck)
+	return term + " -" + strings.TrimSuffix(term, `"`) + `::*"`
+}
+
+// isUnsupportedAction reports whether an AnkiConnect error indicates that the
+// running AnkiConnect version does not know the requested action.
+func isUnsupportedAction(err error) bool {
+	var ankiErr *AnkiConnectError
+	return errors.As(err, &ankiErr) && strings.Contains(strings.ToLower(ankiErr.Message), "unsupported action")
+}
+
+// supportsAction asks AnkiConnect through apiReflect whether it provides
+// action.
+func (s *AnkiServer) supportsAction(ctx context.Context, action string) (bool, error) {
+	result, err := s.ankiRequest(ctx, "apiReflect", map[string]interface{}{
+		"scopes":  []string{"actions"},
+		"actions": []string{action},
+	})
 	if err != nil {
-		return "", err
+		return false, err
 	}
-	return base64.StdEncoding.EncodeToString(jsonData), nil
+	reflected, ok := result.(map[string]interface{})
+	if !ok {
+		return false, fmt.Errorf("%w from apiReflect", errUnexpectedResponse)
+	}
+	actions, _ := reflected["actions"].([]interface{})
+	for _, name := range actions {
+		if name == action {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
-func decodeCursor(cursor string) (map[string]interface{}, error) {
-	data, err := base64.StdEncoding.DecodeString(cursor)
+var (
+	// errUnexpectedResponse is wrapped by errors for AnkiConnect results that
+	// do not have the expected shape.
+	errUnexpectedResponse = errors.New("unexpected response format")
+	// errNotFound is wrapped by errors for decks, cards, or notes that do not
+	// exist.
+	errNotFound = errors.New("not found")
+)
+
+// Error codes included in the machine-readable payload of tool errors.
+const (
+	codeInvalidArgument    = "invalid_argument"
+	codeNotFound           = "not_found"
+	codeUnsupported        = "unsupported_action"
+	codeConnection         = "connection_error"
+	codeAnkiConnect        = "anki_connect_error"
+	codeUnexpectedResponse = "unexpected_response"
+	codeInternal           = "internal_error"
+)
+
+// errorCode maps an error returned by ankiRequest to an error code.
+func errorCode(err error) string {
+	var (
+		connErr   *ConnectionError
+		ankiErr   *AnkiConnectError
+		respErr   *ResponseError
+		statusErr *HTTPStatusError
+	)
+	switch {
+	case isUnsupportedAction(err):
+		return codeUnsupported
+	case errors.As(err, &connErr), errors.As(err, &statusErr):
+		return codeConnection
+	case errors.As(err, &ankiErr):
+		return codeAnkiConnect
+	case errors.As(err, &respErr), errors.Is(err, errUnexpectedResponse):
+		return codeUnexpectedResponse
+	case errors.Is(err, errNotFound):
+		return codeNotFound
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return codeConnection
+	default:
+		return codeInternal
+	}
+}
+
+// toolError builds an error result holding the human-readable message
+// followed by a JSON payload with the error code and message.
+func toolError(code, message string) *mcp.CallToolResult {
+	payload, _ := json.Marshal(map[string]string{"code": code, "message": message})
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{
+			&mcp.TextContent{Text: message},
+			&mcp.TextContent{Text: string(payload)},
+		},
+		IsError: true,
+	}
+}
+
+// invalidArgument builds an error result for rejected tool arguments.
+func invalidArgument(message string) *mcp.CallToolResult {
+	return toolError(codeInvalidArgument, message)
+}
+
+// requestError builds an error result for a failed operation, deriving the
+// error code from err.
+func requestError(prefix string, err error) *mcp.CallToolResult {
+	return toolError(errorCode(err), fmt.Sprintf("%s: %v", prefix, err))
+}
+
+// findIDs runs findCards or findNotes and returns the resulting IDs.
+func (s *AnkiServer) findIDs(ctx context.Context, action, query string) ([]int64, error) {
+	ids, err := s.ankiRequest(ctx, action, map[string]interface{}{"query": query})
 	if err != nil {
-		return nil, fmt.Errorf("invalid cursor: %w", err)
+		return nil, err
 	}
-	var result map[string]interface{}
-	if err := json.Unmarshal(data, &result); err != nil {
-		return nil, fmt.Errorf("invalid cursor: %w", err)
+	if ids == nil {
+		return []int64{}, nil
+	}
+	idsSlice, ok := ids.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w from %s", errUnexpectedResponse, action)
+	}
+	result := make([]int64, len(idsSlice))
+	for i, v := range idsSlice {
+		// AnkiConnect always returns numbers as float64
+		f, ok := v.(float64)
+		if !ok {
+			return nil, fmt.Errorf("%w: non-numeric ID in %s result", errUnexpectedResponse, action)
+		}
+		result[i] = int64(f)
 	}
 	return result, nil
 }
 
-func paginateList(items []interface{}, cursor string, pageSize int) (map[string]interface{}, error) {
-	startIndex := 0
-	if cursor != "" {
-		cursorData, err := decodeCursor(cursor)
-		if err != nil {
-			return nil, err
+// chunkSize is how many IDs are sent to AnkiConnect in a single request when
+// fetching info for potentially large result sets.
+const chunkSize = 500
+
+// chunkInts splits ids into consecutive slices of at most size elements.
+func chunkInts(ids []int64, size int) [][]int64 {
+	var chunks [][]int64
+	for start := 0; start < len(ids); start += size {
+		end := start + size
+		if end > len(ids) {
+			end = len(ids)
 		}
-		if startIdx, ok := cursorData["start_index"].(float64); ok {
-			startIndex = int(startIdx)
+		chunks = append(chunks, ids[start:end])
+	}
+	return chunks
+}
+
+// coerceIDs converts note or card IDs given as JSON numbers or numeric
+// strings to integers. Values that aren't whole numbers are returned in
+// dropped so callers can reject them rather than act on a subset.
+func coerceIDs(ids []interface{}) (parsed []int64, dropped []interface{}) {
+	for _, id := range ids {
+		switch v := id.(type) {
+		case string:
+			if intID, err := strconv.ParseInt(v, 10, 64); err == nil {
+				parsed = append(parsed, intID)
+				continue
+			}
+		case float64:
+			if v == math.Trunc(v) {
+				parsed = append(parsed, int64(v))
+				continue
+			}
+		case int:
+			parsed = append(parsed, int64(v))
+			continue
+		case int64:
+			parsed = append(parsed, v)
+			continue
 		}
+		dropped = append(dropped, id)
 	}
+	return parsed, dropped
+}
 
-	endIndex := startIndex + pageSize
-	if endIndex > len(items) {
-		endIndex = len(items)
+// notesInfo fetches notesInfo for ids in chunks.
+func (s *AnkiServer) notesInfo(ctx context.Context, ids []int64) ([]map[string]interface{}, error) {
+	notes := []map[string]interface{}{}
+	for _, chunk := range chunkInts(ids, chunkSize) {
+		result, err := s.ankiRequest(ctx, "notesInfo", map[string]interface{}{"notes": chunk})
+		if err != nil {
+			return nil, err
+		}
+		items, ok := result.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%w from notesInfo", errUnexpectedResponse)
+		}
+		for _, item := range items {
+			if note, ok := item.(map[string]interface{}); ok && len(note) > 0 {
+				notes = append(notes, note)
+			}
+		}
 	}
+	return notes, nil
+}
 
-	pageItems := items[startIndex:endIndex]
-	result := map[string]interface{}{
-		"items": pageItems,
+// cardsInfo fetches cardsInfo for ids in chunks.
+func (s *AnkiServer) cardsInfo(ctx context.Context, ids []int64) ([]map[string]interface{}, error) {
+	cards := []map[string]interface{}{}
+	for _, chunk := range chunkInts(ids, chunkSize) {
+		result, err := s.ankiRequest(ctx, "cardsInfo", map[string]interface{}{"cards": chunk})
+		if err != nil {
+			return nil, err
+		}
+		items, ok := result.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%w from cardsInfo", errUnexpectedResponse)
+		}
+		for _, item := range items {
+			if card, ok := item.(map[string]interface{}); ok && len(card) > 0 {
+				cards = append(cards, card)
+			}
+		}
 	}
+	return cards, nil
+}
 
-	if endIndex < len(items) {
-		nextCursorData := map[string]interface{}{"start_index": endIndex}
-		nextCursor, err := encodeCursor(nextCursorData)
+// reviewsOfCards fetches review logs for ids in chunks, keyed by card ID.
+func (s *AnkiServer) reviewsOfCards(ctx context.Context, ids []int64) (map[string][]map[string]interface{}, error) {
+	reviews := map[string][]map[string]interface{}{}
+	for _, chunk := range chunkInts(ids, chunkSize) {
+		result, err := s.ankiRequest(ctx, "getReviewsOfCards", map[string]interface{}{"cards": chunk})
 		if err != nil {
 			return nil, err
 		}
-		result["nextCursor"] = nextCursor
+		if result == nil {
+			continue
+		}
+		byCard, ok := result.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%w from getReviewsOfCards", errUnexpectedResponse)
+		}
+		for cardID, items := range byCard {
+			list, _ := items.([]interface{})
+			for _, item := range list {
+				if review, ok := item.(map[string]interface{}); ok {
+					reviews[cardID] = append(reviews[cardID], review)
+				}
+			}
+		}
 	}
+	return reviews, nil
+}
 
-	return result, nil
+// startOfDay returns local midnight for t.
+func startOfDay(t time.Time) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
 }
 
-// Tool argument types
-type SearchArgs struct {
-	Query      string `json:"query"`
-	SearchType string `json:"search_type"`
-	Cursor     string `json:"cursor,omitempty"`
+// modelNames returns the sorted names of all note models.
+func (s *AnkiServer) modelNames(ctx context.Context) ([]string, error) {
+	result, err := s.ankiRequest(ctx, "modelNamesAndIds", nil)
+	if err != nil {
+		return nil, err
+	}
+	modelMap, ok := result.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w from modelNamesAndIds", errUnexpectedResponse)
+	}
+	names := make([]string, 0, len(modelMap))
+	for name := range modelMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
 }
 
-type CreateNotesArgs struct {
-	Notes []map[string]interface{} `json:"notes"`
+// modelFieldNames returns the ordered field names of a model.
+func (s *AnkiServer) modelFieldNames(ctx context.Context, modelName string) ([]string, error) {
+	result, err := s.ankiRequest(ctx, "modelFieldNames", map[string]interface{}{"modelName": modelName})
+	if err != nil {
+		return nil, err
+	}
+	items, ok := result.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w from modelFieldNames", errUnexpectedResponse)
+	}
+	names := make([]string, 0, len(items))
+	for _, item := range items {
+		if name, ok := item.(string); ok {
+			names = append(names, name)
+		}
+	}
+	return names, nil
 }
 
-type UpdateNoteArgs struct {
-	Note map[string]interface{} `json:"note"`
+// modelTemplates returns a model's card templates keyed by template name.
+func (s *AnkiServer) modelTemplates(ctx context.Context, modelName string) (map[string]interface{}, error) {
+	result, err := s.ankiRequest(ctx, "modelTemplates", map[string]interface{}{"modelName": modelName})
+	if err != nil {
+		return nil, err
+	}
+	templates, ok := result.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w from modelTemplates", errUnexpectedResponse)
+	}
+	return templates, nil
 }
 
-type ManageTagsArgs struct {
-	Action         string        `json:"action"`
-	NoteIDs        []interface{} `json:"note_ids"`
-	Tags           string        `json:"tags"`
-	TagToReplace   string        `json:"tag_to_replace,omitempty"`
-	ReplaceWithTag string        `json:"replace_with_tag,omitempty"`
+// reviewsByDay returns the number of cards reviewed per day, keyed by
+// YYYY-MM-DD, from getNumCardsReviewedByDay.
+func (s *AnkiServer) reviewsByDay(ctx context.Context) (map[string]int, error) {
+	result, err := s.ankiRequest(ctx, "getNumCardsReviewedByDay", nil)
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return map[string]int{}, nil
+	}
+	items, ok := result.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w from getNumCardsReviewedByDay", errUnexpectedResponse)
+	}
+	byDay := make(map[string]int, len(items))
+	for _, item := range items {
+		pair, ok := item.([]interface{})
+		if !ok || len(pair) != 2 {
+			continue
+		}
+		day, _ := pair[0].(string)
+		count, _ := pair[1].(float64)
+		byDay[day] = int(count)
+	}
+	return byDay, nil
 }
 
-type ChangeCardStateArgs struct {
-	Action      string        `json:"action"`
-	CardIDs     []interface{} `json:"card_ids"`
-	Days        string        `json:"days,omitempty"`
-	EaseFactors []int         `json:"ease_factors,omitempty"`
+// deckConfigID returns the ID of the options group assigned to a deck.
+func (s *AnkiServer) deckConfigID(ctx context.Context, deck string) (float64, error) {
+	configMap, err := s.deckConfig(ctx, deck)
+	if err != nil {
+		return 0, err
+	}
+	id, ok := configMap["id"].(float64)
+	if !ok {
+		return 0, fmt.Errorf("%w from getDeckConfig", errUnexpectedResponse)
+	}
+	return id, nil
 }
 
-type GUIControlArgs struct {
-	Action string `json:"action"`
-	Ease   *int   `json:"ease,omitempty"`
+// deckConfig returns the options group used by a deck.
+func (s *AnkiServer) deckConfig(ctx context.Context, deck string) (map[string]interface{}, error) {
+	config, err := s.ankiRequest(ctx, "getDeckConfig", map[string]interface{}{"deck": deck})
+	if err != nil {
+		return nil, err
+	}
+	configMap, ok := config.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("deck %s %w", deck, errNotFound)
+	}
+	return configMap, nil
 }
 
-type DeleteNotesArgs struct {
-	NoteIDs []interface{} `json:"note_ids"`
+// modTimes runs notesModTime or cardsModTime for ids in chunks and returns
+// the modification time in seconds keyed by ID.
+func (s *AnkiServer) modTimes(ctx context.Context, action, paramKey, idKey string, ids []int64) (map[int64]int64, error) {
+	times := make(map[int64]int64, len(ids))
+	for _, chunk := range chunkInts(ids, chunkSize) {
+		result, err := s.ankiRequest(ctx, action, map[string]interface{}{paramKey: chunk})
+		if err != nil {
+			return nil, err
+		}
+		items, ok := result.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%w from %s", errUnexpectedResponse, action)
+		}
+		for _, item := range items {
+			entry, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			id, _ := entry[idKey].(float64)
+			mod, _ := entry["mod"].(float64)
+			times[int64(id)] = int64(mod)
+		}
+	}
+	return times, nil
 }
 
-type UpdateDeckConfigArgs struct {
-	Config map[string]interface{} `json:"config"`
+// noteFieldValue returns the value of a field from a notesInfo entry.
+func noteFieldValue(note map[string]interface{}, field string) (string, bool) {
+	fields, ok := note["fields"].(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	fieldData, ok := fields[field].(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	value, ok := fieldData["value"].(string)
+	return value, ok
 }
 
-// Tool handlers
-func (s *AnkiServer) handleSearch(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[SearchArgs]) (*mcp.CallToolResult, error) {
-	args := params.Arguments
+// snakeCase converts a camelCase identifier such as "deckName" to
+// "deck_name". A leading capital and runs of capitals are left untouched.
+func snakeCase(key string) string {
+	var b strings.Builder
+	runes := []rune(key)
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1])) {
+			b.WriteByte('_')
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
 
-	if args.SearchType != "cards" && args.SearchType != "notes" {
-		return &mcp.CallToolResult{
-			Content: []mcp.Content{&mcp.TextContent{Text: "search_type must be 'cards' or 'notes'"}},
-			IsError: true,
-		}, nil
+// camelCase converts a snake_case identifier such as "deck_name" to
+// "deckName".
+func camelCase(key string) string {
+	parts := strings.Split(key, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
 	}
+	return strings.Join(parts, "")
+}
 
-	var resultIDs []int
-	var data []interface{}
+// identifierKey matches map keys shaped like identifiers. Keys such as
+// "My Deck" or numeric IDs are never converted.
+var identifierKey = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+
+// dataKeyed lists result keys whose value is a map keyed by user data such
+// as field, deck, tag or template names, or dates. Those keys are returned
+// verbatim; only the values below them are normalized.
+var dataKeyed = map[string]bool{
+	"by_day":        true,
+	"by_deck":       true,
+	"counts":        true,
+	"decks":         true,
+	"field_mapping": true,
+	"fields":        true,
+	"issues":        true,
+	"matches":       true,
+	"templates":     true,
+}
 
-	if args.SearchType == "cards" {
-		ids, err := s.ankiRequest(ctx, "findCards", map[string]interface{}{"query": args.Query})
-		if err != nil {
-			return &mcp.CallToolResult{
-				Content: []mcp.Content{&mcp.TextContent{Text: fmt.Sprintf("Error finding cards: %v", err)}},
-				IsError: true,
-			}, nil
-		}
-		if ids == nil {
-			resultIDs = []int{}
-		} else {
-			idsSlice, ok := ids.([]interface{})
-			if !ok {
-				return &mcp.CallToolResult{
-					Content: []mcp.Content{&mcp.TextContent{Text: "Unexpected response format from findCards"}},
-					IsError: true,
-				}, nil
-			}
-			resultIDs = make([]int, len(idsSlice))
-			for i, v := range idsSlice {
-				// AnkiConnect always returns numbers as float64
-				if f, ok := v.(float64); ok {
-					resultIDs[i] = int(f)
-				} else {
-					return &mcp.CallToolResult{
-						Content: []mcp.Content{&mcp.TextContent{Text: "Non-numeric ID in findCards result"}},
-						IsError: true,
-					}, nil
-				}
-			}
-		}
+// normalizeKeys recursively rewrites map keys with convert, leaving the keys
+// of data-keyed maps untouched.
+func normalizeKeys(v interface{}, convert func(string) string) interface{} {
+	return normalizeMap(v, convert, false)
+}
 
-		if len(resultIDs) == 0 {
-			data = []interface{}{}
-		} else {
-			cardsData, err := s.ankiRequest(ctx, "cardsInfo", map[string]interface{}{"cards": resultIDs})
-			if err != nil {
-				return &mcp.CallToolResult{
-					Content: []mcp.Content{&mcp.TextContent{Text: fmt.Sprintf("Error getting cards info: %v", err)}},
-					IsError: true,
-				}, nil
+func normalizeMap(v interface{}, convert func(string) string, keepKeys bool) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			if keepKeys {
+				result[key] = normalizeKeys(item, convert)
+				continue
 			}
-			if cardsData == nil {
-				data = []interface{}{}
-			} else {
-				if cardsSlice, ok := cardsData.([]interface{}); ok {
-					data = cardsSlice
-				} else {
-					return &mcp.CallToolResult{
-						Content: []mcp.Content{&mcp.TextContent{Text: "Unexpected response format from cardsInfo"}},
-						IsError: true,
-					}, nil
-				}
+			keepChildKeys := dataKeyed[snakeCase(key)]
+			if identifierKey.MatchString(key) {
+				key = convert(key)
 			}
+			result[key] = normalizeMap(item, convert, keepChildKeys)
 		}
-	} else {
-		ids, err := s.ankiRequest(ctx, "findNotes", map[string]interface{}{"query": args.Query})
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(value))
+		for i, item := range value {
+			result[i] = normalizeKeys(item, convert)
+		}
+		return result
+	default:
+		return v
+	}
+}
+
+// marshalResult encodes a handler result as JSON, applying the configured key
+// normalization.
+func (s *AnkiServer) marshalResult(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || s.keyCase == "" {
+		return data, err
+	}
+
+	var convert func(string) string
+	switch s.keyCase {
+	case "snake":
+		convert = snakeCase
+	case "camel":
+		convert = camelCase
+	default:
+		return data, nil
+	}
+
+	var decoded interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return nil, err
+	}
+	return json.Marshal(normalizeKeys(decoded, convert))
+}
+
+// allQuery is the search used when a tool's query is left empty.
+const allQuery = "deck:*"
+
+var (
+	// htmlMediaPattern matches the tags Anki's Check Media looks at, skipping
+	// over quoted attribute values so a "src=" inside alt text isn't taken.
+	htmlMediaPattern = regexp.MustCompile(`(?is)<(?:img|audio|video|source|track|object|embed)\b(?:[^>"']|"[^"]*"|'[^']*')*?\s(?:src|data)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))`)
+	soundPattern     = regexp.MustCompile(`\[sound:([^\]]+)\]`)
+	cssURLPattern    = regexp.MustCompile(`(?i)\burl\(\s*(?:"([^"]*)"|'([^']*)'|([^)\s]*))\s*\)`)
+)
+
+// mediaReferences returns the media filenames referenced by HTML or CSS
+// through src/data attributes of media tags, [sound:] markers and url()
+// values. Remote URLs are ignored and percent-encoded names are decoded.
+func mediaReferences(text string) []string {
+	var refs []string
+	addURL := func(match []string) {
+		name := html.UnescapeString(match[1] + match[2] + match[3])
+		if name == "" || strings.Contains(name, "://") || strings.HasPrefix(name, "data:") {
+			return
+		}
+		if decoded, err := url.PathUnescape(name); err == nil {
+			name = decoded
+		}
+		refs = append(refs, name)
+	}
+	for _, match := range htmlMediaPattern.FindAllStringSubmatch(text, -1) {
+		addURL(match)
+	}
+	for _, match := range soundPattern.FindAllStringSubmatch(text, -1) {
+		refs = append(refs, html.UnescapeString(match[1]))
+	}
+	for _, match := range cssURLPattern.FindAllStringSubmatch(text, -1) {
+		addURL(match)
+	}
+	return refs
+}
+
+// modelMediaReferences returns the media filenames referenced by the card
+// templates and styling of every note model, such as fonts loaded from CSS.
+func (s *AnkiServer) modelMediaReferences(ctx context.Context) ([]string, error) {
+	modelNames, err := s.modelNames(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var refs []string
+	for _, modelName := range modelNames {
+		templates, err := s.modelTemplates(ctx, modelName)
+		if err != nil {
+			return nil, err
+		}
+		for _, template := range templates {
+			sides, _ := template.(map[string]interface{})
+			for _, side := range sides {
+				if text, ok := side.(string); ok {
+					refs = append(refs, mediaReferences(text)...)
+				}
+			}
+		}
+
+		styling, err := s.ankiRequest(ctx, "modelStyling", map[string]interface{}{"modelName": modelName})
+		if err != nil {
+			return nil, err
+		}
+		stylingMap, ok := styling.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%w from modelStyling", errUnexpectedResponse)
+		}
+		css, _ := stylingMap["css"].(string)
+		refs = append(refs, mediaReferences(css)...)
+	}
+	return refs, nil
+}
+
+// mediaFileNames lists media files matching pattern via getMediaFilesNames.
+func (s *AnkiServer) mediaFileNames(ctx context.Context, pattern string) ([]string, error) {
+	result, err := s.ankiRequest(ctx, "getMediaFilesNames", map[string]interface{}{"pattern": pattern})
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return []string{}, nil
+	}
+	items, ok := result.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w from getMediaFilesNames", errUnexpectedResponse)
+	}
+	names := make([]string, 0, len(items))
+	for _, item := range items {
+		if name, ok := item.(string); ok {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// noteMediaReferences returns the media filenames referenced across all
+// fields of a notesInfo entry.
+func noteMediaReferences(note map[string]interface{}) []string {
+	fields, _ := note["fields"].(map[string]interface{})
+	var refs []string
+	for _, field := range fields {
+		fieldData, ok := field.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		value, _ := fieldData["value"].(string)
+		refs = append(refs, mediaReferences(value)...)
+	}
+	return refs
+}
+
+// validateMediaFilename rejects filenames AnkiConnect would refuse or that
+// would escape the media folder.
+func validateMediaFilename(name string) error {
+	if strings.TrimSpace(name) == "" {
+		return fmt.Errorf("filename must not be empty")
+	}
+	if strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("filename %q must not contain path separators", name)
+	}
+	if name == "." || name == ".." {
+		return fmt.Errorf("filename %q is not valid", name)
+	}
+	return nil
+}
+
+// findIDsConcurrently runs findCards or findNotes for each query with bounded
+// parallelism, returning the IDs in the same order as queries.
+func (s *AnkiServer) findIDsConcurrently(ctx context.Context, action string, queries []string) ([][]int64, error) {
+	results := make([][]int64, len(queries))
+	errs := make([]error, len(queries))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxConcurrentRequests)
+	for i, query := range queries {
+		wg.Add(1)
+		go func(i int, query string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i], errs[i] = s.findIDs(ctx, action, query)
+		}(i, query)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// noteFields flattens the fields of a notesInfo entry to name -> value.
+func noteFields(note map[string]interface{}) map[string]string {
+	fields, _ := note["fields"].(map[string]interface{})
+	result := make(map[string]string, len(fields))
+	for name, field := range fields {
+		if fieldData, ok := field.(map[string]interface{}); ok {
+			result[name], _ = fieldData["value"].(string)
+		}
+	}
+	return result
+}
+
+// orderedFieldValues returns the values of a notesInfo entry's fields in the
+// model's field order.
+func orderedFieldValues(note map[string]interface{}) []string {
+	fields, _ := note["fields"].(map[string]interface{})
+	type field struct {
+		order float64
+		value string
+	}
+	ordered := make([]field, 0, len(fields))
+	for _, f := range fields {
+		if fieldData, ok := f.(map[string]interface{}); ok {
+			order, _ := fieldData["order"].(float64)
+			value, _ := fieldData["value"].(string)
+			ordered = append(ordered, field{order, value})
+		}
+	}
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i].order < ordered[j].order })
+	values := make([]string, len(ordered))
+	for i, f := range ordered {
+		values[i] = f.value
+	}
+	return values
+}
+
+var htmlTagPattern = regexp.MustCompile(`<[^>]*>`)
+
+// stripHTML removes HTML tags and decodes entities, leaving plain text.
+func stripHTML(text string) string {
+	return html.UnescapeString(htmlTagPattern.ReplaceAllString(text, ""))
+}
+
+func parseIDsFromPath(path string) []string {
+	if path == "" {
+		return nil
+	}
+	parts := strings.Split(path, ",")
+	var ids []string
+	for _, part := range parts {
+		if trimmed := strings.TrimSpace(part); trimmed != "" {
+			ids = append(ids, trimmed)
+		}
+	}
+	return ids
+}
+
+func encodeCursor(data map[string]interface{}) (string, error) {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(jsonData), nil
+}
+
+func decodeCursor(cursor string) (map[string]interface{}, error) {
+	data, err := base64.StdEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor: %w", err)
+	}
+	var result map[string]interface{}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("invalid cursor: %w", err)
+	}
+	return result, nil
+}
+
+// Page sizes for search results.
+const (
+	defaultPageSize = 100
+	maxPageSize     = 500
+)
+
+// clampPageSize applies the default to an unset page size and limits it to
+// 1..maxPageSize.
+func clampPageSize(pageSize int) int {
+	switch {
+	case pageSize == 0:
+		return defaultPageSize
+	case pageSize < 1:
+		return 1
+	case pageSize > maxPageSize:
+		return maxPageSize
+	}
+	return pageSize
+}
+
+func paginateList(items []interface{}, cursor string, pageSize int) (map[string]interface{}, error) {
+	startIndex := 0
+	if cursor != "" {
+		cursorData, err := decodeCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+		if startIdx, ok := cursorData["start_index"].(float64); ok {
+			startIndex = int(startIdx)
+		}
+	}
+	// The cursor only stores an index, so it may come from a larger result
+	if startIndex > len(items) {
+		startIndex = len(items)
+	}
+
+	endIndex := startIndex + pageSize
+	if endIndex > len(items) {
+		endIndex = len(items)
+	}
+
+	pageItems := items[startIndex:endIndex]
+	result := map[string]interface{}{
+		"items":       pageItems,
+		"start_index": startIndex,
+		"page_size":   pageSize,
+		"has_more":    endIndex < len(items),
+	}
+
+	if endIndex < len(items) {
+		nextCursorData := map[string]interface{}{"start_index": endIndex}
+		nextCursor, err := encodeCursor(nextCursorData)
+		if err != nil {
+			return nil, err
+		}
+		result["nextCursor"] = nextCursor
+	}
+
+	return result, nil
+}
+
+// Tool argument types
+type SearchArgs struct {
+	Query      string `json:"query"`
+	SearchType string `json:"search_type"`
+	Cursor     string `json:"cursor,omitempty"`
+	PageSize   int    `json:"page_size,omitempty"`
+}
+
+type CreateNotesArgs struct {
+	Notes  []map[string]interface{} `json:"notes"`
+	Verify bool                     `json:"verify,omitempty"`
+}
+
+type UpdateNoteArgs struct {
+	Note map[string]interface{} `json:"note"`
+}
+
+type ManageTagsArgs struct {
+	Action         string        `json:"action"`
+	NoteIDs        []interface{} `json:"note_ids"`
+	Tags           string        `json:"tags"`
+	TagToReplace   string        `json:"tag_to_replace,omitempty"`
+	ReplaceWithTag string        `json:"replace_with_tag,omitempty"`
+}
+
+type ChangeCardStateArgs struct {
+	Action      string        `json:"action"`
+	CardIDs     []interface{} `json:"card_ids"`
+	Days        string        `json:"days,omitempty"`
+	EaseFactors []int         `json:"ease_factors,omitempty"`
+}
+
+type GUIControlArgs struct {
+	Action string `json:"action"`
+	Ease   *int   `json:"ease,omitempty"`
+}
+
+type DeleteNotesArgs struct {
+	NoteIDs []interface{} `json:"note_ids"`
+}
+
+type UpdateDeckConfigArgs struct {
+	Config map[string]interface{} `json:"config"`
+}
+
+type EmptyDecksArgs struct {
+	Delete  bool `json:"delete,omitempty"`
+	Confirm bool `json:"confirm,omitempty"`
+}
+
+type SchedulerArgs struct {
+	Set *int `json:"set,omitempty"`
+}
+
+type FindNotesByValuesArgs struct {
+	Model  string   `json:"model"`
+	Field  string   `json:"field"`
+	Values []string `json:"values"`
+}
+
+type FindBrokenMediaArgs struct {
+	Query string `json:"query,omitempty"`
+}
+
+type FindOrphanMediaArgs struct {
+	Delete  bool `json:"delete,omitempty"`
+	Confirm bool `json:"confirm,omitempty"`
+}
+
+type MediaURL struct {
+	Filename string `json:"filename"`
+	URL      string `json:"url"`
+}
+
+type StoreMediaFromURLsArgs struct {
+	Items []MediaURL `json:"items"`
+}
+
+type WorkloadForecastArgs struct {
+	Days int `json:"days,omitempty"`
+}
+
+type AddReverseArgs struct {
+	Query   string `json:"query"`
+	Confirm bool   `json:"confirm,omitempty"`
+}
+
+type BackupArgs struct {
+	Directory string `json:"directory"`
+}
+
+type DueTodayArgs struct {
+	Deck string `json:"deck,omitempty"`
+}
+
+type SessionPaceArgs struct{}
+
+type HandleLeechesArgs struct {
+	Strategy string `json:"strategy"`
+	Deck     string `json:"deck,omitempty"`
+	Days     string `json:"days,omitempty"`
+}
+
+type ModelSummaryArgs struct{}
+
+type FindFieldIssuesArgs struct {
+	Query string `json:"query"`
+}
+
+type SetFieldStyleArgs struct {
+	ModelName string `json:"model_name"`
+	Field     string `json:"field"`
+	Font      string `json:"font,omitempty"`
+	Size      *int   `json:"size,omitempty"`
+}
+
+type ExportDeckConfigArgs struct {
+	Deck string `json:"deck"`
+}
+
+type ImportDeckConfigArgs struct {
+	Name   string                 `json:"name"`
+	Config map[string]interface{} `json:"config"`
+	Decks  []string               `json:"decks,omitempty"`
+}
+
+type ReviewsInRangeArgs struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+type AuditFormattingArgs struct {
+	Query string `json:"query"`
+	Fix   bool   `json:"fix,omitempty"`
+}
+
+type SpreadDueArgs struct {
+	CardIDs  []interface{} `json:"card_ids,omitempty"`
+	Query    string        `json:"query,omitempty"`
+	StartDay int           `json:"start_day"`
+	EndDay   int           `json:"end_day"`
+}
+
+type CurrentCardDetailArgs struct{}
+
+type ModifiedNotesArgs struct {
+	Days int `json:"days,omitempty"`
+}
+
+type PauseNewArgs struct {
+	Deck string `json:"deck"`
+}
+
+type DeckHealthArgs struct {
+	Deck string `json:"deck"`
+}
+
+type CloneDeckArgs struct {
+	Source    string `json:"source"`
+	Target    string `json:"target"`
+	CopyNotes bool   `json:"copy_notes,omitempty"`
+}
+
+type ChangesSinceArgs struct {
+	Timestamp int64 `json:"timestamp"`
+}
+
+type GetPreferenceArgs struct {
+	Key string `json:"key"`
+}
+
+type AutoreviewArgs struct {
+	Count int  `json:"count"`
+	Ease  *int `json:"ease,omitempty"`
+}
+
+type StreakArgs struct{}
+
+type SplitByTagArgs struct {
+	Deck    string `json:"deck"`
+	Confirm bool   `json:"confirm,omitempty"`
+}
+
+type FlaggedCardsArgs struct {
+	Deck string `json:"deck,omitempty"`
+}
+
+type NormalizeTagsArgs struct {
+	Query   string `json:"query,omitempty"`
+	Confirm bool   `json:"confirm,omitempty"`
+}
+
+type GradeCardArgs struct {
+	CardID int64 `json:"card_id"`
+	Ease   int   `json:"ease"`
+}
+
+type NoteCreationHistogramArgs struct {
+	Deck string `json:"deck,omitempty"`
+}
+
+type BacklogEstimateArgs struct {
+	Deck string `json:"deck"`
+}
+
+type CreateDeckTreeArgs struct {
+	Decks []string `json:"decks"`
+}
+
+type HardestCardsArgs struct {
+	Query string `json:"query"`
+	Limit int    `json:"limit,omitempty"`
+}
+
+type SetDeckDescriptionArgs struct {
+	Deck        string `json:"deck"`
+	Description string `json:"description"`
+	Markdown    bool   `json:"markdown,omitempty"`
+}
+
+type TagRetentionArgs struct {
+	Tag string `json:"tag"`
+}
+
+type RenderTemplateArgs struct {
+	ModelName string            `json:"model_name"`
+	Fields    map[string]string `json:"fields"`
+}
+
+type ConsolidateModelsArgs struct {
+	SourceModel string `json:"source_model"`
+	TargetModel string `json:"target_model"`
+	Confirm     bool   `json:"confirm,omitempty"`
+}
+
+type FindIdenticalSidesArgs struct {
+	Query string `json:"query"`
+}
+
+type ButtonTrendArgs struct {
+	Days int `json:"days,omitempty"`
+}
+
+type ExplainDeckConfigArgs struct {
+	Deck string `json:"deck"`
+}
+
+type SetDueDateArgs struct {
+	CardIDs []interface{} `json:"card_ids"`
+	Date    string        `json:"date"`
+}
+
+type TagDeckArgs struct {
+	Deck            string `json:"deck"`
+	Tag             string `json:"tag"`
+	IncludeSubdecks *bool  `json:"include_subdecks,omitempty"`
+}
+
+type UnusedModelsArgs struct {
+	Delete bool `json:"delete,omitempty"`
+}
+
+type CompareDecksArgs struct {
+	First  string `json:"first"`
+	Second string `json:"second"`
+}
+
+type FilteredDeckArgs struct {
+	Deck string `json:"deck"`
+}
+
+type SuspendedDueArgs struct {
+	Deck      string `json:"deck,omitempty"`
+	Unsuspend bool   `json:"unsuspend,omitempty"`
+}
+
+type NewRateArgs struct {
+	Deck string `json:"deck"`
+	Days int    `json:"days,omitempty"`
+}
+
+type ExportDecksArgs struct{}
+
+type DeckDuplicatesArgs struct {
+	Deck    string `json:"deck"`
+	Field   string `json:"field"`
+	Confirm bool   `json:"confirm,omitempty"`
+}
+
+type SetCardValuesArgs struct {
+	CardID       int64          `json:"card_id"`
+	Values       map[string]int `json:"values"`
+	WarningCheck bool           `json:"warning_check,omitempty"`
+}
+
+type LearningQueueArgs struct {
+	Deck string `json:"deck,omitempty"`
+}
+
+type BulkSetFieldArgs struct {
+	Field  string            `json:"field"`
+	Values map[string]string `json:"values"`
+}
+
+type ConfigUsageArgs struct {
+	ConfigID int64  `json:"config_id,omitempty"`
+	Name     string `json:"name,omitempty"`
+}
+
+type NeverReviewedArgs struct {
+	Query string `json:"query"`
+}
+
+type ShuffleNewArgs struct {
+	Deck string `json:"deck"`
+}
+
+type NoteHistoryArgs struct {
+	NoteID int64 `json:"note_id"`
+}
+
+type AuditClozeArgs struct {
+	Deck  string `json:"deck,omitempty"`
+	Query string `json:"query,omitempty"`
+}
+
+type MostReviewedArgs struct {
+	Query string `json:"query"`
+	Limit int    `json:"limit,omitempty"`
+}
+
+type SuspendChronicFailsArgs struct {
+	Query     string `json:"query"`
+	Threshold int    `json:"threshold"`
+}
+
+type SubdecksArgs struct {
+	Deck      string `json:"deck"`
+	Recursive bool   `json:"recursive,omitempty"`
+}
+
+type CollectionRetentionArgs struct {
+	Days      int `json:"days,omitempty"`
+	SampleCap int `json:"sample_cap,omitempty"`
+}
+
+type EaseDistributionArgs struct {
+	Query string `json:"query"`
+}
+
+type DeferTodayArgs struct {
+	Deck  string `json:"deck"`
+	Count int    `json:"count"`
+}
+
+type NotesAddedByDeckArgs struct {
+	Days int `json:"days,omitempty"`
+}
+
+type MarkLeechArgs struct {
+	NoteIDs []interface{} `json:"note_ids,omitempty"`
+	Query   string        `json:"query,omitempty"`
+	Leech   bool          `json:"leech"`
+	Suspend bool          `json:"suspend,omitempty"`
+}
+
+type RescheduleModelArgs struct {
+	ModelName string `json:"model_name"`
+	Strategy  string `json:"strategy"`
+	Days      int    `json:"days,omitempty"`
+	Confirm   bool   `json:"confirm,omitempty"`
+}
+
+type TagExistsArgs struct {
+	Tag string `json:"tag"`
+}
+
+type DeadTemplatesArgs struct {
+	ModelName string `json:"model_name"`
+}
+
+type DueDistributionArgs struct {
+	Query string `json:"query"`
+	Days  int    `json:"days,omitempty"`
+}
+
+type CrossModelDuplicatesArgs struct {
+	Field string `json:"field"`
+}
+
+type StoreMediaArgs struct {
+	Filename       string `json:"filename"`
+	Data           string `json:"data,omitempty"`
+	Path           string `json:"path,omitempty"`
+	URL            string `json:"url,omitempty"`
+	DeleteExisting *bool  `json:"delete_existing,omitempty"`
+}
+
+type BackupSizeEstimateArgs struct{}
+
+type RetrieveMediaArgs struct {
+	Filename string `json:"filename"`
+}
+
+type CardsInStepArgs struct {
+	Deck string `json:"deck"`
+	Step int    `json:"step"`
+}
+
+type NotesTagsArgs struct {
+	NoteIDs []interface{} `json:"note_ids"`
+}
+
+type DeleteMediaArgs struct {
+	Filename string `json:"filename"`
+}
+
+type CreateDeckArgs struct {
+	Name string `json:"name"`
+}
+
+type ConvertFieldFormatArgs struct {
+	Query     string `json:"query"`
+	Field     string `json:"field"`
+	Direction string `json:"direction"`
+	Confirm   bool   `json:"confirm,omitempty"`
+}
+
+type DeleteDecksArgs struct {
+	Decks    []string `json:"decks"`
+	CardsToo *bool    `json:"cards_too,omitempty"`
+}
+
+type LargeNotesArgs struct {
+	Query     string `json:"query,omitempty"`
+	Threshold int    `json:"threshold,omitempty"`
+}
+
+type MoveCardsArgs struct {
+	CardIDs []interface{} `json:"card_ids"`
+	Deck    string        `json:"deck"`
+}
+
+type SessionProgressArgs struct {
+	Deck string `json:"deck,omitempty"`
+}
+
+type AddNoteArgs struct {
+	DeckName  string                 `json:"deckName,omitempty"`
+	ModelName string                 `json:"modelName,omitempty"`
+	Fields    map[string]string      `json:"fields"`
+	Tags      []string               `json:"tags,omitempty"`
+	Options   map[string]interface{} `json:"options,omitempty"`
+}
+
+type CanAddNotesArgs struct {
+	Notes []map[string]interface{} `json:"notes"`
+}
+
+// Tool handlers
+func (s *AnkiServer) handleSearch(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[SearchArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if args.SearchType != "cards" && args.SearchType != "notes" {
+		return invalidArgument("search_type must be 'cards' or 'notes'"), nil
+	}
+
+	var resultIDs []int64
+	var data []interface{}
+
+	if args.SearchType == "cards" {
+		ids, err := s.ankiRequest(ctx, "findCards", map[string]interface{}{"query": args.Query})
+		if err != nil {
+			return requestError("Error finding cards", err), nil
+		}
+		if ids == nil {
+			resultIDs = []int64{}
+		} else {
+			idsSlice, ok := ids.([]interface{})
+			if !ok {
+				return toolError(codeUnexpectedResponse, "Unexpected response format from findCards"), nil
+			}
+			resultIDs = make([]int64, len(idsSlice))
+			for i, v := range idsSlice {
+				// AnkiConnect always returns numbers as float64
+				if f, ok := v.(float64); ok {
+					resultIDs[i] = int64(f)
+				} else {
+					return toolError(codeUnexpectedResponse, "Non-numeric ID in findCards result"), nil
+				}
+			}
+		}
+
+		if len(resultIDs) == 0 {
+			data = []interface{}{}
+		} else {
+			cardsData, err := s.ankiRequest(ctx, "cardsInfo", map[string]interface{}{"cards": resultIDs})
+			if err != nil {
+				return requestError("Error getting cards info", err), nil
+			}
+			if cardsData == nil {
+				data = []interface{}{}
+			} else {
+				if cardsSlice, ok := cardsData.([]interface{}); ok {
+					data = cardsSlice
+				} else {
+					return toolError(codeUnexpectedResponse, "Unexpected response format from cardsInfo"), nil
+				}
+			}
+		}
+	} else {
+		ids, err := s.ankiRequest(ctx, "findNotes", map[string]interface{}{"query": args.Query})
+		if err != nil {
+			return requestError("Error finding notes", err), nil
+		}
+		if ids == nil {
+			resultIDs = []int64{}
+		} else {
+			idsSlice, ok := ids.([]interface{})
+			if !ok {
+				return toolError(codeUnexpectedResponse, "Unexpected response format from findNotes"), nil
+			}
+			resultIDs = make([]int64, len(idsSlice))
+			for i, v := range idsSlice {
+				// AnkiConnect always returns numbers as float64
+				if f, ok := v.(float64); ok {
+					resultIDs[i] = int64(f)
+				} else {
+					return toolError(codeUnexpectedResponse, "Non-numeric ID in findNotes result"), nil
+				}
+			}
+		}
+
+		if len(resultIDs) == 0 {
+			data = []interface{}{}
+		} else {
+			notesData, err := s.ankiRequest(ctx, "notesInfo", map[string]interface{}{"notes": resultIDs})
+			if err != nil {
+				return requestError("Error getting notes info", err), nil
+			}
+			if notesData == nil {
+				data = []interface{}{}
+			} else {
+				if notesSlice, ok := notesData.([]interface{}); ok {
+					data = notesSlice
+				} else {
+					return toolError(codeUnexpectedResponse, "Unexpected response format from notesInfo"), nil
+				}
+			}
+		}
+	}
+
+	paginated, err := paginateList(data, args.Cursor, clampPageSize(args.PageSize))
+	if err != nil {
+		return requestError("Error paginating results", err), nil
+	}
+
+	result := map[string]interface{}{
+		"search_type": args.SearchType,
+		"query":       args.Query,
+		"total_found": len(resultIDs),
+		"items":       paginated["items"],
+		"nextCursor":  paginated["nextCursor"],
+		"start_index": paginated["start_index"],
+		"page_size":   paginated["page_size"],
+		"has_more":    paginated["has_more"],
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+func (s *AnkiServer) handleCreateNotes(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[CreateNotesArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	for _, note := range args.Notes {
+		s.applyNoteDefaults(note)
+	}
+
+	result, err := s.ankiRequest(ctx, "addNotes", map[string]interface{}{"notes": args.Notes})
+	if err != nil {
+		return requestError("Error creating notes", err), nil
+	}
+
+	if args.Verify {
+		verification, err := s.verifyCreatedNotes(ctx, args.Notes, result)
+		if err != nil {
+			return requestError("Error verifying notes", err), nil
+		}
+		result = map[string]interface{}{
+			"note_ids":     result,
+			"verification": verification,
+		}
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+func (s *AnkiServer) handleCreateNote(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[AddNoteArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if len(args.Fields) == 0 {
+		return invalidArgument("fields is required"), nil
+	}
+
+	note := map[string]interface{}{"fields": args.Fields}
+	if args.DeckName != "" {
+		note["deckName"] = args.DeckName
+	}
+	if args.ModelName != "" {
+		note["modelName"] = args.ModelName
+	}
+	if len(args.Tags) > 0 {
+		note["tags"] = args.Tags
+	}
+	if args.Options != nil {
+		note["options"] = args.Options
+	}
+	s.applyNoteDefaults(note)
+
+	// Unlike addNotes, addNote reports duplicates and missing fields as an
+	// error rather than a null ID
+	result, err := s.ankiRequest(ctx, "addNote", map[string]interface{}{"note": note})
+	if err != nil {
+		return requestError("Error creating note", err), nil
+	}
+	id, ok := result.(float64)
+	if !ok {
+		return toolError(codeUnexpectedResponse, "addNote did not return a note ID"), nil
+	}
+
+	resultJSON, _ := s.marshalResult(map[string]interface{}{"note_id": int64(id)})
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+// canAddResults aligns a canAddNotes or canAddNotesWithErrorDetail result
+// with the n requested notes. The detailed variant returns objects with an
+// error string for notes that can't be added; the plain one only booleans.
+func canAddResults(result interface{}, n int) ([]map[string]interface{}, error) {
+	items, ok := result.([]interface{})
+	if !ok || len(items) != n {
+		return nil, errUnexpectedResponse
+	}
+	entries := make([]map[string]interface{}, n)
+	for i, item := range items {
+		entry := map[string]interface{}{"index": i, "canAdd": false, "reason": nil}
+		switch v := item.(type) {
+		case bool:
+			entry["canAdd"] = v
+		case map[string]interface{}:
+			canAdd, _ := v["canAdd"].(bool)
+			entry["canAdd"] = canAdd
+			if reason, ok := v["error"].(string); ok && !canAdd {
+				entry["reason"] = reason
+			}
+		default:
+			return nil, errUnexpectedResponse
+		}
+		entries[i] = entry
+	}
+	return entries, nil
+}
+
+func (s *AnkiServer) handleCanAddNotes(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[CanAddNotesArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if len(args.Notes) == 0 {
+		return invalidArgument("notes is required"), nil
+	}
+	for _, note := range args.Notes {
+		s.applyNoteDefaults(note)
+	}
+
+	// canAddNotesWithErrorDetail only exists in newer AnkiConnect versions
+	request := map[string]interface{}{"notes": args.Notes}
+	result, err := s.ankiRequest(ctx, "canAddNotesWithErrorDetail", request)
+	if isUnsupportedAction(err) {
+		result, err = s.ankiRequest(ctx, "canAddNotes", request)
+	}
+	if err != nil {
+		return requestError("Error checking notes", err), nil
+	}
+
+	entries, err := canAddResults(result, len(args.Notes))
+	if err != nil {
+		return toolError(codeUnexpectedResponse, "Unexpected response format from canAddNotes"), nil
+	}
+	addable := 0
+	for _, entry := range entries {
+		if entry["canAdd"] == true {
+			addable++
+		}
+	}
+
+	resultJSON, _ := s.marshalResult(map[string]interface{}{
+		"total":   len(entries),
+		"addable": addable,
+		"notes":   entries,
+	})
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+// fieldDiscrepancies compares the fields requested for a note with the
+// fields Anki stored, returning one entry per mismatching field.
+func fieldDiscrepancies(requested map[string]interface{}, actual map[string]string) []map[string]interface{} {
+	var discrepancies []map[string]interface{}
+	names := make([]string, 0, len(requested))
+	for name := range requested {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		want := fmt.Sprint(requested[name])
+		got, ok := actual[name]
+		if !ok {
+			discrepancies = append(discrepancies, map[string]interface{}{"field": name, "expected": want, "error": "field missing"})
+		} else if got != want {
+			discrepancies = append(discrepancies, map[string]interface{}{"field": name, "expected": want, "actual": got})
+		}
+	}
+	return discrepancies
+}
+
+// verifyCreatedNotes re-fetches the notes returned by addNotes and checks
+// that their fields match what was requested.
+func (s *AnkiServer) verifyCreatedNotes(ctx context.Context, requested []map[string]interface{}, addResult interface{}) ([]map[string]interface{}, error) {
+	ids, _ := addResult.([]interface{})
+	verification := make([]map[string]interface{}, len(requested))
+
+	var createdIDs []int64
+	for i := range requested {
+		entry := map[string]interface{}{"index": i, "ok": false}
+		verification[i] = entry
+		if i >= len(ids) {
+			entry["error"] = "no result returned for note"
+			continue
+		}
+		id, ok := ids[i].(float64)
+		if !ok {
+			entry["error"] = "note was not created"
+			continue
+		}
+		entry["noteId"] = int64(id)
+		createdIDs = append(createdIDs, int64(id))
+	}
+
+	notes, err := s.notesInfo(ctx, createdIDs)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[int64]map[string]interface{}, len(notes))
+	for _, note := range notes {
+		if id, ok := note["noteId"].(float64); ok {
+			byID[int64(id)] = note
+		}
+	}
+
+	for i, entry := range verification {
+		noteID, ok := entry["noteId"].(int64)
+		if !ok {
+			continue
+		}
+		note, ok := byID[noteID]
+		if !ok {
+			entry["error"] = "note not found after creation"
+			continue
+		}
+		requestedFields, _ := requested[i]["fields"].(map[string]interface{})
+		if discrepancies := fieldDiscrepancies(requestedFields, noteFields(note)); len(discrepancies) > 0 {
+			entry["discrepancies"] = discrepancies
+			continue
+		}
+		entry["ok"] = true
+	}
+	return verification, nil
+}
+
+func (s *AnkiServer) handleUpdateNote(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[UpdateNoteArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	_, err := s.ankiRequest(ctx, "updateNote", map[string]interface{}{"note": args.Note})
+	if err != nil {
+		return requestError("Error updating note", err), nil
+	}
+
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: "Note updated successfully"}},
+	}, nil
+}
+
+func (s *AnkiServer) handleManageTags(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[ManageTagsArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	noteIDs, dropped := coerceIDs(args.NoteIDs)
+	if len(dropped) > 0 {
+		return invalidArgument(fmt.Sprintf("Invalid note IDs: %v", dropped)), nil
+	}
+
+	var err error
+	switch args.Action {
+	case "add":
+		_, err = s.ankiRequest(ctx, "addTags", map[string]interface{}{"notes": noteIDs, "tags": args.Tags})
+	case "delete":
+		_, err = s.ankiRequest(ctx, "removeTags", map[string]interface{}{"notes": noteIDs, "tags": args.Tags})
+	case "replace":
+		_, err = s.ankiRequest(ctx, "replaceTags", map[string]interface{}{
+			"notes":            noteIDs,
+			"tag_to_replace":   args.TagToReplace,
+			"replace_with_tag": args.ReplaceWithTag,
+		})
+	default:
+		return invalidArgument(fmt.Sprintf("Invalid action: %s. Must be 'add', 'delete', or 'replace'", args.Action)), nil
+	}
+
+	if err != nil {
+		return requestError("Error managing tags", err), nil
+	}
+
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: "Tags managed successfully"}},
+	}, nil
+}
+
+func (s *AnkiServer) handleChangeCardState(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[ChangeCardStateArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	cardIDs, dropped := coerceIDs(args.CardIDs)
+	if len(dropped) > 0 {
+		return invalidArgument(fmt.Sprintf("Invalid card IDs: %v", dropped)), nil
+	}
+
+	var result interface{}
+	var err error
+
+	switch args.Action {
+	case "suspend":
+		result, err = s.ankiRequest(ctx, "suspend", map[string]interface{}{"cards": cardIDs})
+	case "unsuspend":
+		result, err = s.ankiRequest(ctx, "unsuspend", map[string]interface{}{"cards": cardIDs})
+	case "forget":
+		_, err = s.ankiRequest(ctx, "forgetCards", map[string]interface{}{"cards": cardIDs})
+		result = true
+	case "relearn":
+		_, err = s.ankiRequest(ctx, "relearnCards", map[string]interface{}{"cards": cardIDs})
+		result = true
+	case "set_due":
+		if args.Days == "" {
+			return invalidArgument("days parameter required for set_due action"), nil
+		}
+		result, err = s.ankiRequest(ctx, "setDueDate", map[string]interface{}{"cards": cardIDs, "days": args.Days})
+	case "set_ease":
+		if len(args.EaseFactors) != len(cardIDs) {
+			return invalidArgument("ease_factors must match card_ids length for set_ease action"), nil
+		}
+		result, err = s.ankiRequest(ctx, "setEaseFactors", map[string]interface{}{"cards": cardIDs, "easeFactors": args.EaseFactors})
+	default:
+		return invalidArgument(fmt.Sprintf("Invalid action: %s", args.Action)), nil
+	}
+
+	if err != nil {
+		return requestError("Error changing card state", err), nil
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+func (s *AnkiServer) handleGUIControl(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[GUIControlArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	var result interface{}
+	var err error
+
+	switch args.Action {
+	case "current_card":
+		result, err = s.ankiRequest(ctx, "guiCurrentCard", nil)
+	case "show_answer":
+		result, err = s.ankiRequest(ctx, "guiShowAnswer", nil)
+	case "answer":
+		if args.Ease == nil {
+			return invalidArgument("ease parameter required for answer action"), nil
+		}
+		if *args.Ease < 1 || *args.Ease > 4 {
+			return invalidArgument("ease must be 1 (Again), 2 (Hard), 3 (Good), or 4 (Easy)"), nil
+		}
+		// Ensure the card is on the answer side
+		_, err = s.ankiRequest(ctx, "guiShowAnswer", nil)
+		if err != nil {
+			return requestError("Error showing answer", err), nil
+		}
+		result, err = s.ankiRequest(ctx, "guiAnswerCard", map[string]interface{}{"ease": *args.Ease})
+	case "undo":
+		result, err = s.ankiRequest(ctx, "guiUndo", nil)
+	default:
+		return invalidArgument(fmt.Sprintf("Invalid action: %s. Available actions are: current_card, show_answer, answer, undo", args.Action)), nil
+	}
+
+	if err != nil {
+		return requestError("Error in GUI control", err), nil
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+func (s *AnkiServer) handleDeleteNotes(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[DeleteNotesArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	noteIDs, dropped := coerceIDs(args.NoteIDs)
+	if len(dropped) > 0 {
+		return invalidArgument(fmt.Sprintf("Invalid note IDs: %v", dropped)), nil
+	}
+
+	_, err := s.ankiRequest(ctx, "deleteNotes", map[string]interface{}{"notes": noteIDs})
+	if err != nil {
+		return requestError("Error deleting notes", err), nil
+	}
+
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: "Notes deleted successfully"}},
+	}, nil
+}
+
+func (s *AnkiServer) handleUpdateDeckConfig(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[UpdateDeckConfigArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	result, err := s.ankiRequest(ctx, "saveDeckConfig", map[string]interface{}{"config": args.Config})
+	if err != nil {
+		return requestError("Error updating deck config", err), nil
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+func (s *AnkiServer) handleEmptyDecks(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[EmptyDecksArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	decks, err := s.ankiRequest(ctx, "deckNamesAndIds", nil)
+	if err != nil {
+		return requestError("Error getting decks", err), nil
+	}
+	deckMap, ok := decks.(map[string]interface{})
+	if !ok {
+		return toolError(codeUnexpectedResponse, "Unexpected response format from deckNamesAndIds"), nil
+	}
+
+	var deckNames []string
+	for name, id := range deckMap {
+		// The default deck (id 1) cannot be deleted, so never report it
+		if f, ok := id.(float64); ok && f == 1 {
+			continue
+		}
+		deckNames = append(deckNames, name)
+	}
+
+	queries := make([]string, len(deckNames))
+	for i, name := range deckNames {
+		queries[i] = searchTerm("deck", name)
+	}
+	cardIDs, err := s.findIDsConcurrently(ctx, "findCards", queries)
+	if err != nil {
+		return requestError("Error finding cards", err), nil
+	}
+
+	var emptyDecks []string
+	for i, name := range deckNames {
+		if len(cardIDs[i]) == 0 {
+			emptyDecks = append(emptyDecks, name)
+		}
+	}
+	sort.Strings(emptyDecks)
+	if emptyDecks == nil {
+		emptyDecks = []string{}
+	}
+
+	result := map[string]interface{}{
+		"empty_decks": emptyDecks,
+		"count":       len(emptyDecks),
+		"deleted":     false,
+	}
+
+	if args.Delete && len(emptyDecks) > 0 {
+		if !args.Confirm {
+			result["message"] = "Set confirm to true to delete these decks"
+		} else {
+			_, err := s.ankiRequest(ctx, "deleteDecks", map[string]interface{}{"decks": emptyDecks, "cardsToo": true})
+			if err != nil {
+				return requestError("Error deleting decks", err), nil
+			}
+			result["deleted"] = true
+		}
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+// schedulerVersion derives the active scheduler version from Anki preferences.
+func schedulerVersion(prefs map[string]interface{}) int {
+	if v3, ok := prefs["v3Scheduler"].(bool); ok && v3 {
+		return 3
+	}
+	if v, ok := prefs["schedVer"].(float64); ok {
+		return int(v)
+	}
+	return 1
+}
+
+func (s *AnkiServer) handleScheduler(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[SchedulerArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if args.Set != nil {
+		if *args.Set < 1 || *args.Set > 3 {
+			return invalidArgument("set must be 1, 2, or 3"), nil
+		}
+		_, err := s.ankiRequest(ctx, "setPreferences", map[string]interface{}{
+			"preferences": map[string]interface{}{
+				"schedVer":    min(*args.Set, 2),
+				"v3Scheduler": *args.Set == 3,
+			},
+		})
+		if isUnsupportedAction(err) {
+			return toolError(codeUnsupported, "Changing the scheduler version is not supported by this AnkiConnect version"), nil
+		}
+		if err != nil {
+			return requestError("Error setting scheduler version", err), nil
+		}
+	}
+
+	prefs, err := s.ankiRequest(ctx, "getPreferences", nil)
+	if isUnsupportedAction(err) {
+		return toolError(codeUnsupported, "Reading the scheduler version is not supported by this AnkiConnect version"), nil
+	}
+	if err != nil {
+		return requestError("Error getting preferences", err), nil
+	}
+	prefsMap, ok := prefs.(map[string]interface{})
+	if !ok {
+		return toolError(codeUnexpectedResponse, "Unexpected response format from getPreferences"), nil
+	}
+
+	result := map[string]interface{}{
+		"scheduler_version": schedulerVersion(prefsMap),
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+// maxValuesPerLookup caps how many values anki_find_notes_by_values accepts so
+// the generated search query stays manageable.
+const maxValuesPerLookup = 200
+
+func (s *AnkiServer) handleFindNotesByValues(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[FindNotesByValuesArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if args.Model == "" || args.Field == "" {
+		return invalidArgument("model and field are required"), nil
+	}
+	if len(args.Values) == 0 {
+		return invalidArgument("values must not be empty"), nil
+	}
+	if len(args.Values) > maxValuesPerLookup {
+		return invalidArgument(fmt.Sprintf("at most %d values can be looked up at once", maxValuesPerLookup)), nil
+	}
+
+	terms := make([]string, len(args.Values))
+	for i, value := range args.Values {
+		terms[i] = searchTerm(args.Field, value)
+	}
+	query := searchTerm("note", args.Model) + " (" + strings.Join(terms, " OR ") + ")"
+
+	noteIDs, err := s.findIDs(ctx, "findNotes", query)
+	if err != nil {
+		return requestError("Error finding notes", err), nil
+	}
+	notes, err := s.notesInfo(ctx, noteIDs)
+	if err != nil {
+		return requestError("Error getting notes info", err), nil
+	}
+
+	matches := make(map[string][]int64, len(args.Values))
+	for _, value := range args.Values {
+		matches[value] = []int64{}
+	}
+	for _, note := range notes {
+		fieldValue, ok := noteFieldValue(note, args.Field)
+		if !ok {
+			continue
+		}
+		noteID, _ := note["noteId"].(float64)
+		for _, value := range args.Values {
+			// Anki field searches are case-insensitive
+			if strings.EqualFold(fieldValue, value) {
+				matches[value] = append(matches[value], int64(noteID))
+			}
+		}
+	}
+
+	result := map[string]interface{}{
+		"model":   args.Model,
+		"field":   args.Field,
+		"matches": matches,
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+func (s *AnkiServer) handleFindBrokenMedia(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[FindBrokenMediaArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	query := args.Query
+	if query == "" {
+		query = allQuery
+	}
+
+	noteIDs, err := s.findIDs(ctx, "findNotes", query)
+	if err != nil {
+		return requestError("Error finding notes", err), nil
+	}
+	notes, err := s.notesInfo(ctx, noteIDs)
+	if err != nil {
+		return requestError("Error getting notes info", err), nil
+	}
+	mediaFiles, err := s.mediaFileNames(ctx, "*")
+	if err != nil {
+		return requestError("Error listing media files", err), nil
+	}
+
+	existing := make(map[string]bool, len(mediaFiles))
+	for _, name := range mediaFiles {
+		existing[name] = true
+	}
+
+	brokenNotes := []map[string]interface{}{}
+	for _, note := range notes {
+		var missing []string
+		seen := map[string]bool{}
+		for _, ref := range noteMediaReferences(note) {
+			if !existing[ref] && !seen[ref] {
+				seen[ref] = true
+				missing = append(missing, ref)
+			}
+		}
+		if len(missing) > 0 {
+			brokenNotes = append(brokenNotes, map[string]interface{}{
+				"noteId":        note["noteId"],
+				"modelName":     note["modelName"],
+				"missing_media": missing,
+			})
+		}
+	}
+
+	result := map[string]interface{}{
+		"query":         query,
+		"notes_scanned": len(notes),
+		"broken_notes":  brokenNotes,
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+func (s *AnkiServer) handleFindOrphanMedia(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[FindOrphanMediaArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	mediaFiles, err := s.mediaFileNames(ctx, "*")
+	if err != nil {
+		return requestError("Error listing media files", err), nil
+	}
+	noteIDs, err := s.findIDs(ctx, "findNotes", allQuery)
+	if err != nil {
+		return requestError("Error finding notes", err), nil
+	}
+	notes, err := s.notesInfo(ctx, noteIDs)
+	if err != nil {
+		return requestError("Error getting notes info", err), nil
+	}
+
+	modelRefs, err := s.modelMediaReferences(ctx)
+	if err != nil {
+		return requestError("Error reading note model templates", err), nil
+	}
+
+	referenced := map[string]bool{}
+	for _, ref := range modelRefs {
+		referenced[ref] = true
+	}
+	for _, note := range notes {
+		for _, ref := range noteMediaReferences(note) {
+			referenced[ref] = true
+		}
+	}
+
+	orphans := []string{}
+	for _, name := range mediaFiles {
+		// Anki keeps files starting with "_" since templates may use them, and
+		// regenerates latex- images from the [latex] markup in fields
+		if strings.HasPrefix(name, "_") || strings.HasPrefix(name, "latex-") || referenced[name] {
+			continue
+		}
+		orphans = append(orphans, name)
+	}
+	sort.Strings(orphans)
+
+	result := map[string]interface{}{
+		"orphan_media": orphans,
+		"count":        len(orphans),
+		"deleted":      0,
+	}
+
+	if args.Delete && len(orphans) > 0 {
+		if !args.Confirm {
+			result["message"] = "Set confirm to true to delete these media files"
+		} else {
+			deleted := 0
+			for _, name := range orphans {
+				if _, err := s.ankiRequest(ctx, "deleteMediaFile", map[string]interface{}{"filename": name}); err != nil {
+					return requestError(fmt.Sprintf("Error deleting media file %s after deleting %d files", name, deleted), err), nil
+				}
+				deleted++
+			}
+			result["deleted"] = deleted
+		}
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+// maxMediaBatch caps how many media files a single tool call may store.
+const maxMediaBatch = 50
+
+func (s *AnkiServer) handleStoreMediaFromURLs(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[StoreMediaFromURLsArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if len(args.Items) == 0 {
+		return invalidArgument("items must not be empty"), nil
+	}
+	if len(args.Items) > maxMediaBatch {
+		return invalidArgument(fmt.Sprintf("at most %d media files can be stored at once", maxMediaBatch)), nil
+	}
+
+	results := make([]map[string]interface{}, len(args.Items))
+	stored := 0
+	for i, item := range args.Items {
+		itemResult := map[string]interface{}{
+			"filename": item.Filename,
+			"url":      item.URL,
+			"success":  false,
+		}
+		results[i] = itemResult
+
+		if err := validateMediaFilename(item.Filename); err != nil {
+			itemResult["error"] = err.Error()
+			continue
+		}
+		if u, err := url.Parse(item.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			itemResult["error"] = "url must be an http or https URL"
+			continue
+		}
+
+		storedName, err := s.ankiRequest(ctx, "storeMediaFile", map[string]interface{}{
+			"filename": item.Filename,
+			"url":      item.URL,
+		})
+		if err != nil {
+			itemResult["error"] = err.Error()
+			continue
+		}
+		itemResult["success"] = true
+		itemResult["stored_as"] = storedName
+		stored++
+	}
+
+	result := map[string]interface{}{
+		"stored":  stored,
+		"failed":  len(args.Items) - stored,
+		"results": results,
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+func (s *AnkiServer) handleWorkloadForecast(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[WorkloadForecastArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	days := args.Days
+	if days == 0 {
+		days = 7
+	}
+	if days < 1 || days > 365 {
+		return invalidArgument("days must be between 1 and 365"), nil
+	}
+
+	queries := make([]string, days)
+	for i := range queries {
+		queries[i] = fmt.Sprintf("prop:due=%d", i)
+	}
+	cardIDs, err := s.findIDsConcurrently(ctx, "findCards", queries)
+	if err != nil {
+		return requestError("Error finding cards", err), nil
+	}
+
+	today := time.Now()
+	forecast := make([]map[string]interface{}, days)
+	total := 0
+	for i := range forecast {
+		forecast[i] = map[string]interface{}{
+			"day":  i,
+			"date": today.AddDate(0, 0, i).Format("2006-01-02"),
+			"due":  len(cardIDs[i]),
+		}
+		total += len(cardIDs[i])
+	}
+
+	result := map[string]interface{}{
+		"days":     days,
+		"total":    total,
+		"forecast": forecast,
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+const (
+	basicModel    = "Basic"
+	reversedModel = "Basic (and reversed card)"
+)
+
+func (s *AnkiServer) handleAddReverse(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[AddReverseArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	query := searchTerm("note", basicModel)
+	if args.Query != "" {
+		query = "(" + args.Query + ") " + query
+	}
+
+	noteIDs, err := s.findIDs(ctx, "findNotes", query)
+	if err != nil {
+		return requestError("Error finding notes", err), nil
+	}
+
+	// Either note type may have renamed or extra fields, so fields are
+	// matched by name, or by position when both have the same number
+	sourceFields, err := s.modelFieldNames(ctx, basicModel)
+	if err != nil {
+		return requestError(fmt.Sprintf("Error getting fields of %s", basicModel), err), nil
+	}
+	targetFields, err := s.modelFieldNames(ctx, reversedModel)
+	if err != nil {
+		return requestError(fmt.Sprintf("Error getting fields of %s", reversedModel), err), nil
+	}
+	mapping, unmapped := mapFieldsByName(sourceFields, targetFields)
+	if len(unmapped) > 0 && len(sourceFields) == len(targetFields) {
+		mapping, unmapped = map[string]string{}, nil
+		for i, field := range sourceFields {
+			mapping[field] = targetFields[i]
+		}
+	}
+
+	result := map[string]interface{}{
+		"query":           query,
+		"matched":         len(noteIDs),
+		"field_mapping":   mapping,
+		"unmapped_fields": unmapped,
+		"converted":       0,
+	}
+
+	if len(unmapped) > 0 && len(noteIDs) > 0 {
+		if args.Confirm {
+			return invalidArgument(fmt.Sprintf("Fields %s of %q have no counterpart in %q and would be lost; use anki_consolidate_models to convert these notes", strings.Join(unmapped, ", "), basicModel, reversedModel)), nil
+		}
+		result["message"] = fmt.Sprintf("Fields %s have no counterpart in %q, so these notes can't be converted without losing content", strings.Join(unmapped, ", "), reversedModel)
+	}
+
+	if !args.Confirm || len(noteIDs) == 0 {
+		if len(noteIDs) > 0 && len(unmapped) == 0 {
+			result["message"] = fmt.Sprintf("Set confirm to true to convert these notes to %q", reversedModel)
+		}
+		resultJSON, _ := s.marshalResult(result)
+		return &mcp.CallToolResult{
+			Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+		}, nil
+	}
+
+	notes, err := s.notesInfo(ctx, noteIDs)
+	if err != nil {
+		return requestError("Error getting notes info", err), nil
+	}
+
+	converted := 0
+	for _, note := range notes {
+		values := noteFields(note)
+		fields := make(map[string]interface{}, len(mapping))
+		for from, to := range mapping {
+			fields[to] = values[from]
+		}
+		_, err := s.ankiRequest(ctx, "updateNoteModel", map[string]interface{}{
+			"note": map[string]interface{}{
+				"id":        note["noteId"],
+				"modelName": reversedModel,
+				"fields":    fields,
+				"tags":      note["tags"],
+			},
+		})
+		if err != nil {
+			return requestError(fmt.Sprintf("Error converting note %v after converting %d notes", note["noteId"], converted), err), nil
+		}
+		converted++
+	}
+	result["converted"] = converted
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+// backupFileName turns a deck name into a file name unique within used,
+// which holds the lowercased names already taken.
+func backupFileName(prefix, deck string, used map[string]bool) string {
+	base := prefix + strings.NewReplacer("/", "_", `\`, "_", ":", "_").Replace(deck)
+	name := base + ".apkg"
+	for i := 2; used[strings.ToLower(name)]; i++ {
+		name = fmt.Sprintf("%s-%d.apkg", base, i)
+	}
+	used[strings.ToLower(name)] = true
+	return name
+}
+
+func (s *AnkiServer) handleBackup(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[BackupArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	// The packages are written by Anki, so the directory is on the machine
+	// running Anki and has to exist there already
+	if args.Directory == "" {
+		return invalidArgument("directory is required"), nil
+	}
+
+	decks, err := s.ankiRequest(ctx, "deckNames", nil)
+	if err != nil {
+		return requestError("Error getting decks", err), nil
+	}
+	deckNames, ok := decks.([]interface{})
+	if !ok {
+		return toolError(codeUnexpectedResponse, "Unexpected response format from deckNames"), nil
+	}
+
+	// AnkiConnect can only export decks, so each top-level deck is exported
+	// with its subdecks. Exports follow a card's current deck, so filtered
+	// decks holding cards are exported as well; a card may then appear in two
+	// packages, which importing handles.
+	var exportDecks []string
+	exporting := map[string]bool{}
+	for _, d := range deckNames {
+		name, _ := d.(string)
+		if name == "" || strings.Contains(name, "::") {
+			continue
+		}
+		exportDecks = append(exportDecks, name)
+		exporting[name] = true
+	}
+	filteredIDs, err := s.findIDs(ctx, "findCards", "deck:filtered")
+	if err != nil {
+		return requestError("Error finding cards in filtered decks", err), nil
+	}
+	filteredCards, err := s.cardsInfo(ctx, filteredIDs)
+	if err != nil {
+		return requestError("Error getting cards info", err), nil
+	}
+	var filteredDecks []string
+	for _, card := range filteredCards {
+		name, _ := card["deckName"].(string)
+		if name != "" && !exporting[name] {
+			filteredDecks = append(filteredDecks, name)
+			exporting[name] = true
+		}
+	}
+	sort.Strings(filteredDecks)
+	exportDecks = append(exportDecks, filteredDecks...)
+
+	prefix := "anki-backup-" + time.Now().Format("20060102-150405") + "-"
+	used := map[string]bool{}
+	files := []string{}
+	for _, name := range exportDecks {
+		path := filepath.Join(args.Directory, backupFileName(prefix, name, used))
+		exported, err := s.ankiRequest(ctx, "exportPackage", map[string]interface{}{
+			"deck":         name,
+			"path":         path,
+			"includeSched": true,
+		})
+		if err != nil {
+			return requestError(fmt.Sprintf("Error exporting deck %s", name), err), nil
+		}
+		if exported != true {
+			return toolError(codeAnkiConnect, fmt.Sprintf("Anki could not export deck %s to %s", name, path)), nil
+		}
+		files = append(files, path)
+	}
+
+	result := map[string]interface{}{
+		"directory": args.Directory,
+		"files":     files,
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+func (s *AnkiServer) handleDueToday(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[DueTodayArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	query := "is:due"
+	if args.Deck != "" {
+		query = searchTerm("deck", args.Deck) + " " + query
+	}
+
+	cardIDs, err := s.findIDs(ctx, "findCards", query)
+	if err != nil {
+		return requestError("Error finding cards", err), nil
+	}
+	cards, err := s.cardsInfo(ctx, cardIDs)
+	if err != nil {
+		return requestError("Error getting cards info", err), nil
+	}
+
+	byDeck := map[string]int{}
+	for _, card := range cards {
+		deckName, _ := card["deckName"].(string)
+		byDeck[deckName]++
+	}
+
+	result := map[string]interface{}{
+		"total":   len(cardIDs),
+		"by_deck": byDeck,
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+func (s *AnkiServer) handleSessionPace(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[SessionPaceArgs]) (*mcp.CallToolResult, error) {
+	reviewedToday, err := s.ankiRequest(ctx, "getNumCardsReviewedToday", nil)
+	if err != nil {
+		return requestError("Error getting today's review count", err), nil
+	}
+
+	cardIDs, err := s.findIDs(ctx, "findCards", "rated:1")
+	if err != nil {
+		return requestError("Error finding cards", err), nil
+	}
+	reviews, err := s.reviewsOfCards(ctx, cardIDs)
+	if err != nil {
+		return requestError("Error getting reviews", err), nil
+	}
+
+	dayStart := startOfDay(time.Now()).UnixMilli()
+	reviewCount := 0
+	totalMillis := 0.0
+	for _, cardReviews := range reviews {
+		for _, review := range cardReviews {
+			if id, _ := review["id"].(float64); int64(id) < dayStart {
+				continue
+			}
+			duration, _ := review["time"].(float64)
+			totalMillis += duration
+			reviewCount++
+		}
+	}
+
+	result := map[string]interface{}{
+		"cards_reviewed_today": reviewedToday,
+		"reviews_today":        reviewCount,
+		"total_seconds":        totalMillis / 1000,
+		"avg_seconds_per_card": nil,
+		"cards_per_minute":     nil,
+	}
+	if reviewCount > 0 && totalMillis > 0 {
+		result["avg_seconds_per_card"] = totalMillis / 1000 / float64(reviewCount)
+		result["cards_per_minute"] = float64(reviewCount) / (totalMillis / 60000)
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+func (s *AnkiServer) handleHandleLeeches(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[HandleLeechesArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if args.Strategy != "suspend" && args.Strategy != "reset" && args.Strategy != "reschedule" {
+		return invalidArgument(fmt.Sprintf("Invalid strategy: %s. Must be 'suspend', 'reset', or 'reschedule'", args.Strategy)), nil
+	}
+	days := args.Days
+	if days == "" {
+		days = "30-60"
+	}
+
+	query := "tag:leech"
+	if args.Deck != "" {
+		query = searchTerm("deck", args.Deck) + " " + query
+	}
+
+	cardIDs, err := s.findIDs(ctx, "findCards", query)
+	if err != nil {
+		return requestError("Error finding cards", err), nil
+	}
+
+	for _, chunk := range chunkInts(cardIDs, chunkSize) {
+		switch args.Strategy {
+		case "suspend":
+			_, err = s.ankiRequest(ctx, "suspend", map[string]interface{}{"cards": chunk})
+		case "reset":
+			_, err = s.ankiRequest(ctx, "forgetCards", map[string]interface{}{"cards": chunk})
+		case "reschedule":
+			_, err = s.ankiRequest(ctx, "setDueDate", map[string]interface{}{"cards": chunk, "days": days})
+		}
+		if err != nil {
+			return requestError("Error handling leeches", err), nil
+		}
+	}
+
+	result := map[string]interface{}{
+		"strategy": args.Strategy,
+		"cards":    len(cardIDs),
+	}
+
+	// A reset gives the card a fresh start, so it should no longer be tagged
+	if args.Strategy == "reset" && len(cardIDs) > 0 {
+		noteIDs, err := s.findIDs(ctx, "findNotes", query)
+		if err != nil {
+			return requestError("Error finding notes", err), nil
+		}
+		for _, chunk := range chunkInts(noteIDs, chunkSize) {
+			if _, err := s.ankiRequest(ctx, "removeTags", map[string]interface{}{"notes": chunk, "tags": "leech"}); err != nil {
+				return requestError("Error removing leech tag", err), nil
+			}
+		}
+		result["notes_untagged"] = len(noteIDs)
+	}
+	if args.Strategy == "reschedule" {
+		result["days"] = days
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+func (s *AnkiServer) handleModelSummary(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[ModelSummaryArgs]) (*mcp.CallToolResult, error) {
+	models, err := s.modelNames(ctx)
+	if err != nil {
+		return requestError("Error getting models", err), nil
+	}
+
+	queries := make([]string, len(models))
+	for i, model := range models {
+		queries[i] = searchTerm("note", model)
+	}
+	noteIDs, err := s.findIDsConcurrently(ctx, "findNotes", queries)
+	if err != nil {
+		return requestError("Error finding notes", err), nil
+	}
+
+	summary := make([]map[string]interface{}, len(models))
+	for i, model := range models {
+		fields, err := s.modelFieldNames(ctx, model)
+		if err != nil {
+			return requestError(fmt.Sprintf("Error getting fields of %s", model), err), nil
+		}
+		templates, err := s.modelTemplates(ctx, model)
+		if err != nil {
+			return requestError(fmt.Sprintf("Error getting templates of %s", model), err), nil
+		}
+		summary[i] = map[string]interface{}{
+			"model":     model,
+			"fields":    len(fields),
+			"templates": len(templates),
+			"notes":     len(noteIDs[i]),
+		}
+	}
+
+	resultJSON, _ := s.marshalResult(summary)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+// fieldIssues compares a note's fields with its model's field names. Anki
+// requires the first field to be non-empty, so that field is treated as
+// required. It returns nil when the note has no issues.
+func fieldIssues(fields map[string]string, modelFields []string) map[string]interface{} {
+	issues := map[string]interface{}{}
+
+	expected := make(map[string]bool, len(modelFields))
+	var missing []string
+	for _, name := range modelFields {
+		expected[name] = true
+		if _, ok := fields[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	var unexpected []string
+	for name := range fields {
+		if !expected[name] {
+			unexpected = append(unexpected, name)
+		}
+	}
+	sort.Strings(unexpected)
+
+	if len(missing) > 0 {
+		issues["missing_fields"] = missing
+	}
+	if len(unexpected) > 0 {
+		issues["unexpected_fields"] = unexpected
+	}
+	if len(modelFields) > 0 {
+		if value, ok := fields[modelFields[0]]; ok && strings.TrimSpace(stripHTML(value)) == "" {
+			issues["empty_required_fields"] = []string{modelFields[0]}
+		}
+	}
+
+	if len(issues) == 0 {
+		return nil
+	}
+	return issues
+}
+
+func (s *AnkiServer) handleFindFieldIssues(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[FindFieldIssuesArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	query := args.Query
+	if query == "" {
+		query = allQuery
+	}
+
+	noteIDs, err := s.findIDs(ctx, "findNotes", query)
+	if err != nil {
+		return requestError("Error finding notes", err), nil
+	}
+	notes, err := s.notesInfo(ctx, noteIDs)
+	if err != nil {
+		return requestError("Error getting notes info", err), nil
+	}
+
+	modelFields := map[string][]string{}
+	problems := []map[string]interface{}{}
+	for _, note := range notes {
+		modelName, _ := note["modelName"].(string)
+		fieldNames, ok := modelFields[modelName]
+		if !ok {
+			fieldNames, err = s.modelFieldNames(ctx, modelName)
+			if err != nil {
+				return requestError(fmt.Sprintf("Error getting fields of %s", modelName), err), nil
+			}
+			modelFields[modelName] = fieldNames
+		}
+
+		issues := fieldIssues(noteFields(note), fieldNames)
+		if issues == nil {
+			continue
+		}
+		issues["noteId"] = note["noteId"]
+		issues["modelName"] = modelName
+		problems = append(problems, issues)
+	}
+
+	result := map[string]interface{}{
+		"query":         query,
+		"notes_scanned": len(notes),
+		"problem_notes": problems,
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+func (s *AnkiServer) handleSetFieldStyle(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[SetFieldStyleArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if args.Font == "" && args.Size == nil {
+		return invalidArgument("at least one of font or size is required"), nil
+	}
+	if args.Size != nil && *args.Size <= 0 {
+		return invalidArgument("size must be positive"), nil
+	}
+
+	fields, err := s.modelFieldNames(ctx, args.ModelName)
+	if err != nil {
+		return requestError(fmt.Sprintf("Error getting fields of model %s", args.ModelName), err), nil
+	}
+	found := false
+	for _, name := range fields {
+		if name == args.Field {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return toolError(codeNotFound, fmt.Sprintf("Field %s not found in model %s", args.Field, args.ModelName)), nil
+	}
+
+	if args.Font != "" {
+		_, err := s.ankiRequest(ctx, "modelFieldSetFont", map[string]interface{}{
+			"modelName": args.ModelName,
+			"fieldName": args.Field,
+			"font":      args.Font,
+		})
+		if err != nil {
+			return requestError("Error setting font", err), nil
+		}
+	}
+	if args.Size != nil {
+		_, err := s.ankiRequest(ctx, "modelFieldSetFontSize", map[string]interface{}{
+			"modelName": args.ModelName,
+			"fieldName": args.Field,
+			"fontSize":  *args.Size,
+		})
+		if err != nil {
+			return requestError("Error setting font size", err), nil
+		}
+	}
+
+	fonts, err := s.ankiRequest(ctx, "modelFieldFonts", map[string]interface{}{"modelName": args.ModelName})
+	if err != nil {
+		return requestError("Error getting field fonts", err), nil
+	}
+	fontMap, _ := fonts.(map[string]interface{})
+
+	result := map[string]interface{}{
+		"model_name": args.ModelName,
+		"field":      args.Field,
+		"style":      fontMap[args.Field],
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+func (s *AnkiServer) handleExportDeckConfig(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[ExportDeckConfigArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if args.Deck == "" {
+		return invalidArgument("deck is required"), nil
+	}
+
+	config, err := s.ankiRequest(ctx, "getDeckConfig", map[string]interface{}{"deck": args.Deck})
+	if err != nil {
+		return requestError("Error getting deck config", err), nil
+	}
+	if _, ok := config.(map[string]interface{}); !ok {
+		return toolError(codeNotFound, fmt.Sprintf("Deck %s not found", args.Deck)), nil
+	}
+
+	resultJSON, _ := s.marshalResult(config)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+// requiredDeckConfigKeys are the option sections every imported deck config
+// must contain.
+var requiredDeckConfigKeys = []string{"new", "rev", "lapse"}
+
+func (s *AnkiServer) handleImportDeckConfig(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[ImportDeckConfigArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if strings.TrimSpace(args.Name) == "" {
+		return invalidArgument("name is required"), nil
+	}
+	for _, key := range requiredDeckConfigKeys {
+		if _, ok := args.Config[key].(map[string]interface{}); !ok {
+			return invalidArgument(fmt.Sprintf("config is missing required section %q", key)), nil
+		}
+	}
+
+	// Start from the default options group so keys absent from the import keep sane values
+	newID, err := s.ankiRequest(ctx, "cloneDeckConfigId", map[string]interface{}{"name": args.Name, "cloneFrom": 1})
+	if err != nil {
+		return requestError("Error creating deck config", err), nil
+	}
+	if created, ok := newID.(bool); ok && !created {
+		return toolError(codeUnexpectedResponse, "AnkiConnect could not create the deck config"), nil
+	}
+
+	config := make(map[string]interface{}, len(args.Config))
+	for key, value := range args.Config {
+		config[key] = value
+	}
+	config["id"] = newID
+	config["name"] = args.Name
+
+	saved, err := s.ankiRequest(ctx, "saveDeckConfig", map[string]interface{}{"config": config})
+	if err != nil {
+		return requestError("Error saving deck config", err), nil
+	}
+	if saved != true {
+		return toolError(codeUnexpectedResponse, fmt.Sprintf("AnkiConnect did not save the settings of new deck config %v", newID)), nil
+	}
+
+	if len(args.Decks) > 0 {
+		if _, err := s.ankiRequest(ctx, "setDeckConfigId", map[string]interface{}{"decks": args.Decks, "configId": newID}); err != nil {
+			return requestError("Error assigning deck config", err), nil
+		}
+	}
+
+	result := map[string]interface{}{
+		"config_id": newID,
+		"name":      args.Name,
+		"decks":     args.Decks,
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+// dateLayout is the YYYY-MM-DD format used for dates in tool arguments and
+// results.
+const dateLayout = "2006-01-02"
+
+func (s *AnkiServer) handleReviewsInRange(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[ReviewsInRangeArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	start, err := time.ParseInLocation(dateLayout, args.Start, time.Local)
+	if err != nil {
+		return invalidArgument("start must be a date in YYYY-MM-DD format"), nil
+	}
+	end, err := time.ParseInLocation(dateLayout, args.End, time.Local)
+	if err != nil {
+		return invalidArgument("end must be a date in YYYY-MM-DD format"), nil
+	}
+	if end.Before(start) {
+		return invalidArgument("end must not be before start"), nil
+	}
+	// Rounding absorbs daylight saving shifts between the two midnights
+	if span := int(math.Round(end.Sub(start).Hours()/24)) + 1; span > maxTrendDays {
+		return invalidArgument(fmt.Sprintf("the range must span at most %d days", maxTrendDays)), nil
+	}
+
+	byDay, err := s.reviewsByDay(ctx)
+	if err != nil {
+		return requestError("Error getting reviews by day", err), nil
+	}
+
+	days := []map[string]interface{}{}
+	total := 0
+	for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+		date := day.Format(dateLayout)
+		days = append(days, map[string]interface{}{
+			"date":  date,
+			"count": byDay[date],
+		})
+		total += byDay[date]
+	}
+
+	result := map[string]interface{}{
+		"start":  args.Start,
+		"end":    args.End,
+		"total":  total,
+		"by_day": days,
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+var (
+	divWrapperPattern  = regexp.MustCompile(`(?is)^<div>(.*)</div>$`)
+	trailingBRPattern  = regexp.MustCompile(`(?i)(\s|<br\s*/?>)+$`)
+	strongOpenPattern  = regexp.MustCompile(`(?i)<strong>`)
+	strongClosePattern = regexp.MustCompile(`(?i)</strong>`)
+	boldTagPattern     = regexp.MustCompile(`(?i)</?b>`)
+)
+
+// unwrapDiv returns the content of a field wrapped in a single outer <div>.
+func unwrapDiv(value string) (string, bool) {
+	match := divWrapperPattern.FindStringSubmatch(strings.TrimSpace(value))
+	if match == nil || strings.Contains(strings.ToLower(match[1]), "<div") {
+		return value, false
+	}
+	return match[1], true
+}
+
+// formattingIssues lists the formatting problems found in a field value.
+func formattingIssues(value string) []string {
+	var issues []string
+	if _, ok := unwrapDiv(value); ok {
+		issues = append(issues, "div_wrapper")
+	}
+	if strings.Contains(value, "&nbsp;") {
+		issues = append(issues, "nbsp")
+	}
+	if value != strings.TrimLeft(value, " \t\n") || trailingBRPattern.MatchString(value) {
+		issues = append(issues, "surrounding_whitespace")
+	}
+	if strongOpenPattern.MatchString(value) && boldTagPattern.MatchString(value) {
+		issues = append(issues, "mixed_bold")
+	}
+	return issues
+}
+
+// fixFormatting applies the fixes for the issues reported by
+// formattingIssues.
+func fixFormatting(value string) string {
+	value = strings.TrimSpace(value)
+	value, _ = unwrapDiv(value)
+	value = strings.ReplaceAll(value, "&nbsp;", " ")
+	value = strongOpenPattern.ReplaceAllString(value, "<b>")
+	value = strongClosePattern.ReplaceAllString(value, "</b>")
+	value = trailingBRPattern.ReplaceAllString(value, "")
+	return strings.TrimSpace(value)
+}
+
+func (s *AnkiServer) handleAuditFormatting(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[AuditFormattingArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	query := args.Query
+	if query == "" {
+		query = allQuery
+	}
+
+	noteIDs, err := s.findIDs(ctx, "findNotes", query)
+	if err != nil {
+		return requestError("Error finding notes", err), nil
+	}
+	notes, err := s.notesInfo(ctx, noteIDs)
+	if err != nil {
+		return requestError("Error getting notes info", err), nil
+	}
+
+	affected := []map[string]interface{}{}
+	fixed := 0
+	for _, note := range notes {
+		fieldIssues := map[string][]string{}
+		fixedFields := map[string]interface{}{}
+		for name, value := range noteFields(note) {
+			issues := formattingIssues(value)
+			if len(issues) == 0 {
+				continue
+			}
+			fieldIssues[name] = issues
+			if fixedValue := fixFormatting(value); fixedValue != value {
+				fixedFields[name] = fixedValue
+			}
+		}
+		if len(fieldIssues) == 0 {
+			continue
+		}
+		affected = append(affected, map[string]interface{}{
+			"noteId": note["noteId"],
+			"issues": fieldIssues,
+		})
+
+		if args.Fix && len(fixedFields) > 0 {
+			_, err := s.ankiRequest(ctx, "updateNoteFields", map[string]interface{}{
+				"note": map[string]interface{}{"id": note["noteId"], "fields": fixedFields},
+			})
+			if err != nil {
+				return requestError(fmt.Sprintf("Error fixing note %v after fixing %d notes", note["noteId"], fixed), err), nil
+			}
+			fixed++
+		}
+	}
+
+	result := map[string]interface{}{
+		"query":          query,
+		"notes_scanned":  len(notes),
+		"affected_notes": affected,
+		"fixed":          fixed,
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+// spreadDays assigns each of n items a day in [start, end] so that items are
+// distributed as evenly as possible across the range.
+func spreadDays(n, start, end int) []int {
+	days := make([]int, n)
+	span := end - start + 1
+	for i := range days {
+		days[i] = start + i*span/n
+	}
+	return days
+}
+
+func (s *AnkiServer) handleSpreadDue(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[SpreadDueArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if args.StartDay < 0 || args.EndDay < args.StartDay {
+		return invalidArgument("start_day must be >= 0 and end_day must be >= start_day"), nil
+	}
+	if (len(args.CardIDs) == 0) == (args.Query == "") {
+		return invalidArgument("exactly one of card_ids or query must be provided"), nil
+	}
+
+	cardIDs, dropped := coerceIDs(args.CardIDs)
+	if len(dropped) > 0 {
+		return invalidArgument(fmt.Sprintf("Invalid card IDs: %v", dropped)), nil
+	}
+	if args.Query != "" {
+		var err error
+		cardIDs, err = s.findIDs(ctx, "findCards", args.Query)
+		if err != nil {
+			return requestError("Error finding cards", err), nil
+		}
+	}
+
+	// Group cards by their computed day so each day needs a single request
+	byDay := map[int][]int64{}
+	for i, day := range spreadDays(len(cardIDs), args.StartDay, args.EndDay) {
+		byDay[day] = append(byDay[day], cardIDs[i])
+	}
+
+	distribution := []map[string]interface{}{}
+	for day := args.StartDay; day <= args.EndDay; day++ {
+		cards := byDay[day]
+		if len(cards) == 0 {
+			continue
+		}
+		_, err := s.ankiRequest(ctx, "setDueDate", map[string]interface{}{"cards": cards, "days": strconv.Itoa(day)})
+		if err != nil {
+			return requestError("Error setting due date", err), nil
+		}
+		distribution = append(distribution, map[string]interface{}{
+			"day":   day,
+			"cards": len(cards),
+		})
+	}
+
+	result := map[string]interface{}{
+		"total":        len(cardIDs),
+		"distribution": distribution,
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+func (s *AnkiServer) handleCurrentCardDetail(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[CurrentCardDetailArgs]) (*mcp.CallToolResult, error) {
+	currentCard, err := s.ankiRequest(ctx, "guiCurrentCard", nil)
+	if err != nil {
+		return requestError("Error getting current card", err), nil
+	}
+	current, ok := currentCard.(map[string]interface{})
+	if !ok {
+		return toolError(codeNotFound, "No card is currently being reviewed"), nil
+	}
+	cardID, ok := current["cardId"].(float64)
+	if !ok {
+		return toolError(codeUnexpectedResponse, "Unexpected response format from guiCurrentCard"), nil
+	}
+
+	result, err := s.cardContext(ctx, int64(cardID))
+	if err != nil {
+		return requestError("Error getting card context", err), nil
+	}
+	result["current_card"] = current
+	if note, ok := result["note"].(map[string]interface{}); ok {
+		result["tags"] = note["tags"]
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+func (s *AnkiServer) handleModifiedNotes(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[ModifiedNotesArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	days := args.Days
+	if days == 0 {
+		days = 1
+	}
+	if days < 1 || days > 365 {
+		return invalidArgument("days must be between 1 and 365"), nil
+	}
+
+	noteIDs, err := s.findIDs(ctx, "findNotes", fmt.Sprintf("edited:%d", days))
+	if err != nil {
+		return requestError("Error finding notes", err), nil
+	}
+	notes, err := s.notesInfo(ctx, noteIDs)
+	if err != nil {
+		return requestError("Error getting notes info", err), nil
+	}
+
+	// Most recently modified first
+	sort.SliceStable(notes, func(i, j int) bool {
+		modI, _ := notes[i]["mod"].(float64)
+		modJ, _ := notes[j]["mod"].(float64)
+		return modI > modJ
+	})
+
+	result := map[string]interface{}{
+		"days":  days,
+		"count": len(notes),
+		"notes": notes,
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+// setNewCardsSuspended suspends or unsuspends the new cards of a deck and
+// returns a tool result with the number of cards changed.
+func (s *AnkiServer) setNewCardsSuspended(ctx context.Context, deck string, suspend bool) *mcp.CallToolResult {
+	if deck == "" {
+		return invalidArgument("deck is required")
+	}
+
+	action, query := "suspend", searchTerm("deck", deck)+" is:new -is:suspended"
+	if !suspend {
+		action, query = "unsuspend", searchTerm("deck", deck)+" is:new is:suspended"
+	}
+
+	cardIDs, err := s.findIDs(ctx, "findCards", query)
+	if err != nil {
+		return requestError("Error finding cards", err)
+	}
+	for _, chunk := range chunkInts(cardIDs, chunkSize) {
+		if _, err := s.ankiRequest(ctx, action, map[string]interface{}{"cards": chunk}); err != nil {
+			return requestError(fmt.Sprintf("Error running %s", action), err)
+		}
+	}
+
+	result := map[string]interface{}{
+		"deck":   deck,
+		"action": action,
+		"cards":  len(cardIDs),
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}
+}
+
+func (s *AnkiServer) handlePauseNew(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[PauseNewArgs]) (*mcp.CallToolResult, error) {
+	return s.setNewCardsSuspended(ctx, params.Arguments.Deck, true), nil
+}
+
+func (s *AnkiServer) handleResumeNew(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[PauseNewArgs]) (*mcp.CallToolResult, error) {
+	return s.setNewCardsSuspended(ctx, params.Arguments.Deck, false), nil
+}
+
+// matureInterval is the interval in days from which Anki considers a card
+// mature.
+const matureInterval = 21
+
+// cardHealthStats derives maturity buckets, lapse rate, and average ease from
+// cardsInfo entries. Ease is reported as a percentage, e.g. 250 for 2500.
+func cardHealthStats(cards []map[string]interface{}) map[string]interface{} {
+	newCount, young, mature := 0, 0, 0
+	totalReps, totalLapses := 0.0, 0.0
+	easeSum, easeCount := 0.0, 0
+
+	for _, card := range cards {
+		cardType, _ := card["type"].(float64)
+		interval, _ := card["interval"].(float64)
+		reps, _ := card["reps"].(float64)
+		lapses, _ := card["lapses"].(float64)
+		totalReps += reps
+		totalLapses += lapses
+
+		if cardType == 0 {
+			newCount++
+			continue
+		}
+		if interval >= matureInterval {
+			mature++
+		} else {
+			young++
+		}
+		if factor, ok := card["factor"].(float64); ok && factor > 0 {
+			easeSum += factor
+			easeCount++
+		}
+	}
+
+	stats := map[string]interface{}{
+		"total":        len(cards),
+		"new":          newCount,
+		"young":        young,
+		"mature":       mature,
+		"lapse_rate":   nil,
+		"average_ease": nil,
+	}
+	if totalReps > 0 {
+		stats["lapse_rate"] = totalLapses / totalReps
+	}
+	if easeCount > 0 {
+		stats["average_ease"] = easeSum / float64(easeCount) / 10
+	}
+	return stats
+}
+
+func (s *AnkiServer) handleDeckHealth(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[DeckHealthArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if args.Deck == "" {
+		return invalidArgument("deck is required"), nil
+	}
+
+	cardIDs, err := s.findIDs(ctx, "findCards", searchTerm("deck", args.Deck))
+	if err != nil {
+		return requestError("Error finding cards", err), nil
+	}
+	cards, err := s.cardsInfo(ctx, cardIDs)
+	if err != nil {
+		return requestError("Error getting cards info", err), nil
+	}
+
+	result := cardHealthStats(cards)
+	result["deck"] = args.Deck
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+func (s *AnkiServer) handleCloneDeck(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[CloneDeckArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if args.Source == "" || strings.TrimSpace(args.Target) == "" {
+		return invalidArgument("source and target are required"), nil
+	}
+
+	configID, err := s.deckConfigID(ctx, args.Source)
+	if err != nil {
+		return requestError("Error getting source deck config", err), nil
+	}
+
+	deckID, err := s.ankiRequest(ctx, "createDeck", map[string]interface{}{"deck": args.Target})
+	if err != nil {
+		return requestError("Error creating deck", err), nil
+	}
+	if _, err := s.ankiRequest(ctx, "setDeckConfigId", map[string]interface{}{"decks": []string{args.Target}, "configId": configID}); err != nil {
+		return requestError("Error assigning deck config", err), nil
+	}
+
+	result := map[string]interface{}{
+		"source":       args.Source,
+		"target":       args.Target,
+		"deck_id":      deckID,
+		"config_id":    configID,
+		"notes_copied": 0,
+	}
+
+	if args.CopyNotes {
+		noteIDs, err := s.findIDs(ctx, "findNotes", searchTerm("deck", args.Source))
+		if err != nil {
+			return requestError("Error finding notes", err), nil
+		}
+		notes, err := s.notesInfo(ctx, noteIDs)
+		if err != nil {
+			return requestError("Error getting notes info", err), nil
+		}
+
+		newNotes := make([]map[string]interface{}, len(notes))
+		for i, note := range notes {
+			newNotes[i] = map[string]interface{}{
+				"deckName":  args.Target,
+				"modelName": note["modelName"],
+				"fields":    noteFields(note),
+				"tags":      note["tags"],
+				// Copies share their first field with the originals
+				"options": map[string]interface{}{"allowDuplicate": true},
+			}
+		}
+
+		copied := 0
+		for start := 0; start < len(newNotes); start += chunkSize {
+			end := min(start+chunkSize, len(newNotes))
+			added, err := s.ankiRequest(ctx, "addNotes", map[string]interface{}{"notes": newNotes[start:end]})
+			if err != nil {
+				return requestError(fmt.Sprintf("Error copying notes after copying %d", copied), err), nil
+			}
+			addedIDs, _ := added.([]interface{})
+			for _, id := range addedIDs {
+				if id != nil {
+					copied++
+				}
+			}
+		}
+		result["notes_copied"] = copied
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+func (s *AnkiServer) handleChangesSince(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[ChangesSinceArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	now := time.Now()
+	if args.Timestamp <= 0 || args.Timestamp > now.Unix() {
+		return invalidArgument("timestamp must be a Unix time in seconds in the past"), nil
+	}
+
+	// edited:N works in whole days, so search a little wider and filter by
+	// exact modification time afterwards
+	days := int(now.Sub(time.Unix(args.Timestamp, 0)).Hours()/24) + 1
+	noteIDs, err := s.findIDs(ctx, "findNotes", fmt.Sprintf("edited:%d", days))
+	if err != nil {
+		return requestError("Error finding notes", err), nil
+	}
+	// edited:N only follows note edits, and suspending, moving, flagging or
+	// rescheduling a card leaves its note alone, so every card's
+	// modification time is checked
+	cardIDs, err := s.findIDs(ctx, "findCards", allQuery)
+	if err != nil {
+		return requestError("Error finding cards", err), nil
+	}
+
+	noteMods, err := s.modTimes(ctx, "notesModTime", "notes", "noteId", noteIDs)
+	if err != nil {
+		return requestError("Error getting note modification times", err), nil
+	}
+	cardMods, err := s.modTimes(ctx, "cardsModTime", "cards", "cardId", cardIDs)
+	if err != nil {
+		return requestError("Error getting card modification times", err), nil
+	}
+
+	// Modification times are in whole seconds, so changes made at the
+	// timestamp itself are included; anything later in the high-water mark's
+	// second then shows up again next time, and clients dedupe by ID
+	highWaterMark := args.Timestamp
+	var changedNotes, changedCards []int64
+	for _, id := range noteIDs {
+		if mod := noteMods[id]; mod >= args.Timestamp {
+			changedNotes = append(changedNotes, id)
+			highWaterMark = max(highWaterMark, mod)
+		}
+	}
+	for _, id := range cardIDs {
+		if mod := cardMods[id]; mod >= args.Timestamp {
+			changedCards = append(changedCards, id)
+			highWaterMark = max(highWaterMark, mod)
+		}
+	}
+
+	notes, err := s.notesInfo(ctx, changedNotes)
+	if err != nil {
+		return requestError("Error getting notes info", err), nil
+	}
+	cards, err := s.cardsInfo(ctx, changedCards)
+	if err != nil {
+		return requestError("Error getting cards info", err), nil
+	}
+
+	result := map[string]interface{}{
+		"since":           args.Timestamp,
+		"high_water_mark": highWaterMark,
+		"notes":           notes,
+		"cards":           cards,
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+// lookupPath navigates nested maps using a dotted key such as "new.perDay".
+func lookupPath(data map[string]interface{}, key string) (interface{}, bool) {
+	var current interface{} = data
+	for _, part := range strings.Split(key, ".") {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		current, ok = m[part]
+		if !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+func (s *AnkiServer) handleGetPreference(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[GetPreferenceArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if args.Key == "" {
+		return invalidArgument("key is required"), nil
+	}
+
+	prefs, err := s.ankiRequest(ctx, "getPreferences", nil)
+	if err != nil {
+		return requestError("Error getting preferences", err), nil
+	}
+	prefsMap, ok := prefs.(map[string]interface{})
+	if !ok {
+		return toolError(codeUnexpectedResponse, "Unexpected response format from getPreferences"), nil
+	}
+
+	value, ok := lookupPath(prefsMap, args.Key)
+	if !ok {
+		return toolError(codeNotFound, fmt.Sprintf("Preference %s not found", args.Key)), nil
+	}
+
+	result := map[string]interface{}{
+		"key":   args.Key,
+		"value": value,
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+const (
+	// maxAutoreviewCount caps how many cards anki_autoreview answers per call.
+	maxAutoreviewCount = 500
+	// maxRepeatedCard is how many times in a row the same card may be shown
+	// before anki_autoreview assumes the queue is stuck.
+	maxRepeatedCard = 3
+)
+
+func (s *AnkiServer) handleAutoreview(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[AutoreviewArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if args.Count < 1 || args.Count > maxAutoreviewCount {
+		return invalidArgument(fmt.Sprintf("count must be between 1 and %d", maxAutoreviewCount)), nil
+	}
+	ease := 3
+	if args.Ease != nil {
+		ease = *args.Ease
+	}
+	if ease < 1 || ease > 4 {
+		return invalidArgument("ease must be 1 (Again), 2 (Hard), 3 (Good), or 4 (Easy)"), nil
+	}
+
+	answered := 0
+	stopReason := "count reached"
+	var lastCardID float64
+	repeats := 0
+	for answered < args.Count {
+		currentCard, err := s.ankiRequest(ctx, "guiCurrentCard", nil)
+		if err != nil {
+			return requestError(fmt.Sprintf("Error getting current card after answering %d cards", answered), err), nil
+		}
+		current, ok := currentCard.(map[string]interface{})
+		if !ok {
+			stopReason = "no more cards due"
+			break
+		}
+
+		cardID, _ := current["cardId"].(float64)
+		if cardID == lastCardID {
+			repeats++
+			if repeats >= maxRepeatedCard {
+				stopReason = "card did not advance"
+				break
+			}
+		} else {
+			lastCardID = cardID
+			repeats = 0
+		}
+
+		if _, err := s.ankiRequest(ctx, "guiShowAnswer", nil); err != nil {
+			return requestError(fmt.Sprintf("Error showing answer after answering %d cards", answered), err), nil
+		}
+		answerResult, err := s.ankiRequest(ctx, "guiAnswerCard", map[string]interface{}{"ease": ease})
+		if err != nil {
+			return requestError(fmt.Sprintf("Error answering card after answering %d cards", answered), err), nil
+		}
+		if success, ok := answerResult.(bool); ok && !success {
+			stopReason = "card could not be answered"
+			break
+		}
+		answered++
+	}
+
+	result := map[string]interface{}{
+		"answered":    answered,
+		"ease":        ease,
+		"stop_reason": stopReason,
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+// computeStreaks returns the current and longest runs of consecutive days
+// with reviews. A day without reviews yet today does not break the current
+// streak, which then counts back from yesterday.
+func computeStreaks(byDay map[string]int, today time.Time) (current, longest int) {
+	day := startOfDay(today)
+	if byDay[day.Format(dateLayout)] == 0 {
+		day = day.AddDate(0, 0, -1)
+	}
+	for byDay[day.Format(dateLayout)] > 0 {
+		current++
+		day = day.AddDate(0, 0, -1)
+	}
+
+	var days []time.Time
+	for date, count := range byDay {
+		if count <= 0 {
+			continue
+		}
+		if t, err := time.ParseInLocation(dateLayout, date, today.Location()); err == nil {
+			days = append(days, t)
+		}
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+
+	run := 0
+	for i, d := range days {
+		if i > 0 && d.Equal(days[i-1].AddDate(0, 0, 1)) {
+			run++
+		} else {
+			run = 1
+		}
+		longest = max(longest, run)
+	}
+	return current, longest
+}
+
+func (s *AnkiServer) handleStreak(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[StreakArgs]) (*mcp.CallToolResult, error) {
+	byDay, err := s.reviewsByDay(ctx)
+	if err != nil {
+		return requestError("Error getting reviews by day", err), nil
+	}
+
+	now := time.Now()
+	current, longest := computeStreaks(byDay, now)
+
+	result := map[string]interface{}{
+		"current_streak": current,
+		"longest_streak": longest,
+		"studied_today":  byDay[now.Format(dateLayout)] > 0,
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+// joinInts formats ids as a comma-separated list for nid:/cid: searches.
+func joinInts(ids []int64) string {
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = strconv.FormatInt(id, 10)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (s *AnkiServer) handleSplitByTag(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[SplitByTagArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if args.Deck == "" {
+		return invalidArgument("deck is required"), nil
+	}
+
+	// Cards already in subdecks, including those moved by an earlier split,
+	// stay where they are
+	noteIDs, err := s.findIDs(ctx, "findNotes", deckOnlyTerm(args.Deck))
+	if err != nil {
+		return requestError("Error finding notes", err), nil
+	}
+	notes, err := s.notesInfo(ctx, noteIDs)
+	if err != nil {
+		return requestError("Error getting notes info", err), nil
+	}
+
+	// A card can only live in one deck, so notes with several tags go to the
+	// subdeck of their alphabetically first tag
+	notesByTag := map[string][]int64{}
+	untagged := 0
+	for _, note := range notes {
+		tagList, _ := note["tags"].([]interface{})
+		var tags []string
+		for _, tag := range tagList {
+			if t, ok := tag.(string); ok && t != "" {
+				tags = append(tags, t)
+			}
+		}
+		if len(tags) == 0 {
+			untagged++
+			continue
+		}
+		sort.Strings(tags)
+		noteID, _ := note["noteId"].(float64)
+		notesByTag[tags[0]] = append(notesByTag[tags[0]], int64(noteID))
+	}
+
+	tags := make([]string, 0, len(notesByTag))
+	for tag := range notesByTag {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	subdecks := make([]map[string]interface{}, len(tags))
+	for i, tag := range tags {
+		subdecks[i] = map[string]interface{}{
+			"tag":     tag,
+			"subdeck": args.Deck + "::" + tag,
+			"notes":   len(notesByTag[tag]),
+		}
+	}
+
+	result := map[string]interface{}{
+		"deck":           args.Deck,
+		"subdecks":       subdecks,
+		"untagged_notes": untagged,
+		"moved_cards":    0,
+	}
+
+	if !args.Confirm {
+		if len(tags) > 0 {
+			result["message"] = "Set confirm to true to create these subdecks and move the cards"
+		}
+		resultJSON, _ := s.marshalResult(result)
+		return &mcp.CallToolResult{
+			Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+		}, nil
+	}
+
+	moved := 0
+	for i, tag := range tags {
+		subdeck := args.Deck + "::" + tag
+		var cardIDs []int64
+		for _, chunk := range chunkInts(notesByTag[tag], chunkSize) {
+			ids, err := s.findIDs(ctx, "findCards", deckOnlyTerm(args.Deck)+" nid:"+joinInts(chunk))
+			if err != nil {
+				return requestError("Error finding cards", err), nil
+			}
+			cardIDs = append(cardIDs, ids...)
+		}
+		if _, err := s.ankiRequest(ctx, "createDeck", map[string]interface{}{"deck": subdeck}); err != nil {
+			return requestError(fmt.Sprintf("Error creating deck %s after moving %d cards", subdeck, moved), err), nil
+		}
+		for _, chunk := range chunkInts(cardIDs, chunkSize) {
+			if _, err := s.ankiRequest(ctx, "changeDeck", map[string]interface{}{"cards": chunk, "deck": subdeck}); err != nil {
+				return requestError(fmt.Sprintf("Error moving cards to %s after moving %d cards", subdeck, moved), err), nil
+			}
+			moved += len(chunk)
+		}
+		subdecks[i]["cards"] = len(cardIDs)
+	}
+	result["moved_cards"] = moved
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+// flagNames maps Anki's flag numbers to the colors shown in the browser.
+var flagNames = []string{"", "red", "orange", "green", "blue", "pink", "turquoise", "purple"}
+
+const previewLength = 80
+
+// cardPreview returns the plain text of a card's first field, truncated for
+// listings.
+func cardPreview(card map[string]interface{}) string {
+	fields, _ := card["fields"].(map[string]interface{})
+	for _, field := range fields {
+		fieldData, ok := field.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if order, _ := fieldData["order"].(float64); order != 0 {
+			continue
+		}
+		value, _ := fieldData["value"].(string)
+		preview := []rune(strings.TrimSpace(stripHTML(value)))
+		if len(preview) > previewLength {
+			return string(preview[:previewLength]) + "…"
+		}
+		return string(preview)
+	}
+	return ""
+}
+
+func (s *AnkiServer) handleFlaggedCards(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[FlaggedCardsArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	queries := make([]string, 0, len(flagNames)-1)
+	for flag := 1; flag < len(flagNames); flag++ {
+		query := fmt.Sprintf("flag:%d", flag)
+		if args.Deck != "" {
+			query = searchTerm("deck", args.Deck) + " " + query
+		}
+		queries = append(queries, query)
+	}
+
+	idsByFlag, err := s.findIDsConcurrently(ctx, "findCards", queries)
+	if err != nil {
+		return requestError("Error finding flagged cards", err), nil
+	}
+
+	var allIDs []int64
+	for _, ids := range idsByFlag {
+		allIDs = append(allIDs, ids...)
+	}
+	cards, err := s.cardsInfo(ctx, allIDs)
+	if err != nil {
+		return requestError("Error getting cards info", err), nil
+	}
+	previews := make(map[int64]string, len(cards))
+	for _, card := range cards {
+		cardID, _ := card["cardId"].(float64)
+		previews[int64(cardID)] = cardPreview(card)
+	}
+
+	flags := []map[string]interface{}{}
+	for i, ids := range idsByFlag {
+		if len(ids) == 0 {
+			continue
+		}
+		entries := make([]map[string]interface{}, len(ids))
+		for j, id := range ids {
+			entries[j] = map[string]interface{}{"card_id": id, "front": previews[id]}
+		}
+		flags = append(flags, map[string]interface{}{
+			"flag":  i + 1,
+			"color": flagNames[i+1],
+			"count": len(ids),
+			"cards": entries,
+		})
+	}
+
+	result := map[string]interface{}{
+		"total": len(allIDs),
+		"flags": flags,
+	}
+	if args.Deck != "" {
+		result["deck"] = args.Deck
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+var repeatedColons = regexp.MustCompile(`:{3,}`)
+
+// normalizeTag trims whitespace and stray hierarchy separators from a tag.
+func normalizeTag(tag string) string {
+	tag = repeatedColons.ReplaceAllString(strings.TrimSpace(tag), "::")
+	return strings.Trim(tag, ":")
+}
+
+// canonicalTagCase picks one spelling for tags that differ only by case: the
+// most used one, or the alphabetically first on a tie.
+func canonicalTagCase(counts map[string]int) map[string]string {
+	best := map[string]string{}
+	for tag, count := range counts {
+		key := strings.ToLower(tag)
+		current, ok := best[key]
+		if !ok || count > counts[current] || (count == counts[current] && tag < current) {
+			best[key] = tag
+		}
+	}
+	canonical := make(map[string]string, len(counts))
+	for tag := range counts {
+		canonical[tag] = best[strings.ToLower(tag)]
+	}
+	return canonical
+}
+
+func (s *AnkiServer) handleNormalizeTags(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[NormalizeTagsArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	query := args.Query
+	if query == "" {
+		query = allQuery
+	}
+
+	noteIDs, err := s.findIDs(ctx, "findNotes", query)
+	if err != nil {
+		return requestError("Error finding notes", err), nil
+	}
+	notes, err := s.notesInfo(ctx, noteIDs)
+	if err != nil {
+		return requestError("Error getting notes info", err), nil
+	}
+
+	noteTags := make([][]string, len(notes))
+	counts := map[string]int{}
+	for i, note := range notes {
+		tagList, _ := note["tags"].([]interface{})
+		for _, tag := range tagList {
+			if t, ok := tag.(string); ok {
+				noteTags[i] = append(noteTags[i], t)
+				if normalized := normalizeTag(t); normalized != "" {
+					counts[normalized]++
+				}
+			}
+		}
+	}
+	canonical := canonicalTagCase(counts)
+
+	type rename struct{ from, to string }
+	notesByRename := map[rename][]int64{}
+	for i, note := range notes {
+		noteID, _ := note["noteId"].(float64)
+		for _, tag := range noteTags[i] {
+			to := canonical[normalizeTag(tag)]
+			if to != tag {
+				key := rename{tag, to}
+				notesByRename[key] = append(notesByRename[key], int64(noteID))
+			}
+		}
+	}
+
+	renames := make([]rename, 0, len(notesByRename))
+	for key := range notesByRename {
+		renames = append(renames, key)
+	}
+	sort.Slice(renames, func(i, j int) bool {
+		if renames[i].from != renames[j].from {
+			return renames[i].from < renames[j].from
+		}
+		return renames[i].to < renames[j].to
+	})
+
+	changes := make([]map[string]interface{}, len(renames))
+	for i, key := range renames {
+		changes[i] = map[string]interface{}{
+			"before": key.from,
+			"after":  key.to,
+			"notes":  len(notesByRename[key]),
+		}
+	}
+
+	result := map[string]interface{}{
+		"notes_checked": len(notes),
+		"changes":       changes,
+		"applied":       false,
+	}
+
+	if args.Confirm && len(renames) > 0 {
+		// Anki matches tags case-insensitively and adds a tag with the
+		// spelling it already knows, so every old spelling is removed and
+		// dropped from the tag list before the new ones are added
+		for _, key := range renames {
+			for _, chunk := range chunkInts(notesByRename[key], chunkSize) {
+				if _, err := s.ankiRequest(ctx, "removeTags", map[string]interface{}{"notes": chunk, "tags": key.from}); err != nil {
+					return requestError(fmt.Sprintf("Error removing tag %s", key.from), err), nil
+				}
+			}
+		}
+		if _, err := s.ankiRequest(ctx, "clearUnusedTags", nil); err != nil && !isUnsupportedAction(err) {
+			return requestError("Error clearing unused tags", err), nil
+		}
+		touched := map[int64]bool{}
+		for _, key := range renames {
+			for _, id := range notesByRename[key] {
+				touched[id] = true
+			}
+			if key.to == "" {
+				continue
+			}
+			for _, chunk := range chunkInts(notesByRename[key], chunkSize) {
+				if _, err := s.ankiRequest(ctx, "addTags", map[string]interface{}{"notes": chunk, "tags": key.to}); err != nil {
+					return requestError(fmt.Sprintf("Error adding tag %s", key.to), err), nil
+				}
+			}
+		}
+
+		// Count only the renames that show up on the notes afterwards, since
+		// a spelling still used by notes outside the query is kept
+		touchedIDs := make([]int64, 0, len(touched))
+		for id := range touched {
+			touchedIDs = append(touchedIDs, id)
+		}
+		updated, err := s.notesInfo(ctx, touchedIDs)
+		if err != nil {
+			return requestError("Error checking renamed tags", err), nil
+		}
+		tagsAfter := map[int64]map[string]bool{}
+		for _, note := range updated {
+			noteID, _ := note["noteId"].(float64)
+			tags := map[string]bool{}
+			tagList, _ := note["tags"].([]interface{})
+			for _, tag := range tagList {
+				if t, ok := tag.(string); ok {
+					tags[t] = true
+				}
+			}
+			tagsAfter[int64(noteID)] = tags
+		}
+		renamed, total := 0, 0
+		for i, key := range renames {
+			total += len(notesByRename[key])
+			done := 0
+			for _, id := range notesByRename[key] {
+				if tags := tagsAfter[id]; !tags[key.from] && (key.to == "" || tags[key.to]) {
+					done++
+				}
+			}
+			changes[i]["renamed"] = done
+			renamed += done
+		}
+		result["applied"] = true
+		result["renamed"] = renamed
+		if renamed < total {
+			result["message"] = fmt.Sprintf("%d of %d tag changes did not take effect; Anki keeps a spelling still used elsewhere, so rename those tags in the browser", total-renamed, total)
+		}
+	} else if len(renames) > 0 {
+		result["message"] = "Set confirm to true to rewrite these tags"
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+func (s *AnkiServer) handleGradeCard(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[GradeCardArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if args.CardID == 0 {
+		return invalidArgument("card_id is required"), nil
+	}
+	if args.Ease < 1 || args.Ease > 4 {
+		return invalidArgument("ease must be 1 (Again), 2 (Hard), 3 (Good), or 4 (Easy)"), nil
+	}
+
+	due, err := s.findIDs(ctx, "findCards", fmt.Sprintf("cid:%d is:due", args.CardID))
+	if err != nil {
+		return requestError("Error checking card", err), nil
+	}
+	if len(due) == 0 {
+		return invalidArgument(fmt.Sprintf("Card %d is not due for review", args.CardID)), nil
+	}
+
+	answered, err := s.ankiRequest(ctx, "answerCards", map[string]interface{}{
+		"answers": []map[string]interface{}{{"cardId": args.CardID, "ease": args.Ease}},
+	})
+	if err != nil {
+		return requestError("Error answering card", err), nil
+	}
+	if answers, _ := answered.([]interface{}); len(answers) != 1 || answers[0] != true {
+		return toolError(codeUnexpectedResponse, fmt.Sprintf("Card %d was not answered", args.CardID)), nil
+	}
+
+	cards, err := s.cardsInfo(ctx, []int64{args.CardID})
+	if err != nil {
+		return requestError("Error getting card info", err), nil
+	}
+	if len(cards) == 0 {
+		return toolError(codeNotFound, fmt.Sprintf("Card %d not found", args.CardID)), nil
+	}
+	card := cards[0]
+
+	result := map[string]interface{}{
+		"card_id":  args.CardID,
+		"ease":     args.Ease,
+		"due":      card["due"],
+		"interval": card["interval"],
+		"factor":   card["factor"],
+		"queue":    card["queue"],
+		"type":     card["type"],
+		"reps":     card["reps"],
+		"lapses":   card["lapses"],
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+const monthLayout = "2006-01"
+
+// creationHistogram counts note IDs, which are creation times in
+// milliseconds, per month. Months without notes between the first and last
+// are included with a zero count.
+func creationHistogram(noteIDs []int64, loc *time.Location) []map[string]interface{} {
+	if len(noteIDs) == 0 {
+		return []map[string]interface{}{}
+	}
+	counts := map[string]int{}
+	first, last := noteIDs[0], noteIDs[0]
+	for _, id := range noteIDs {
+		counts[time.UnixMilli(id).In(loc).Format(monthLayout)]++
+		if id < first {
+			first = id
+		}
+		if id > last {
+			last = id
+		}
+	}
+
+	start := time.UnixMilli(first).In(loc)
+	month := time.Date(start.Year(), start.Month(), 1, 0, 0, 0, 0, loc)
+	end := time.UnixMilli(last).In(loc).Format(monthLayout)
+	var buckets []map[string]interface{}
+	for {
+		key := month.Format(monthLayout)
+		buckets = append(buckets, map[string]interface{}{"month": key, "notes": counts[key]})
+		if key == end {
+			break
+		}
+		month = month.AddDate(0, 1, 0)
+	}
+	return buckets
+}
+
+func (s *AnkiServer) handleNoteCreationHistogram(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[NoteCreationHistogramArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	query := allQuery
+	if args.Deck != "" {
+		query = searchTerm("deck", args.Deck)
+	}
+
+	noteIDs, err := s.findIDs(ctx, "findNotes", query)
+	if err != nil {
+		return requestError("Error finding notes", err), nil
+	}
+
+	result := map[string]interface{}{
+		"total":  len(noteIDs),
+		"months": creationHistogram(noteIDs, time.Local),
+	}
+	if args.Deck != "" {
+		result["deck"] = args.Deck
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+// backlogWindowDays is how far back reviews are sampled for the average
+// time per card.
+const backlogWindowDays = 30
+
+func (s *AnkiServer) handleBacklogEstimate(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[BacklogEstimateArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if args.Deck == "" {
+		return invalidArgument("deck is required"), nil
+	}
+	deckQuery := searchTerm("deck", args.Deck)
+
+	overdue, err := s.findIDs(ctx, "findCards", deckQuery+" is:due prop:due<0")
+	if err != nil {
+		return requestError("Error finding overdue cards", err), nil
+	}
+
+	config, err := s.deckConfig(ctx, args.Deck)
+	if err != nil {
+		return requestError("Error getting deck config", err), nil
+	}
+	perDay, _ := lookupPath(config, "rev.perDay")
+	dailyLimit, _ := perDay.(float64)
+
+	recent, err := s.findIDs(ctx, "findCards", fmt.Sprintf("%s rated:%d", deckQuery, backlogWindowDays))
+	if err != nil {
+		return requestError("Error finding recent reviews", err), nil
+	}
+	reviews, err := s.reviewsOfCards(ctx, recent)
+	if err != nil {
+		return requestError("Error getting reviews", err), nil
+	}
+
+	windowStart := startOfDay(time.Now()).AddDate(0, 0, -backlogWindowDays).UnixMilli()
+	reviewCount := 0
+	totalMillis := 0.0
+	for _, cardReviews := range reviews {
+		for _, review := range cardReviews {
+			if id, _ := review["id"].(float64); int64(id) < windowStart {
+				continue
+			}
+			duration, _ := review["time"].(float64)
+			totalMillis += duration
+			reviewCount++
+		}
+	}
+
+	result := map[string]interface{}{
+		"deck":                 args.Deck,
+		"overdue_cards":        len(overdue),
+		"daily_review_limit":   int(dailyLimit),
+		"avg_seconds_per_card": nil,
+		"estimated_minutes":    nil,
+		"days_to_clear":        nil,
+	}
+	if reviewCount > 0 && totalMillis > 0 {
+		avgSeconds := totalMillis / 1000 / float64(reviewCount)
+		result["avg_seconds_per_card"] = avgSeconds
+		result["estimated_minutes"] = avgSeconds * float64(len(overdue)) / 60
+	}
+	if dailyLimit > 0 {
+		// Overdue cards compete with each day's regular reviews for the
+		// limit, so this is a lower bound
+		result["days_to_clear"] = (len(overdue) + int(dailyLimit) - 1) / int(dailyLimit)
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+// validateDeckPath rejects deck names with empty "::"-separated segments,
+// which Anki would otherwise silently collapse or rename.
+func validateDeckPath(path string) error {
+	for _, segment := range strings.Split(path, "::") {
+		if strings.TrimSpace(segment) == "" {
+			return fmt.Errorf("deck %q has an empty segment", path)
+		}
+	}
+	return nil
+}
+
+func (s *AnkiServer) handleCreateDeckTree(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[CreateDeckTreeArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if len(args.Decks) == 0 {
+		return invalidArgument("decks is required"), nil
+	}
+	for _, deck := range args.Decks {
+		if err := validateDeckPath(deck); err != nil {
+			return invalidArgument(err.Error()), nil
+		}
+	}
+
+	// createDeck creates missing parents itself, so only the leaves are needed
+	decks := make([]map[string]interface{}, len(args.Decks))
+	for i, deck := range args.Decks {
+		deckID, err := s.ankiRequest(ctx, "createDeck", map[string]interface{}{"deck": deck})
+		if err != nil {
+			return requestError(fmt.Sprintf("Error creating deck %s after creating %d decks", deck, i), err), nil
+		}
+		decks[i] = map[string]interface{}{"deck": deck, "id": deckID}
+	}
+
+	resultJSON, _ := s.marshalResult(map[string]interface{}{"decks": decks})
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+// defaultRankLimit is how many cards the ranking tools return by default.
+const defaultRankLimit = 10
+
+type cardDifficulty struct {
+	cardID  int64
+	again   int
+	reviews int
+}
+
+// rankByAgain orders cards by how many of their reviews were answered Again,
+// then by the fraction of Again answers. Cards never answered Again are left
+// out.
+func rankByAgain(reviews map[string][]map[string]interface{}) []cardDifficulty {
+	var ranked []cardDifficulty
+	for key, cardReviews := range reviews {
+		cardID, err := strconv.ParseInt(key, 10, 64)
+		if err != nil {
+			continue
+		}
+		again := 0
+		for _, review := range cardReviews {
+			// getReviewsOfCards reports the button pressed as "ease"
+			if button, _ := review["ease"].(float64); button == 1 {
+				again++
+			}
+		}
+		if again > 0 {
+			ranked = append(ranked, cardDifficulty{cardID, again, len(cardReviews)})
+		}
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		a, b := ranked[i], ranked[j]
+		if a.again != b.again {
+			return a.again > b.again
+		}
+		if a.again*b.reviews != b.again*a.reviews {
+			return a.again*b.reviews > b.again*a.reviews
+		}
+		return a.cardID < b.cardID
+	})
+	return ranked
+}
+
+func (s *AnkiServer) handleHardestCards(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[HardestCardsArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if args.Query == "" {
+		return invalidArgument("query is required"), nil
+	}
+	limit := args.Limit
+	if limit <= 0 {
+		limit = defaultRankLimit
+	}
+
+	cardIDs, err := s.findIDs(ctx, "findCards", args.Query)
+	if err != nil {
+		return requestError("Error finding cards", err), nil
+	}
+	reviews, err := s.reviewsOfCards(ctx, cardIDs)
+	if err != nil {
+		return requestError("Error getting reviews", err), nil
+	}
+
+	ranked := rankByAgain(reviews)
+	if len(ranked) > limit {
+		ranked = ranked[:limit]
+	}
+
+	topIDs := make([]int64, len(ranked))
+	for i, card := range ranked {
+		topIDs[i] = card.cardID
+	}
+	cards, err := s.cardsInfo(ctx, topIDs)
+	if err != nil {
+		return requestError("Error getting cards info", err), nil
+	}
+	previews := make(map[int64]string, len(cards))
+	for _, card := range cards {
+		cardID, _ := card["cardId"].(float64)
+		previews[int64(cardID)] = cardPreview(card)
+	}
+
+	hardest := make([]map[string]interface{}, len(ranked))
+	for i, card := range ranked {
+		hardest[i] = map[string]interface{}{
+			"card_id":        card.cardID,
+			"front":          previews[card.cardID],
+			"again_count":    card.again,
+			"reviews":        card.reviews,
+			"again_fraction": float64(card.again) / float64(card.reviews),
+		}
+	}
+
+	result := map[string]interface{}{
+		"cards_checked": len(cardIDs),
+		"cards":         hardest,
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+func (s *AnkiServer) handleSetDeckDescription(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[SetDeckDescriptionArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if args.Deck == "" {
+		return invalidArgument("deck is required"), nil
+	}
+
+	// Stock AnkiConnect has no deck description action, so the tool is only
+	// registered for add-on builds that provide one
+	_, err := s.ankiRequest(ctx, "setDeckDescription", map[string]interface{}{
+		"deck":        args.Deck,
+		"description": args.Description,
+		"markdown":    args.Markdown,
+	})
+	if isUnsupportedAction(err) {
+		return toolError(codeUnsupported, "Setting deck descriptions is not supported by this AnkiConnect version"), nil
+	}
+	if err != nil {
+		return requestError("Error setting deck description", err), nil
+	}
+
+	result := map[string]interface{}{
+		"deck":     args.Deck,
+		"markdown": args.Markdown,
+		"message":  "Deck description updated",
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+// minRetentionSample is the fewest mature reviews needed before a
+// retention figure is reported.
+const minRetentionSample = 20
+
+// matureRetention counts review-type log entries made while the card was
+// mature, and how many of them were not answered Again.
+func matureRetention(reviews map[string][]map[string]interface{}) (passed, total int) {
+	for _, cardReviews := range reviews {
+		for _, review := range cardReviews {
+			reviewType, _ := review["type"].(float64)
+			lastInterval, _ := review["lastIvl"].(float64)
+			if reviewType != 1 || lastInterval < matureInterval {
+				continue
+			}
+			total++
+			if button, _ := review["ease"].(float64); button != 1 {
+				passed++
+			}
+		}
+	}
+	return passed, total
+}
+
+func (s *AnkiServer) handleTagRetention(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[TagRetentionArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if args.Tag == "" {
+		return invalidArgument("tag is required"), nil
+	}
+
+	cardIDs, err := s.findIDs(ctx, "findCards", searchTerm("tag", args.Tag))
+	if err != nil {
+		return requestError("Error finding cards", err), nil
+	}
+	reviews, err := s.reviewsOfCards(ctx, cardIDs)
+	if err != nil {
+		return requestError("Error getting reviews", err), nil
+	}
+
+	passed, total := matureRetention(reviews)
+	result := map[string]interface{}{
+		"tag":            args.Tag,
+		"cards":          len(cardIDs),
+		"mature_reviews": total,
+		"retention":      nil,
+	}
+	if total < minRetentionSample {
+		result["message"] = fmt.Sprintf("At least %d mature reviews are needed to estimate retention", minRetentionSample)
+	} else {
+		result["retention"] = 100 * float64(passed) / float64(total)
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+var templateTagPattern = regexp.MustCompile(`{{\s*([#^/]?)\s*([^}]*?)\s*}}`)
+
+// renderTemplate performs the field substitution of an Anki card template.
+// {{#Field}} and {{^Field}} sections are kept when the field is non-empty or
+// empty respectively. Of the filters only text: is applied; type: renders
+// nothing and the rest fall back to the plain field value.
+func renderTemplate(tmpl string, fields map[string]string) string {
+	var out strings.Builder
+	type section struct {
+		name string
+		show bool
+	}
+	var stack []section
+	visible := func() bool {
+		for _, sec := range stack {
+			if !sec.show {
+				return false
+			}
+		}
+		return true
+	}
+
+	last := 0
+	for _, loc := range templateTagPattern.FindAllStringSubmatchIndex(tmpl, -1) {
+		if visible() {
+			out.WriteString(tmpl[last:loc[0]])
+		}
+		last = loc[1]
+		kind, name := tmpl[loc[2]:loc[3]], tmpl[loc[4]:loc[5]]
+
+		switch kind {
+		case "#", "^":
+			filled := strings.TrimSpace(fields[name]) != ""
+			stack = append(stack, section{name, filled == (kind == "#")})
+		case "/":
+			if len(stack) > 0 && stack[len(stack)-1].name == name {
+				stack = stack[:len(stack)-1]
+			}
+		default:
+			if !visible() {
+				continue
+			}
+			filters := strings.Split(name, ":")
+			value := fields[strings.TrimSpace(filters[len(filters)-1])]
+			for _, filter := range filters[:len(filters)-1] {
+				switch strings.TrimSpace(filter) {
+				case "text":
+					value = stripHTML(value)
+				case "type":
+					value = ""
+				}
+			}
+			out.WriteString(value)
+		}
+	}
+	if visible() {
+		out.WriteString(tmpl[last:])
+	}
+	return out.String()
+}
+
+func (s *AnkiServer) handleRenderTemplate(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[RenderTemplateArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if args.ModelName == "" {
+		return invalidArgument("model_name is required"), nil
+	}
+
+	templates, err := s.modelTemplates(ctx, args.ModelName)
+	if err != nil {
+		return requestError("Error getting templates", err), nil
+	}
+
+	names := make([]string, 0, len(templates))
+	for name := range templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	cards := make([]map[string]interface{}, 0, len(names))
+	for _, name := range names {
+		sides, _ := templates[name].(map[string]interface{})
+		frontTemplate, _ := sides["Front"].(string)
+		backTemplate, _ := sides["Back"].(string)
+
+		front := renderTemplate(frontTemplate, args.Fields)
+		backFields := make(map[string]string, len(args.Fields)+1)
+		for field, value := range args.Fields {
+			backFields[field] = value
+		}
+		backFields["FrontSide"] = front
+
+		cards = append(cards, map[string]interface{}{
+			"template": name,
+			"front":    front,
+			"back":     renderTemplate(backTemplate, backFields),
+		})
+	}
+
+	result := map[string]interface{}{
+		"model": args.ModelName,
+		"cards": cards,
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+// mapFieldsByName pairs source fields with target fields of the same name,
+// falling back to a case-insensitive match. Source fields with no match are
+// returned as unmapped.
+func mapFieldsByName(source, target []string) (mapping map[string]string, unmapped []string) {
+	mapping = map[string]string{}
+	used := map[string]bool{}
+	for _, field := range source {
+		for _, candidate := range target {
+			if candidate == field && !used[candidate] {
+				mapping[field] = candidate
+				used[candidate] = true
+				break
+			}
+		}
+	}
+	for _, field := range source {
+		if _, ok := mapping[field]; ok {
+			continue
+		}
+		for _, candidate := range target {
+			if strings.EqualFold(candidate, field) && !used[candidate] {
+				mapping[field] = candidate
+				used[candidate] = true
+				break
+			}
+		}
+		if _, ok := mapping[field]; !ok {
+			unmapped = append(unmapped, field)
+		}
+	}
+	return mapping, unmapped
+}
+
+func (s *AnkiServer) handleConsolidateModels(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[ConsolidateModelsArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if args.SourceModel == "" || args.TargetModel == "" {
+		return invalidArgument("source_model and target_model are required"), nil
+	}
+	if args.SourceModel == args.TargetModel {
+		return invalidArgument("source_model and target_model must differ"), nil
+	}
+
+	sourceFields, err := s.modelFieldNames(ctx, args.SourceModel)
+	if err != nil {
+		return requestError(fmt.Sprintf("Error getting fields of %s", args.SourceModel), err), nil
+	}
+	targetFields, err := s.modelFieldNames(ctx, args.TargetModel)
+	if err != nil {
+		return requestError(fmt.Sprintf("Error getting fields of %s", args.TargetModel), err), nil
+	}
+	mapping, unmapped := mapFieldsByName(sourceFields, targetFields)
+
+	noteIDs, err := s.findIDs(ctx, "findNotes", searchTerm("note", args.SourceModel))
+	if err != nil {
+		return requestError("Error finding notes", err), nil
+	}
+
+	result := map[string]interface{}{
+		"source_model":    args.SourceModel,
+		"target_model":    args.TargetModel,
+		"field_mapping":   mapping,
+		"unmapped_fields": unmapped,
+		"notes":           len(noteIDs),
+		"converted":       0,
+	}
+
+	if !args.Confirm || len(noteIDs) == 0 {
+		if len(noteIDs) > 0 {
+			message := fmt.Sprintf("Set confirm to true to convert these notes to %q", args.TargetModel)
+			if len(unmapped) > 0 {
+				message += "; the content of the unmapped fields will be lost"
+			}
+			result["message"] = message
+		}
+		resultJSON, _ := s.marshalResult(result)
+		return &mcp.CallToolResult{
+			Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+		}, nil
+	}
+
+	notes, err := s.notesInfo(ctx, noteIDs)
+	if err != nil {
+		return requestError("Error getting notes info", err), nil
+	}
+
+	converted := 0
+	for _, note := range notes {
+		values := noteFields(note)
+		fields := make(map[string]interface{}, len(mapping))
+		for from, to := range mapping {
+			fields[to] = values[from]
+		}
+		_, err := s.ankiRequest(ctx, "updateNoteModel", map[string]interface{}{
+			"note": map[string]interface{}{
+				"id":        note["noteId"],
+				"modelName": args.TargetModel,
+				"fields":    fields,
+				"tags":      note["tags"],
+			},
+		})
+		if err != nil {
+			return requestError(fmt.Sprintf("Error converting note %v after converting %d notes", note["noteId"], converted), err), nil
+		}
+		converted++
+	}
+	result["converted"] = converted
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+func (s *AnkiServer) handleFindIdenticalSides(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[FindIdenticalSidesArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if args.Query == "" {
+		return invalidArgument("query is required"), nil
+	}
+
+	noteIDs, err := s.findIDs(ctx, "findNotes", args.Query)
+	if err != nil {
+		return requestError("Error finding notes", err), nil
+	}
+	notes, err := s.notesInfo(ctx, noteIDs)
+	if err != nil {
+		return requestError("Error getting notes info", err), nil
+	}
+
+	identical := []map[string]interface{}{}
+	for _, note := range notes {
+		values := orderedFieldValues(note)
+		if len(values) < 2 {
+			continue
+		}
+		first := strings.TrimSpace(stripHTML(values[0]))
+		// Notes with both sides empty are reported by anki_find_field_issues
+		if first == "" || first != strings.TrimSpace(stripHTML(values[1])) {
+			continue
+		}
+		identical = append(identical, map[string]interface{}{
+			"note_id": note["noteId"],
+			"model":   note["modelName"],
+			"text":    first,
+		})
+	}
+
+	result := map[string]interface{}{
+		"notes_checked": len(notes),
+		"identical":     identical,
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+const (
+	defaultTrendDays = 30
+	// maxTrendDays matches the longest window rated: searches accept.
+	maxTrendDays = 365
+)
+
+var buttonNames = []string{"", "again", "hard", "good", "easy"}
+
+// buttonsByDay counts the buttons pressed per day for the days from start
+// through end, including days without reviews.
+func buttonsByDay(reviews map[string][]map[string]interface{}, start, end time.Time) []map[string]interface{} {
+	counts := map[string][]int{}
+	for _, cardReviews := range reviews {
+		for _, review := range cardReviews {
+			id, _ := review["id"].(float64)
+			button, _ := review["ease"].(float64)
+			if button < 1 || int(button) >= len(buttonNames) {
+				continue
+			}
+			date := time.UnixMilli(int64(id)).In(start.Location()).Format(dateLayout)
+			if counts[date] == nil {
+				counts[date] = make([]int, len(buttonNames))
+			}
+			counts[date][int(button)]++
+		}
+	}
+
+	days := []map[string]interface{}{}
+	for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+		date := day.Format(dateLayout)
+		entry := map[string]interface{}{"date": date}
+		total := 0
+		for button := 1; button < len(buttonNames); button++ {
+			count := 0
+			if counts[date] != nil {
+				count = counts[date][button]
+			}
+			entry[buttonNames[button]] = count
+			total += count
+		}
+		entry["total"] = total
+		days = append(days, entry)
+	}
+	return days
+}
+
+func (s *AnkiServer) handleButtonTrend(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[ButtonTrendArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	days := args.Days
+	if days == 0 {
+		days = defaultTrendDays
+	}
+	if days < 1 || days > maxTrendDays {
+		return invalidArgument(fmt.Sprintf("days must be between 1 and %d", maxTrendDays)), nil
+	}
+
+	cardIDs, err := s.findIDs(ctx, "findCards", fmt.Sprintf("rated:%d", days))
+	if err != nil {
+		return requestError("Error finding cards", err), nil
+	}
+	reviews, err := s.reviewsOfCards(ctx, cardIDs)
+	if err != nil {
+		return requestError("Error getting reviews", err), nil
+	}
+
+	today := startOfDay(time.Now())
+	result := map[string]interface{}{
+		"days":   days,
+		"by_day": buttonsByDay(reviews, today.AddDate(0, 0, 1-days), today),
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+// formatSteps renders learning steps given in minutes the way Anki's options
+// screen does, e.g. "1m 10m 1d".
+func formatSteps(value interface{}) string {
+	steps, _ := value.([]interface{})
+	parts := make([]string, 0, len(steps))
+	for _, step := range steps {
+		minutes, _ := step.(float64)
+		switch {
+		case minutes >= 1440 && int(minutes)%1440 == 0:
+			parts = append(parts, fmt.Sprintf("%dd", int(minutes)/1440))
+		case minutes >= 60 && int(minutes)%60 == 0:
+			parts = append(parts, fmt.Sprintf("%dh", int(minutes)/60))
+		default:
+			parts = append(parts, strconv.FormatFloat(minutes, 'f', -1, 64)+"m")
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// deckConfigSettings lists the deck options explained by
+// anki_explain_deck_config, keyed by their dotted path in getDeckConfig.
+var deckConfigSettings = []struct {
+	key     string
+	label   string
+	explain func(value interface{}) string
+}{
+	{"new.perDay", "New cards/day", func(v interface{}) string { return fmt.Sprintf("%v new cards introduced per day", v) }},
+	{"rev.perDay", "Maximum reviews/day", func(v interface{}) string { return fmt.Sprintf("at most %v reviews shown per day", v) }},
+	{"new.delays", "Learning steps", func(v interface{}) string { return "new cards are shown again after " + formatSteps(v) }},
+	{"new.ints.0", "Graduating interval", func(v interface{}) string { return fmt.Sprintf("%v days after the last learning step", v) }},
+	{"new.ints.1", "Easy interval", func(v interface{}) string { return fmt.Sprintf("%v days when a new card is answered Easy", v) }},
+	{"new.initialFactor", "Starting ease", func(v interface{}) string {
+		factor, _ := v.(float64)
+		return fmt.Sprintf("%g%% interval multiplier for graduated cards", factor/10)
+	}},
+	{"rev.maxIvl", "Maximum interval", func(v interface{}) string { return fmt.Sprintf("reviews are never scheduled more than %v days out", v) }},
+	{"rev.ease4", "Easy bonus", func(v interface{}) string {
+		bonus, _ := v.(float64)
+		return fmt.Sprintf("Easy answers multiply the interval by an extra %g%%", bonus*100)
+	}},
+	{"lapse.delays", "Relearning steps", func(v interface{}) string { return "forgotten cards are shown again after " + formatSteps(v) }},
+	{"lapse.leechFails", "Leech threshold", func(v interface{}) string { return fmt.Sprintf("cards are marked as leeches after %v lapses", v) }},
+}
+
+// explainDeckConfig turns a getDeckConfig result into labelled settings with
+// plain-language explanations, skipping keys the config does not have.
+func explainDeckConfig(config map[string]interface{}) []map[string]interface{} {
+	settings := []map[string]interface{}{}
+	for _, setting := range deckConfigSettings {
+		value, ok := lookupConfigValue(config, setting.key)
+		if !ok {
+			continue
+		}
+		settings = append(settings, map[string]interface{}{
+			"setting":     setting.label,
+			"key":         setting.key,
+			"value":       value,
+			"explanation": setting.explain(value),
+		})
+	}
+	return settings
+}
+
+// lookupConfigValue is lookupPath with support for a trailing list index,
+// as in "new.ints.0".
+func lookupConfigValue(config map[string]interface{}, key string) (interface{}, bool) {
+	if dot := strings.LastIndex(key, "."); dot >= 0 {
+		if index, err := strconv.Atoi(key[dot+1:]); err == nil {
+			value, ok := lookupPath(config, key[:dot])
+			list, isList := value.([]interface{})
+			if !ok || !isList || index >= len(list) {
+				return nil, false
+			}
+			return list[index], true
+		}
+	}
+	return lookupPath(config, key)
+}
+
+func (s *AnkiServer) handleExplainDeckConfig(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[ExplainDeckConfigArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if args.Deck == "" {
+		return invalidArgument("deck is required"), nil
+	}
+
+	config, err := s.deckConfig(ctx, args.Deck)
+	if err != nil {
+		return requestError("Error getting deck config", err), nil
+	}
+
+	result := map[string]interface{}{
+		"deck":     args.Deck,
+		"config":   config["name"],
+		"settings": explainDeckConfig(config),
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+// daysUntil returns the number of calendar days from today to date, both
+// given as local midnights. Rounding absorbs daylight saving shifts.
+func daysUntil(date, today time.Time) int {
+	return int(math.Round(date.Sub(today).Hours() / 24))
+}
+
+func (s *AnkiServer) handleSetDueDate(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[SetDueDateArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	cardIDs, dropped := coerceIDs(args.CardIDs)
+	if len(dropped) > 0 {
+		return invalidArgument(fmt.Sprintf("Invalid card IDs: %v", dropped)), nil
+	}
+	if len(cardIDs) == 0 {
+		return invalidArgument("card_ids is required"), nil
+	}
+
+	date, err := time.ParseInLocation(dateLayout, args.Date, time.Local)
+	if err != nil {
+		return invalidArgument("date must be a date in YYYY-MM-DD format"), nil
+	}
+	offset := daysUntil(date, startOfDay(time.Now()))
+	if offset < 0 {
+		return invalidArgument(fmt.Sprintf("date %s is in the past", args.Date)), nil
+	}
+
+	for _, chunk := range chunkInts(cardIDs, chunkSize) {
+		if _, err := s.ankiRequest(ctx, "setDueDate", map[string]interface{}{"cards": chunk, "days": strconv.Itoa(offset)}); err != nil {
+			return requestError("Error setting due date", err), nil
+		}
+	}
+
+	result := map[string]interface{}{
+		"cards":       len(cardIDs),
+		"date":        args.Date,
+		"days_offset": offset,
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+func (s *AnkiServer) handleTagDeck(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[TagDeckArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if args.Deck == "" || args.Tag == "" {
+		return invalidArgument("deck and tag are required"), nil
+	}
+	if strings.ContainsAny(args.Tag, " \t\n") {
+		return invalidArgument("tag must not contain whitespace"), nil
+	}
+
+	includeSubdecks := args.IncludeSubdecks == nil || *args.IncludeSubdecks
+	query := searchTerm("deck", args.Deck)
+	if !includeSubdecks {
+		query = deckOnlyTerm(args.Deck)
+	}
+
+	noteIDs, err := s.findIDs(ctx, "findNotes", query)
+	if err != nil {
+		return requestError("Error finding notes", err), nil
+	}
+
+	tagged := 0
+	for _, chunk := range chunkInts(noteIDs, chunkSize) {
+		if _, err := s.ankiRequest(ctx, "addTags", map[string]interface{}{"notes": chunk, "tags": args.Tag}); err != nil {
+			return requestError(fmt.Sprintf("Error adding tag after tagging %d notes", tagged), err), nil
+		}
+		tagged += len(chunk)
+	}
+
+	result := map[string]interface{}{
+		"deck":             args.Deck,
+		"tag":              args.Tag,
+		"include_subdecks": includeSubdecks,
+		"tagged":           tagged,
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+func (s *AnkiServer) handleUnusedModels(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[UnusedModelsArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	models, err := s.modelNames(ctx)
+	if err != nil {
+		return requestError("Error getting models", err), nil
+	}
+
+	queries := make([]string, len(models))
+	for i, model := range models {
+		queries[i] = searchTerm("note", model)
+	}
+	noteIDs, err := s.findIDsConcurrently(ctx, "findNotes", queries)
+	if err != nil {
+		return requestError("Error finding notes", err), nil
+	}
+
+	unused := []string{}
+	for i, model := range models {
+		if len(noteIDs[i]) == 0 {
+			unused = append(unused, model)
+		}
+	}
+
+	result := map[string]interface{}{
+		"models_checked": len(models),
+		"unused_models":  unused,
+		"deleted":        []string{},
+	}
+
+	if !args.Delete {
+		if len(unused) > 0 {
+			result["message"] = "Remove these note types in Anki's Manage Note Types window, or set delete to true if your AnkiConnect supports deleting models"
+		}
+		resultJSON, _ := s.marshalResult(result)
+		return &mcp.CallToolResult{
+			Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+		}, nil
+	}
+
+	// Stock AnkiConnect has no action to delete a model; stop at the first
+	// sign that this one doesn't either
+	deleted := []string{}
+	for _, model := range unused {
+		_, err := s.ankiRequest(ctx, "deleteModel", map[string]interface{}{"modelName": model})
+		if isUnsupportedAction(err) {
+			return toolError(codeUnsupported, "Deleting note types is not supported by this AnkiConnect version; remove them in Anki's Manage Note Types window"), nil
+		}
+		if err != nil {
+			return requestError(fmt.Sprintf("Error deleting model %s after deleting %d models", model, len(deleted)), err), nil
+		}
+		deleted = append(deleted, model)
+	}
+	result["deleted"] = deleted
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+// deckMetrics combines a deck's getDeckStats counts with the health and
+// retention figures derived from its cards.
+func (s *AnkiServer) deckMetrics(ctx context.Context, deck string, stats map[string]interface{}) (map[string]interface{}, error) {
+	cardIDs, err := s.findIDs(ctx, "findCards", searchTerm("deck", deck))
+	if err != nil {
+		return nil, err
+	}
+	cards, err := s.cardsInfo(ctx, cardIDs)
+	if err != nil {
+		return nil, err
+	}
+	reviews, err := s.reviewsOfCards(ctx, cardIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics := cardHealthStats(cards)
+	metrics["deck"] = deck
+	for _, key := range []string{"new_count", "learn_count", "review_count"} {
+		metrics[key] = stats[key]
+	}
+	passed, total := matureRetention(reviews)
+	metrics["mature_reviews"] = total
+	metrics["retention"] = nil
+	if total >= minRetentionSample {
+		metrics["retention"] = 100 * float64(passed) / float64(total)
+	}
+	return metrics, nil
+}
+
+func (s *AnkiServer) handleCompareDecks(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[CompareDecksArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if args.First == "" || args.Second == "" {
+		return invalidArgument("first and second are required"), nil
+	}
+
+	stats, err := s.ankiRequest(ctx, "getDeckStats", map[string]interface{}{"decks": []string{args.First, args.Second}})
+	if err != nil {
+		return requestError("Error getting deck stats", err), nil
+	}
+	statsMap, _ := stats.(map[string]interface{})
+	statsByName := map[string]map[string]interface{}{}
+	for _, entry := range statsMap {
+		if deckStats, ok := entry.(map[string]interface{}); ok {
+			name, _ := deckStats["name"].(string)
+			statsByName[name] = deckStats
+		}
+	}
+
+	decks := make([]map[string]interface{}, 2)
+	for i, deck := range []string{args.First, args.Second} {
+		deckStats, ok := statsByName[deck]
+		if !ok {
+			return toolError(codeNotFound, fmt.Sprintf("Deck %s not found", deck)), nil
+		}
+		decks[i], err = s.deckMetrics(ctx, deck, deckStats)
+		if err != nil {
+			return requestError(fmt.Sprintf("Error computing metrics for %s", deck), err), nil
+		}
+	}
+
+	resultJSON, _ := s.marshalResult(map[string]interface{}{"decks": decks})
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+// filteredDeckAction validates that deck is a filtered deck and runs action
+// on it. getDeckConfig returns a filtered deck's own settings, which carry a
+// truthy dyn flag, while regular decks get their options group with dyn
+// false; a deck whose type can't be told is rejected.
+func (s *AnkiServer) filteredDeckAction(ctx context.Context, deck, action, verb string) *mcp.CallToolResult {
+	if deck == "" {
+		return invalidArgument("deck is required")
+	}
+
+	config, err := s.deckConfig(ctx, deck)
+	if err != nil {
+		return requestError("Error checking deck type", err)
+	}
+	switch dyn := config["dyn"]; dyn {
+	case true, float64(1):
+	case false, float64(0):
+		return invalidArgument(fmt.Sprintf("Deck %s is not a filtered deck", deck))
+	default:
+		return toolError(codeUnexpectedResponse, fmt.Sprintf("Could not tell whether deck %s is a filtered deck", deck))
+	}
+
+	_, err = s.ankiRequest(ctx, action, map[string]interface{}{"deck": deck})
+	if isUnsupportedAction(err) {
+		return toolError(codeUnsupported, fmt.Sprintf("%s filtered decks is not supported by this AnkiConnect version", verb))
+	}
+	if err != nil {
+		return requestError(fmt.Sprintf("Error %s filtered deck", strings.ToLower(verb)), err)
+	}
+
+	resultJSON, _ := s.marshalResult(map[string]interface{}{
+		"deck":    deck,
+		"message": fmt.Sprintf("%s filtered deck %s", verb, deck),
+	})
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}
+}
+
+func (s *AnkiServer) handleRebuildFiltered(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[FilteredDeckArgs]) (*mcp.CallToolResult, error) {
+	return s.filteredDeckAction(ctx, params.Arguments.Deck, "rebuildFilteredDeck", "Rebuilding"), nil
+}
+
+func (s *AnkiServer) handleEmptyFiltered(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[FilteredDeckArgs]) (*mcp.CallToolResult, error) {
+	return s.filteredDeckAction(ctx, params.Arguments.Deck, "emptyFilteredDeck", "Emptying"), nil
+}
+
+// dueProbeDays is how many days either side of today todayDayNumber probes
+// for a review card before searching more widely.
+const dueProbeDays = 7
+
+// dueSearchRange bounds the day offsets searched by todayDayNumber.
+const dueSearchRange = 1 << 20
+
+// scheduledReviews matches review cards whose due is a day number that
+// prop:due searches see.
+const scheduledReviews = "is:review -is:learn -is:suspended -is:buried -deck:filtered"
+
+// todayDayNumber returns today's day number as used in review cards' due
+// values. AnkiConnect doesn't expose the collection's creation, so it finds
+// a scheduled review card and how many days from today it is due with
+// prop:due searches, which are relative to today. Cards due within a week
+// are probed first; otherwise one card's offset is found by binary search.
+func (s *AnkiServer) todayDayNumber(ctx context.Context) (int64, error) {
+	offsets := make([]int, 0, 2*dueProbeDays+1)
+	queries := make([]string, 0, 2*dueProbeDays+1)
+	for day := 0; day <= dueProbeDays; day++ {
+		for _, offset := range []int{day, -day} {
+			if offset == -day && day == 0 {
+				continue
+			}
+			offsets = append(offsets, offset)
+			queries = append(queries, fmt.Sprintf("%s prop:due=%d", scheduledReviews, offset))
+		}
+	}
+	probes, err := s.findIDsConcurrently(ctx, "findCards", queries)
+	if err != nil {
+		return 0, err
+	}
+	cardID, offset := int64(0), 0
+	for i, ids := range probes {
+		if len(ids) > 0 {
+			cardID, offset = ids[0], offsets[i]
+			break
+		}
+	}
+
+	if cardID == 0 {
+		cardIDs, err := s.findIDs(ctx, "findCards", scheduledReviews)
+		if err != nil {
+			return 0, err
+		}
+		if len(cardIDs) == 0 {
+			return 0, fmt.Errorf("no scheduled review card to date today by: %w", errNotFound)
+		}
+		cardID = cardIDs[0]
+
+		// Binary search for the smallest offset the card's due is within
+		low, high := -dueSearchRange, dueSearchRange
+		for low < high {
+			mid := low + (high-low)/2
+			ids, err := s.findIDs(ctx, "findCards", fmt.Sprintf("cid:%d prop:due<=%d", cardID, mid))
+			if err != nil {
+				return 0, err
+			}
+			if len(ids) > 0 {
+				high = mid
+			} else {
+				low = mid + 1
+			}
+		}
+		offset = low
+	}
+
+	cards, err := s.cardsInfo(ctx, []int64{cardID})
+	if err != nil {
+		return 0, err
+	}
+	if len(cards) == 0 {
+		return 0, fmt.Errorf("%w from cardsInfo", errUnexpectedResponse)
+	}
+	due, _ := cards[0]["due"].(float64)
+	return int64(due) - int64(offset), nil
+}
+
+// suspendedCardDue reports whether a suspended card would be due if it were
+// unsuspended. Suspension moves cards out of their queue, so the card type
+// and due value are used instead of is:due. Review and interday learning
+// cards are due on a day number, so dated is false for them when today's
+// day number isn't known.
+func suspendedCardDue(card map[string]interface{}, today int64, haveToday bool, now time.Time) (due, dated bool) {
+	cardType, _ := card["type"].(float64)
+	dueValue, _ := card["due"].(float64)
+	if odue, _ := card["odue"].(float64); odue != 0 {
+		dueValue = odue
+	}
+	switch cardType {
+	case 1, 3:
+		// Intraday learning cards are due at a timestamp in seconds
+		if dueValue > 1e9 {
+			return int64(dueValue) <= now.Unix(), true
+		}
+	case 2:
+	default:
+		return false, true
+	}
+	if !haveToday {
+		return false, false
+	}
+	return int64(dueValue) <= today, true
+}
+
+func (s *AnkiServer) handleSuspendedDue(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[SuspendedDueArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	query := "is:suspended -is:new"
+	if args.Deck != "" {
+		query = searchTerm("deck", args.Deck) + " " + query
+	}
+
+	suspendedIDs, err := s.findIDs(ctx, "findCards", query)
+	if err != nil {
+		return requestError("Error finding cards", err), nil
+	}
+	cards, err := s.cardsInfo(ctx, suspendedIDs)
+	if err != nil {
+		return requestError("Error getting cards info", err), nil
+	}
+
+	// When every review card is suspended there's nothing to date today by;
+	// intraday learning cards are still checked against the clock
+	var today int64
+	haveToday := false
+	for _, card := range cards {
+		if _, dated := suspendedCardDue(card, 0, false, time.Now()); !dated {
+			today, err = s.todayDayNumber(ctx)
+			if err != nil && !errors.Is(err, errNotFound) {
+				return requestError("Error finding today's day number", err), nil
+			}
+			haveToday = err == nil
+			break
+		}
+	}
+
+	entries := []map[string]interface{}{}
+	var cardIDs []int64
+	undated := 0
+	now := time.Now()
+	for _, card := range cards {
+		due, dated := suspendedCardDue(card, today, haveToday, now)
+		if !dated {
+			undated++
+		}
+		if !due {
+			continue
+		}
+		cardID, _ := card["cardId"].(float64)
+		cardIDs = append(cardIDs, int64(cardID))
+		entries = append(entries, map[string]interface{}{
+			"card_id": card["cardId"],
+			"deck":    card["deckName"],
+			"front":   cardPreview(card),
+		})
+	}
+
+	result := map[string]interface{}{
+		"cards":       entries,
+		"unsuspended": 0,
+	}
+	if undated > 0 {
+		result["undated_cards"] = undated
+		result["message"] = fmt.Sprintf("Cannot date today without an unsuspended review card, so %d suspended review and interday learning cards were not checked", undated)
+	}
+
+	if args.Unsuspend {
+		for _, chunk := range chunkInts(cardIDs, chunkSize) {
+			if _, err := s.ankiRequest(ctx, "unsuspend", map[string]interface{}{"cards": chunk}); err != nil {
+				return requestError("Error unsuspending cards", err), nil
+			}
+		}
+		result["unsuspended"] = len(cardIDs)
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+const defaultNewRateDays = 14
+
+// introductionsByDay counts, per day from start through end, the cards whose
+// first logged review was a learning review on that day.
+func introductionsByDay(reviews map[string][]map[string]interface{}, start, end time.Time) []map[string]interface{} {
+	counts := map[string]int{}
+	for _, cardReviews := range reviews {
+		var first map[string]interface{}
+		firstID := 0.0
+		for _, review := range cardReviews {
+			if id, _ := review["id"].(float64); first == nil || id < firstID {
+				first, firstID = review, id
+			}
+		}
+		if reviewType, _ := first["type"].(float64); first == nil || reviewType != 0 {
+			continue
+		}
+		counts[time.UnixMilli(int64(firstID)).In(start.Location()).Format(dateLayout)]++
+	}
+
+	days := []map[string]interface{}{}
+	for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+		date := day.Format(dateLayout)
+		days = append(days, map[string]interface{}{"date": date, "introduced": counts[date]})
+	}
+	return days
+}
+
+func (s *AnkiServer) handleNewRate(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[NewRateArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if args.Deck == "" {
+		return invalidArgument("deck is required"), nil
+	}
+	days := args.Days
+	if days == 0 {
+		days = defaultNewRateDays
+	}
+	if days < 1 || days > maxTrendDays {
+		return invalidArgument(fmt.Sprintf("days must be between 1 and %d", maxTrendDays)), nil
+	}
+
+	config, err := s.deckConfig(ctx, args.Deck)
+	if err != nil {
+		return requestError("Error getting deck config", err), nil
+	}
+	perDay, _ := lookupPath(config, "new.perDay")
+
+	cardIDs, err := s.findIDs(ctx, "findCards", fmt.Sprintf("%s introduced:%d", searchTerm("deck", args.Deck), days))
+	if err != nil {
+		return requestError("Error finding cards", err), nil
+	}
+	reviews, err := s.reviewsOfCards(ctx, cardIDs)
+	if err != nil {
+		return requestError("Error getting reviews", err), nil
+	}
+
+	today := startOfDay(time.Now())
+	byDay := introductionsByDay(reviews, today.AddDate(0, 0, 1-days), today)
+	total := 0
+	for _, day := range byDay {
+		total += day["introduced"].(int)
+	}
+
+	result := map[string]interface{}{
+		"deck":               args.Deck,
+		"days":               days,
+		"configured_per_day": perDay,
+		"actual_per_day":     float64(total) / float64(days),
+		"introduced":         total,
+		"by_day":             byDay,
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+// decksCSV renders deck names and IDs as CSV with one column per hierarchy
+// level, sorted by full path.
+func decksCSV(decks map[string]int64) (string, error) {
+	names := make([]string, 0, len(decks))
+	depth := 0
+	for name := range decks {
+		names = append(names, name)
+		if levels := len(strings.Split(name, "::")); levels > depth {
+			depth = levels
+		}
+	}
+	sort.Strings(names)
+
+	var buf strings.Builder
+	w := csv.NewWriter(&buf)
+	header := []string{"path", "id"}
+	for level := 1; level <= depth; level++ {
+		header = append(header, fmt.Sprintf("level_%d", level))
+	}
+	if err := w.Write(header); err != nil {
+		return "", err
+	}
+	for _, name := range names {
+		row := make([]string, len(header))
+		row[0] = name
+		row[1] = strconv.FormatInt(decks[name], 10)
+		copy(row[2:], strings.Split(name, "::"))
+		if err := w.Write(row); err != nil {
+			return "", err
+		}
+	}
+	w.Flush()
+	return buf.String(), w.Error()
+}
+
+func (s *AnkiServer) handleExportDecks(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[ExportDecksArgs]) (*mcp.CallToolResult, error) {
+	result, err := s.ankiRequest(ctx, "deckNamesAndIds", nil)
+	if err != nil {
+		return requestError("Error getting decks", err), nil
+	}
+	deckMap, ok := result.(map[string]interface{})
+	if !ok {
+		return toolError(codeUnexpectedResponse, "Unexpected response format from deckNamesAndIds"), nil
+	}
+
+	decks := make(map[string]int64, len(deckMap))
+	for name, id := range deckMap {
+		f, _ := id.(float64)
+		decks[name] = int64(f)
+	}
+
+	text, err := decksCSV(decks)
+	if err != nil {
+		return toolError(codeInternal, fmt.Sprintf("Error writing CSV: %v", err)), nil
+	}
+
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: text}},
+	}, nil
+}
+
+// normalizeFieldValue reduces a field to the text used when comparing notes
+// for duplicates: HTML removed, whitespace collapsed and lowercased.
+func normalizeFieldValue(value string) string {
+	return strings.ToLower(strings.Join(strings.Fields(stripHTML(value)), " "))
+}
+
+// duplicateClusters groups notes whose field has the same normalized value.
+// Each cluster lists note IDs oldest first; clusters are ordered by value.
+func duplicateClusters(notes []map[string]interface{}, field string) []map[string]interface{} {
+	groups := map[string][]int64{}
+	for _, note := range notes {
+		value, ok := noteFields(note)[field]
+		if !ok {
+			continue
+		}
+		normalized := normalizeFieldValue(value)
+		if normalized == "" {
+			continue
+		}
+		noteID, _ := note["noteId"].(float64)
+		groups[normalized] = append(groups[normalized], int64(noteID))
+	}
+
+	values := make([]string, 0, len(groups))
+	for value, ids := range groups {
+		if len(ids) > 1 {
+			values = append(values, value)
+		}
+	}
+	sort.Strings(values)
+
+	clusters := make([]map[string]interface{}, len(values))
+	for i, value := range values {
+		ids := groups[value]
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		clusters[i] = map[string]interface{}{"value": value, "note_ids": ids}
+	}
+	return clusters
+}
+
+func (s *AnkiServer) handleDeckDuplicates(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[DeckDuplicatesArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if args.Deck == "" || args.Field == "" {
+		return invalidArgument("deck and field are required"), nil
+	}
+
+	noteIDs, err := s.findIDs(ctx, "findNotes", searchTerm("deck", args.Deck))
+	if err != nil {
+		return requestError("Error finding notes", err), nil
+	}
+	notes, err := s.notesInfo(ctx, noteIDs)
+	if err != nil {
+		return requestError("Error getting notes info", err), nil
+	}
+
+	clusters := duplicateClusters(notes, args.Field)
+	tagsByNote := make(map[int64][]interface{}, len(notes))
+	for _, note := range notes {
+		noteID, _ := note["noteId"].(float64)
+		tagsByNote[int64(noteID)], _ = note["tags"].([]interface{})
+	}
+
+	result := map[string]interface{}{
+		"deck":     args.Deck,
+		"field":    args.Field,
+		"clusters": clusters,
+		"deleted":  0,
+	}
+
+	if !args.Confirm {
+		if len(clusters) > 0 {
+			result["message"] = "Set confirm to true to keep the oldest note of each cluster, copy the others' tags onto it and delete them"
+		}
+		resultJSON, _ := s.marshalResult(result)
+		return &mcp.CallToolResult{
+			Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+		}, nil
+	}
+
+	deleted := 0
+	for _, cluster := range clusters {
+		ids := cluster["note_ids"].([]int64)
+		keep, duplicates := ids[0], ids[1:]
+
+		var tags []string
+		for _, id := range duplicates {
+			for _, tag := range tagsByNote[id] {
+				if t, ok := tag.(string); ok {
+					tags = append(tags, t)
+				}
+			}
+		}
+		if len(tags) > 0 {
+			if _, err := s.ankiRequest(ctx, "addTags", map[string]interface{}{"notes": []int64{keep}, "tags": strings.Join(tags, " ")}); err != nil {
+				return requestError(fmt.Sprintf("Error merging tags into note %d after deleting %d notes", keep, deleted), err), nil
+			}
+		}
+		if _, err := s.ankiRequest(ctx, "deleteNotes", map[string]interface{}{"notes": duplicates}); err != nil {
+			return requestError(fmt.Sprintf("Error deleting duplicates of note %d after deleting %d notes", keep, deleted), err), nil
+		}
+		deleted += len(duplicates)
+	}
+	result["deleted"] = deleted
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+// settableCardKeys are the card columns anki_set_card_values may change.
+var settableCardKeys = map[string]bool{"ivl": true, "factor": true, "due": true, "reps": true, "lapses": true}
+
+// cardValueKeys validates the keys of a set_card_values request and returns
+// them sorted.
+func cardValueKeys(values map[string]int) ([]string, error) {
+	if len(values) == 0 {
+		return nil, errors.New("values is required")
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		if !settableCardKeys[key] {
+			return nil, fmt.Errorf("unknown key %q: must be one of ivl, factor, due, reps, lapses", key)
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *AnkiServer) handleSetCardValues(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[SetCardValuesArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if args.CardID == 0 {
+		return invalidArgument("card_id is required"), nil
+	}
+	keys, err := cardValueKeys(args.Values)
+	if err != nil {
+		return invalidArgument(err.Error()), nil
+	}
+	newValues := make([]int, len(keys))
+	for i, key := range keys {
+		newValues[i] = args.Values[key]
+	}
+
+	// AnkiConnect refuses keys it considers dangerous unless warning_check
+	// is set
+	_, err = s.ankiRequest(ctx, "setSpecificValueOfCard", map[string]interface{}{
+		"card":          args.CardID,
+		"keys":          keys,
+		"newValues":     newValues,
+		"warning_check": args.WarningCheck,
+	})
+	if err != nil {
+		return requestError("Error setting card values", err), nil
+	}
+
+	cards, err := s.cardsInfo(ctx, []int64{args.CardID})
+	if err != nil {
+		return requestError("Error getting card info", err), nil
+	}
+	if len(cards) == 0 {
+		return toolError(codeNotFound, fmt.Sprintf("Card %d not found", args.CardID)), nil
+	}
+
+	resultJSON, _ := s.marshalResult(cards[0])
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+func (s *AnkiServer) handleLearningQueue(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[LearningQueueArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	query := "is:learn"
+	if args.Deck != "" {
+		query = searchTerm("deck", args.Deck) + " " + query
+	}
+
+	cardIDs, err := s.findIDs(ctx, "findCards", query)
+	if err != nil {
+		return requestError("Error finding cards", err), nil
+	}
+	cards, err := s.cardsInfo(ctx, cardIDs)
+	if err != nil {
+		return requestError("Error getting cards info", err), nil
+	}
+
+	// Intraday learning cards (queue 1) are due at a timestamp in seconds and
+	// come before interday ones (queue 3), which are due on a day number
+	sort.Slice(cards, func(i, j int) bool {
+		qi, _ := cards[i]["queue"].(float64)
+		qj, _ := cards[j]["queue"].(float64)
+		if qi != qj {
+			return qi < qj
+		}
+		di, _ := cards[i]["due"].(float64)
+		dj, _ := cards[j]["due"].(float64)
+		return di < dj
+	})
+
+	now := time.Now()
+	entries := make([]map[string]interface{}, len(cards))
+	for i, card := range cards {
+		queue, _ := card["queue"].(float64)
+		due, _ := card["due"].(float64)
+		left, _ := card["left"].(float64)
+		entry := map[string]interface{}{
+			"card_id":    card["cardId"],
+			"deck":       card["deckName"],
+			"front":      cardPreview(card),
+			"steps_left": int(left) % 1000,
+			"relearning": card["type"] == float64(3),
+		}
+		if queue == 1 {
+			dueAt := time.Unix(int64(due), 0)
+			entry["due"] = dueAt.Format(time.RFC3339)
+			entry["minutes_until_due"] = math.Max(0, math.Ceil(dueAt.Sub(now).Minutes()))
+		} else {
+			// Day numbers count from the collection's creation, which
+			// AnkiConnect doesn't expose, so no date can be given
+			entry["due"] = nil
+			entry["interday"] = true
+		}
+		entries[i] = entry
+	}
+
+	result := map[string]interface{}{
+		"total": len(entries),
+		"cards": entries,
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+func (s *AnkiServer) handleBulkSetField(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[BulkSetFieldArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if args.Field == "" || len(args.Values) == 0 {
+		return invalidArgument("field and values are required"), nil
+	}
+
+	// JSON object keys are strings, so the note IDs arrive as text
+	keys := make([]string, 0, len(args.Values))
+	for key := range args.Values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	results := make([]map[string]interface{}, len(keys))
+	var noteIDs []int64
+	for i, key := range keys {
+		results[i] = map[string]interface{}{"note_id": key, "success": false}
+		noteID, err := strconv.ParseInt(key, 10, 64)
+		if err != nil {
+			results[i]["error"] = "invalid note ID"
+			continue
+		}
+		results[i]["note_id"] = noteID
+		noteIDs = append(noteIDs, noteID)
+	}
+
+	notes, err := s.notesInfo(ctx, noteIDs)
+	if err != nil {
+		return requestError("Error getting notes info", err), nil
+	}
+	notesByID := make(map[int64]map[string]interface{}, len(notes))
+	for _, note := range notes {
+		if noteID, ok := note["noteId"].(float64); ok {
+			notesByID[int64(noteID)] = note
+		}
+	}
+
+	updated := 0
+	for i, key := range keys {
+		noteID, ok := results[i]["note_id"].(int64)
+		if !ok {
+			continue
+		}
+		note, ok := notesByID[noteID]
+		if !ok {
+			results[i]["error"] = "note not found"
+			continue
+		}
+		if _, ok := noteFields(note)[args.Field]; !ok {
+			results[i]["error"] = fmt.Sprintf("model %v has no field %s", note["modelName"], args.Field)
+			continue
+		}
+		_, err := s.ankiRequest(ctx, "updateNoteFields", map[string]interface{}{
+			"note": map[string]interface{}{"id": noteID, "fields": map[string]string{args.Field: args.Values[key]}},
+		})
+		if err != nil {
+			results[i]["error"] = err.Error()
+			continue
+		}
+		results[i]["success"] = true
+		updated++
+	}
+
+	result := map[string]interface{}{
+		"field":   args.Field,
+		"updated": updated,
+		"results": results,
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+func (s *AnkiServer) handleConfigUsage(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[ConfigUsageArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if (args.ConfigID == 0) == (args.Name == "") {
+		return invalidArgument("Provide exactly one of config_id or name"), nil
+	}
+
+	decks, err := s.ankiRequest(ctx, "deckNames", nil)
+	if err != nil {
+		return requestError("Error getting decks", err), nil
+	}
+	deckNames, ok := decks.([]interface{})
+	if !ok {
+		return toolError(codeUnexpectedResponse, "Unexpected response format from deckNames"), nil
+	}
+
+	using := []string{}
+	var configName interface{}
+	for _, d := range deckNames {
+		name, _ := d.(string)
+		config, err := s.deckConfig(ctx, name)
+		if err != nil {
+			return requestError(fmt.Sprintf("Error getting config of %s", name), err), nil
+		}
+		id, _ := config["id"].(float64)
+		if (args.ConfigID != 0 && int64(id) == args.ConfigID) || (args.Name != "" && config["name"] == args.Name) {
+			using = append(using, name)
+			configName = config["name"]
+		}
+	}
+	sort.Strings(using)
+
+	result := map[string]interface{}{
+		"decks": using,
+	}
+	if args.ConfigID != 0 {
+		result["config_id"] = args.ConfigID
+		result["name"] = configName
+	} else {
+		result["name"] = args.Name
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+func (s *AnkiServer) handleNeverReviewed(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[NeverReviewedArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if args.Query == "" {
+		return invalidArgument("query is required"), nil
+	}
+
+	cardIDs, err := s.findIDs(ctx, "findCards", args.Query)
+	if err != nil {
+		return requestError("Error finding cards", err), nil
+	}
+	reviews, err := s.reviewsOfCards(ctx, cardIDs)
+	if err != nil {
+		return requestError("Error getting reviews", err), nil
+	}
+
+	// is:new also matches cards that were studied and then reset, so the
+	// review log is the only reliable signal
+	var unreviewed []int64
+	for _, id := range cardIDs {
+		if len(reviews[strconv.FormatInt(id, 10)]) == 0 {
+			unreviewed = append(unreviewed, id)
+		}
+	}
+	cards, err := s.cardsInfo(ctx, unreviewed)
+	if err != nil {
+		return requestError("Error getting cards info", err), nil
+	}
+
+	entries := make([]map[string]interface{}, len(cards))
+	for i, card := range cards {
+		entries[i] = map[string]interface{}{
+			"card_id": card["cardId"],
+			"front":   cardPreview(card),
+		}
+	}
+
+	result := map[string]interface{}{
+		"cards_checked": len(cardIDs),
+		"cards":         entries,
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+func (s *AnkiServer) handleShuffleNew(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[ShuffleNewArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if args.Deck == "" {
+		return invalidArgument("deck is required"), nil
+	}
+
+	cardIDs, err := s.findIDs(ctx, "findCards", searchTerm("deck", args.Deck)+" is:new")
+	if err != nil {
+		return requestError("Error finding cards", err), nil
+	}
+	cards, err := s.cardsInfo(ctx, cardIDs)
+	if err != nil {
+		return requestError("Error getting cards info", err), nil
+	}
+
+	// For new cards due is the queue position; reusing the existing positions
+	// keeps the deck's new cards in the same place relative to other decks
+	var newIDs []int64
+	var positions []int
+	for _, card := range cards {
+		if cardType, _ := card["type"].(float64); cardType != 0 {
+			continue
+		}
+		cardID, _ := card["cardId"].(float64)
+		due, _ := card["due"].(float64)
+		newIDs = append(newIDs, int64(cardID))
+		positions = append(positions, int(due))
+	}
+	rand.Shuffle(len(positions), func(i, j int) { positions[i], positions[j] = positions[j], positions[i] })
+
+	for i, cardID := range newIDs {
+		_, err := s.ankiRequest(ctx, "setSpecificValueOfCard", map[string]interface{}{
+			"card":      cardID,
+			"keys":      []string{"due"},
+			"newValues": []int{positions[i]},
+		})
+		if err != nil {
+			return requestError(fmt.Sprintf("Error repositioning card %d after repositioning %d cards", cardID, i), err), nil
+		}
+	}
+
+	result := map[string]interface{}{
+		"deck":     args.Deck,
+		"shuffled": len(newIDs),
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+func (s *AnkiServer) handleNoteHistory(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[NoteHistoryArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if args.NoteID == 0 {
+		return invalidArgument("note_id is required"), nil
+	}
+
+	mods, err := s.modTimes(ctx, "notesModTime", "notes", "noteId", []int64{args.NoteID})
+	if err != nil {
+		return requestError("Error getting note modification time", err), nil
+	}
+	mod, ok := mods[args.NoteID]
+	if !ok {
+		return toolError(codeNotFound, fmt.Sprintf("Note %d not found", args.NoteID)), nil
+	}
+
+	cardIDs, err := s.findIDs(ctx, "findCards", fmt.Sprintf("nid:%d", args.NoteID))
+	if err != nil {
+		return requestError("Error finding cards", err), nil
+	}
+	reviews, err := s.reviewsOfCards(ctx, cardIDs)
+	if err != nil {
+		return requestError("Error getting reviews", err), nil
+	}
+
+	reviewCount := 0
+	var first, last float64
+	for _, cardReviews := range reviews {
+		for _, review := range cardReviews {
+			id, _ := review["id"].(float64)
+			if reviewCount == 0 || id < first {
+				first = id
+			}
+			if id > last {
+				last = id
+			}
+			reviewCount++
+		}
+	}
+
+	// Anki keeps no log of field edits, only the last modification time
+	result := map[string]interface{}{
+		"note_id":      args.NoteID,
+		"created":      time.UnixMilli(args.NoteID).Format(time.RFC3339),
+		"modified":     time.Unix(mod, 0).Format(time.RFC3339),
+		"cards":        len(cardIDs),
+		"reviews":      reviewCount,
+		"first_review": nil,
+		"last_review":  nil,
+		"message":      "Anki does not record individual edits; only the last modification time is available",
+	}
+	if reviewCount > 0 {
+		result["first_review"] = time.UnixMilli(int64(first)).Format(time.RFC3339)
+		result["last_review"] = time.UnixMilli(int64(last)).Format(time.RFC3339)
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+var (
+	clozeOpenPattern   = regexp.MustCompile(`{{c([^:}]*)::`)
+	clozeMarkerPattern = regexp.MustCompile(`{{c\d+::(.*?)(?:::[^}]*)?}}`)
+	clozeSingleColon   = regexp.MustCompile(`{{c\d+:(?:[^:]|$)`)
+	clozeSingleBrace   = regexp.MustCompile(`(?:^|[^{]){c\d+::`)
+)
+
+// clozeFieldNames returns the fields a model's templates render with the
+// cloze filter. It is empty for models that are not cloze models.
+func clozeFieldNames(templates map[string]interface{}) []string {
+	seen := map[string]bool{}
+	var fields []string
+	for _, template := range templates {
+		sides, _ := template.(map[string]interface{})
+		for _, side := range sides {
+			text, _ := side.(string)
+			for _, match := range templateTagPattern.FindAllStringSubmatch(text, -1) {
+				// Filters precede the field name, as in {{text:cloze:Text}}
+				parts := strings.Split(match[2], ":")
+				if match[1] != "" || len(parts) < 2 {
+					continue
+				}
+				name := strings.TrimSpace(parts[len(parts)-1])
+				for _, filter := range parts[:len(parts)-1] {
+					if strings.TrimSpace(filter) == "cloze" && !seen[name] {
+						seen[name] = true
+						fields = append(fields, name)
+					}
+				}
+			}
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// clozeIssues lists the problems found in the cloze markup of a field value.
+func clozeIssues(value string) []string {
+	var issues []string
+	if !strings.Contains(value, "{{c") {
+		return []string{"no_cloze"}
+	}
+	if strings.Count(value, "{{") != strings.Count(value, "}}") {
+		issues = append(issues, "unbalanced_braces")
+	}
+	for _, match := range clozeOpenPattern.FindAllStringSubmatch(value, -1) {
+		if index, err := strconv.Atoi(match[1]); err != nil || index < 1 {
+			issues = append(issues, "invalid_index")
+			break
+		}
+	}
+	if clozeSingleColon.MatchString(value) || clozeSingleBrace.MatchString(value) {
+		issues = append(issues, "malformed_marker")
+	}
+	for _, match := range clozeMarkerPattern.FindAllStringSubmatch(value, -1) {
+		if strings.TrimSpace(stripHTML(match[1])) == "" {
+			issues = append(issues, "empty_cloze")
+			break
+		}
+	}
+	return issues
+}
+
+func (s *AnkiServer) handleAuditCloze(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[AuditClozeArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if (args.Deck == "") == (args.Query == "") {
+		return invalidArgument("Provide exactly one of deck or query"), nil
+	}
+	query := args.Query
+	if args.Deck != "" {
+		query = searchTerm("deck", args.Deck)
+	}
+
+	noteIDs, err := s.findIDs(ctx, "findNotes", query)
+	if err != nil {
+		return requestError("Error finding notes", err), nil
+	}
+	notes, err := s.notesInfo(ctx, noteIDs)
+	if err != nil {
+		return requestError("Error getting notes info", err), nil
+	}
+
+	clozeFieldsByModel := map[string][]string{}
+	checked := 0
+	problems := []map[string]interface{}{}
+	for _, note := range notes {
+		model, _ := note["modelName"].(string)
+		clozeFields, ok := clozeFieldsByModel[model]
+		if !ok {
+			templates, err := s.modelTemplates(ctx, model)
+			if err != nil {
+				return requestError(fmt.Sprintf("Error getting templates of %s", model), err), nil
+			}
+			clozeFields = clozeFieldNames(templates)
+			clozeFieldsByModel[model] = clozeFields
+		}
+		if len(clozeFields) == 0 {
+			continue
+		}
+		checked++
+
+		fields := noteFields(note)
+		noteIssues := map[string][]string{}
+		for _, field := range clozeFields {
+			if issues := clozeIssues(fields[field]); len(issues) > 0 {
+				noteIssues[field] = issues
+			}
+		}
+		if len(noteIssues) > 0 {
+			problems = append(problems, map[string]interface{}{
+				"note_id": note["noteId"],
+				"model":   model,
+				"issues":  noteIssues,
+			})
+		}
+	}
+
+	result := map[string]interface{}{
+		"cloze_notes_checked": checked,
+		"notes":               problems,
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+func (s *AnkiServer) handleMostReviewed(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[MostReviewedArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if args.Query == "" {
+		return invalidArgument("query is required"), nil
+	}
+	limit := args.Limit
+	if limit <= 0 {
+		limit = defaultRankLimit
+	}
+
+	cardIDs, err := s.findIDs(ctx, "findCards", args.Query)
+	if err != nil {
+		return requestError("Error finding cards", err), nil
+	}
+	cards, err := s.cardsInfo(ctx, cardIDs)
+	if err != nil {
+		return requestError("Error getting cards info", err), nil
+	}
+
+	sort.SliceStable(cards, func(i, j int) bool {
+		ri, _ := cards[i]["reps"].(float64)
+		rj, _ := cards[j]["reps"].(float64)
+		return ri > rj
+	})
+	if len(cards) > limit {
+		cards = cards[:limit]
+	}
+
+	entries := make([]map[string]interface{}, len(cards))
+	for i, card := range cards {
+		entries[i] = map[string]interface{}{
+			"card_id": card["cardId"],
+			"front":   cardPreview(card),
+			"reps":    card["reps"],
+			"lapses":  card["lapses"],
+		}
+	}
+
+	result := map[string]interface{}{
+		"cards_checked": len(cardIDs),
+		"cards":         entries,
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+// trailingAgainRun counts how many of a card's most recent reviews in a row
+// were answered Again.
+func trailingAgainRun(reviews []map[string]interface{}) int {
+	sorted := make([]map[string]interface{}, len(reviews))
+	copy(sorted, reviews)
+	sort.Slice(sorted, func(i, j int) bool {
+		a, _ := sorted[i]["id"].(float64)
+		b, _ := sorted[j]["id"].(float64)
+		return a < b
+	})
+	run := 0
+	for i := len(sorted) - 1; i >= 0; i-- {
+		if button, _ := sorted[i]["ease"].(float64); button != 1 {
+			break
+		}
+		run++
+	}
+	return run
+}
+
+func (s *AnkiServer) handleSuspendChronicFails(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[SuspendChronicFailsArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if args.Query == "" {
+		return invalidArgument("query is required"), nil
+	}
+	if args.Threshold < 1 {
+		return invalidArgument("threshold must be at least 1"), nil
+	}
+
+	cardIDs, err := s.findIDs(ctx, "findCards", "("+args.Query+") -is:suspended")
+	if err != nil {
+		return requestError("Error finding cards", err), nil
+	}
+	reviews, err := s.reviewsOfCards(ctx, cardIDs)
+	if err != nil {
+		return requestError("Error getting reviews", err), nil
+	}
+
+	suspended := []map[string]interface{}{}
+	var toSuspend []int64
+	for _, id := range cardIDs {
+		if run := trailingAgainRun(reviews[strconv.FormatInt(id, 10)]); run > args.Threshold {
+			toSuspend = append(toSuspend, id)
+			suspended = append(suspended, map[string]interface{}{"card_id": id, "consecutive_again": run})
+		}
+	}
+
+	for _, chunk := range chunkInts(toSuspend, chunkSize) {
+		if _, err := s.ankiRequest(ctx, "suspend", map[string]interface{}{"cards": chunk}); err != nil {
+			return requestError("Error suspending cards", err), nil
+		}
+	}
+
+	result := map[string]interface{}{
+		"cards_checked": len(cardIDs),
+		"threshold":     args.Threshold,
+		"suspended":     suspended,
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+// subdecksOf returns the decks below parent, sorted by name. Only direct
+// children are included unless recursive is set. Matching on "parent::"
+// keeps a sibling such as "Lang2" from counting as a child of "Lang".
+func subdecksOf(decks map[string]int64, parent string, recursive bool) []map[string]interface{} {
+	prefix := parent + "::"
+	var names []string
+	for name := range decks {
+		rest, ok := strings.CutPrefix(name, prefix)
+		if !ok || rest == "" {
+			continue
+		}
+		if !recursive && strings.Contains(rest, "::") {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	subdecks := make([]map[string]interface{}, len(names))
+	for i, name := range names {
+		subdecks[i] = map[string]interface{}{"name": name, "id": decks[name]}
+	}
+	return subdecks
+}
+
+func (s *AnkiServer) handleSubdecks(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[SubdecksArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if args.Deck == "" {
+		return invalidArgument("deck is required"), nil
+	}
+
+	result, err := s.ankiRequest(ctx, "deckNamesAndIds", nil)
+	if err != nil {
+		return requestError("Error getting decks", err), nil
+	}
+	deckMap, ok := result.(map[string]interface{})
+	if !ok {
+		return toolError(codeUnexpectedResponse, "Unexpected response format from deckNamesAndIds"), nil
+	}
+	if _, ok := deckMap[args.Deck]; !ok {
+		return toolError(codeNotFound, fmt.Sprintf("Deck %s not found", args.Deck)), nil
+	}
+
+	decks := make(map[string]int64, len(deckMap))
+	for name, id := range deckMap {
+		f, _ := id.(float64)
+		decks[name] = int64(f)
+	}
+
+	resultJSON, _ := s.marshalResult(map[string]interface{}{
+		"deck":      args.Deck,
+		"recursive": args.Recursive,
+		"subdecks":  subdecksOf(decks, args.Deck, args.Recursive),
+	})
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+const (
+	defaultRetentionDays = 30
+	// defaultRetentionSampleCap bounds how many cards' review logs are
+	// fetched for anki_collection_retention.
+	defaultRetentionSampleCap = 2000
+)
+
+// reviewsSince keeps only the reviews logged at or after cutoff, given in
+// milliseconds.
+func reviewsSince(reviews map[string][]map[string]interface{}, cutoff int64) map[string][]map[string]interface{} {
+	filtered := make(map[string][]map[string]interface{}, len(reviews))
+	for cardID, cardReviews := range reviews {
+		for _, review := range cardReviews {
+			if id, _ := review["id"].(float64); int64(id) >= cutoff {
+				filtered[cardID] = append(filtered[cardID], review)
+			}
+		}
+	}
+	return filtered
+}
+
+func (s *AnkiServer) handleCollectionRetention(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[CollectionRetentionArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	days := args.Days
+	if days == 0 {
+		days = defaultRetentionDays
+	}
+	if days < 1 || days > maxTrendDays {
+		return invalidArgument(fmt.Sprintf("days must be between 1 and %d", maxTrendDays)), nil
+	}
+	sampleCap := args.SampleCap
+	if sampleCap == 0 {
+		sampleCap = defaultRetentionSampleCap
+	}
+	if sampleCap < 1 {
+		return invalidArgument("sample_cap must be positive"), nil
+	}
+
+	cardIDs, err := s.findIDs(ctx, "findCards", fmt.Sprintf("rated:%d", days))
+	if err != nil {
+		return requestError("Error finding cards", err), nil
+	}
+	sampled := cardIDs
+	if len(cardIDs) > sampleCap {
+		sampled = make([]int64, sampleCap)
+		for i, index := range rand.Perm(len(cardIDs))[:sampleCap] {
+			sampled[i] = cardIDs[index]
+		}
+	}
+
+	reviews, err := s.reviewsOfCards(ctx, sampled)
+	if err != nil {
+		return requestError("Error getting reviews", err), nil
+	}
+	cutoff := startOfDay(time.Now()).AddDate(0, 0, 1-days).UnixMilli()
+	passed, total := matureRetention(reviewsSince(reviews, cutoff))
+
+	result := map[string]interface{}{
+		"days":           days,
+		"cards_reviewed": len(cardIDs),
+		"cards_sampled":  len(sampled),
+		"estimate":       len(sampled) < len(cardIDs),
+		"mature_reviews": total,
+		"retention":      nil,
+	}
+	if total < minRetentionSample {
+		result["message"] = fmt.Sprintf("At least %d mature reviews are needed to estimate retention", minRetentionSample)
+	} else {
+		result["retention"] = 100 * float64(passed) / float64(total)
+	}
+	if total >= minRetentionSample && len(sampled) < len(cardIDs) {
+		result["message"] = fmt.Sprintf("Estimated from a random sample of %d of the %d cards reviewed", len(sampled), len(cardIDs))
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+const (
+	// minimumEase is the lowest ease factor Anki assigns, in permille.
+	minimumEase = 1300
+	// easeHellShare is the fraction of cards at minimumEase above which the
+	// distribution is flagged.
+	easeHellShare = 0.2
+)
+
+var easeBuckets = []struct {
+	label string
+	below int
+}{
+	{"<1500", 1500},
+	{"1500-1999", 2000},
+	{"2000-2499", 2500},
+	{"2500-2999", 3000},
+	{">=3000", math.MaxInt},
+}
+
+// easeHistogram buckets ease factors (in permille) and counts how many sit at
+// the minimum ease.
+func easeHistogram(factors []int) (buckets []map[string]interface{}, atMinimum int) {
+	counts := make([]int, len(easeBuckets))
+	for _, factor := range factors {
+		if factor <= minimumEase {
+			atMinimum++
+		}
+		for i, bucket := range easeBuckets {
+			if factor < bucket.below {
+				counts[i]++
+				break
+			}
+		}
+	}
+	buckets = make([]map[string]interface{}, len(easeBuckets))
+	for i, bucket := range easeBuckets {
+		buckets[i] = map[string]interface{}{"range": bucket.label, "cards": counts[i]}
+	}
+	return buckets, atMinimum
+}
+
+func (s *AnkiServer) handleEaseDistribution(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[EaseDistributionArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if args.Query == "" {
+		return invalidArgument("query is required"), nil
+	}
+
+	// New cards have no ease yet
+	cardIDs, err := s.findIDs(ctx, "findCards", "("+args.Query+") -is:new")
+	if err != nil {
+		return requestError("Error finding cards", err), nil
+	}
+
+	var factors []int
+	for _, chunk := range chunkInts(cardIDs, chunkSize) {
+		result, err := s.ankiRequest(ctx, "getEaseFactors", map[string]interface{}{"cards": chunk})
+		if err != nil {
+			return requestError("Error getting ease factors", err), nil
+		}
+		values, ok := result.([]interface{})
+		if !ok {
+			return toolError(codeUnexpectedResponse, "Unexpected response format from getEaseFactors"), nil
+		}
+		for _, value := range values {
+			if factor, ok := value.(float64); ok {
+				factors = append(factors, int(factor))
+			}
+		}
+	}
+
+	buckets, atMinimum := easeHistogram(factors)
+	result := map[string]interface{}{
+		"cards":      len(factors),
+		"buckets":    buckets,
+		"at_minimum": atMinimum,
+		"ease_hell":  len(factors) > 0 && float64(atMinimum)/float64(len(factors)) > easeHellShare,
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+func (s *AnkiServer) handleDeferToday(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[DeferTodayArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if args.Deck == "" {
+		return invalidArgument("deck is required"), nil
+	}
+	if args.Count < 1 {
+		return invalidArgument("count must be at least 1"), nil
+	}
+
+	// Learning cards are left alone; their steps are minutes apart
+	cardIDs, err := s.findIDs(ctx, "findCards", searchTerm("deck", args.Deck)+" is:due is:review -is:learn")
+	if err != nil {
+		return requestError("Error finding due cards", err), nil
+	}
+	cards, err := s.cardsInfo(ctx, cardIDs)
+	if err != nil {
+		return requestError("Error getting cards info", err), nil
+	}
+
+	// Cards with the longest intervals lose the least from a short delay
+	sort.SliceStable(cards, func(i, j int) bool {
+		ii, _ := cards[i]["interval"].(float64)
+		ij, _ := cards[j]["interval"].(float64)
+		return ii > ij
+	})
+	if len(cards) > args.Count {
+		cards = cards[:args.Count]
+	}
+
+	deferred := make([]map[string]interface{}, len(cards))
+	ids := make([]int64, len(cards))
+	for i, card := range cards {
+		cardID, _ := card["cardId"].(float64)
+		ids[i] = int64(cardID)
+		deferred[i] = map[string]interface{}{
+			"card_id":  ids[i],
+			"interval": card["interval"],
+			"front":    cardPreview(card),
+		}
+	}
+
+	for _, chunk := range chunkInts(ids, chunkSize) {
+		if _, err := s.ankiRequest(ctx, "setDueDate", map[string]interface{}{"cards": chunk, "days": "1-2"}); err != nil {
+			return requestError("Error deferring cards", err), nil
+		}
+	}
+
+	result := map[string]interface{}{
+		"deck":          args.Deck,
+		"due_before":    len(cardIDs),
+		"due_remaining": len(cardIDs) - len(ids),
+		"deferred":      deferred,
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+func (s *AnkiServer) handleNotesAddedByDeck(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[NotesAddedByDeckArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	days := args.Days
+	if days == 0 {
+		days = defaultTrendDays
+	}
+	if days < 1 {
+		return invalidArgument("days must be positive"), nil
+	}
+
+	// Notes have no deck of their own, so one added: search over cards is
+	// mapped to decks through the cards
+	cardIDs, err := s.findIDs(ctx, "findCards", fmt.Sprintf("added:%d", days))
+	if err != nil {
+		return requestError("Error finding cards", err), nil
+	}
+	cards, err := s.cardsInfo(ctx, cardIDs)
+	if err != nil {
+		return requestError("Error getting cards info", err), nil
+	}
+
+	notesByDeck := map[string]map[float64]bool{}
+	allNotes := map[float64]bool{}
+	for _, card := range cards {
+		deck, _ := card["deckName"].(string)
+		noteID, _ := card["note"].(float64)
+		if notesByDeck[deck] == nil {
+			notesByDeck[deck] = map[float64]bool{}
+		}
+		notesByDeck[deck][noteID] = true
+		allNotes[noteID] = true
+	}
+
+	decks := make([]string, 0, len(notesByDeck))
+	for deck := range notesByDeck {
+		decks = append(decks, deck)
+	}
+	sort.Slice(decks, func(i, j int) bool {
+		if len(notesByDeck[decks[i]]) != len(notesByDeck[decks[j]]) {
+			return len(notesByDeck[decks[i]]) > len(notesByDeck[decks[j]])
+		}
+		return decks[i] < decks[j]
+	})
+
+	byDeck := make([]map[string]interface{}, len(decks))
+	for i, deck := range decks {
+		byDeck[i] = map[string]interface{}{"deck": deck, "notes": len(notesByDeck[deck])}
+	}
+
+	result := map[string]interface{}{
+		"days":    days,
+		"total":   len(allNotes),
+		"by_deck": byDeck,
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+func (s *AnkiServer) handleMarkLeech(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[MarkLeechArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if (len(args.NoteIDs) == 0) == (args.Query == "") {
+		return invalidArgument("Provide exactly one of note_ids or query"), nil
+	}
+	if args.Suspend && !args.Leech {
+		return invalidArgument("suspend only applies when marking notes as leeches"), nil
+	}
+
+	noteIDs, dropped := coerceIDs(args.NoteIDs)
+	if len(dropped) > 0 {
+		return invalidArgument(fmt.Sprintf("Invalid note IDs: %v", dropped)), nil
+	}
+	if args.Query != "" {
+		var err error
+		noteIDs, err = s.findIDs(ctx, "findNotes", args.Query)
 		if err != nil {
-			return &mcp.CallToolResult{
-				Content: []mcp.Content{&mcp.TextContent{Text: fmt.Sprintf("Error finding notes: %v", err)}},
-				IsError: true,
-			}, nil
+			return requestError("Error finding notes", err), nil
+		}
+	}
+
+	action := "removeTags"
+	if args.Leech {
+		action = "addTags"
+	}
+	for _, chunk := range chunkInts(noteIDs, chunkSize) {
+		if _, err := s.ankiRequest(ctx, action, map[string]interface{}{"notes": chunk, "tags": "leech"}); err != nil {
+			return requestError("Error updating leech tag", err), nil
 		}
-		if ids == nil {
-			resultIDs = []int{}
-		} else {
-			idsSlice, ok := ids.([]interface{})
-			if !ok {
-				return &mcp.CallToolResult{
-					Content: []mcp.Content{&mcp.TextContent{Text: "Unexpected response format from findNotes"}},
-					IsError: true,
-				}, nil
+	}
+
+	result := map[string]interface{}{
+		"leech": args.Leech,
+		"notes": len(noteIDs),
+	}
+
+	// Anki suspends a card when it becomes a leech
+	if args.Suspend {
+		suspended := 0
+		for _, chunk := range chunkInts(noteIDs, chunkSize) {
+			cardIDs, err := s.findIDs(ctx, "findCards", "nid:"+joinInts(chunk))
+			if err != nil {
+				return requestError("Error finding cards", err), nil
 			}
-			resultIDs = make([]int, len(idsSlice))
-			for i, v := range idsSlice {
-				// AnkiConnect always returns numbers as float64
-				if f, ok := v.(float64); ok {
-					resultIDs[i] = int(f)
-				} else {
-					return &mcp.CallToolResult{
-						Content: []mcp.Content{&mcp.TextContent{Text: "Non-numeric ID in findNotes result"}},
-						IsError: true,
-					}, nil
+			if len(cardIDs) == 0 {
+				continue
+			}
+			if _, err := s.ankiRequest(ctx, "suspend", map[string]interface{}{"cards": cardIDs}); err != nil {
+				return requestError(fmt.Sprintf("Error suspending cards after suspending %d cards", suspended), err), nil
+			}
+			suspended += len(cardIDs)
+		}
+		result["suspended_cards"] = suspended
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+func (s *AnkiServer) handleRescheduleModel(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[RescheduleModelArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if args.ModelName == "" {
+		return invalidArgument("model_name is required"), nil
+	}
+	switch args.Strategy {
+	case "forget":
+	case "spread":
+		if args.Days < 1 {
+			return invalidArgument("days must be at least 1 for the spread strategy"), nil
+		}
+	default:
+		return invalidArgument(fmt.Sprintf("Invalid strategy: %s. Must be 'forget' or 'spread'", args.Strategy)), nil
+	}
+
+	cardIDs, err := s.findIDs(ctx, "findCards", searchTerm("note", args.ModelName))
+	if err != nil {
+		return requestError("Error finding cards", err), nil
+	}
+
+	result := map[string]interface{}{
+		"model":       args.ModelName,
+		"strategy":    args.Strategy,
+		"cards":       len(cardIDs),
+		"rescheduled": 0,
+	}
+
+	if !args.Confirm || len(cardIDs) == 0 {
+		if len(cardIDs) > 0 {
+			result["message"] = "Set confirm to true to reschedule these cards"
+		}
+		resultJSON, _ := s.marshalResult(result)
+		return &mcp.CallToolResult{
+			Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+		}, nil
+	}
+
+	rescheduled := 0
+	if args.Strategy == "forget" {
+		for _, chunk := range chunkInts(cardIDs, chunkSize) {
+			if _, err := s.ankiRequest(ctx, "forgetCards", map[string]interface{}{"cards": chunk}); err != nil {
+				return requestError(fmt.Sprintf("Error resetting cards after resetting %d cards", rescheduled), err), nil
+			}
+			rescheduled += len(chunk)
+		}
+	} else {
+		// Group cards by their computed day so each day needs few requests
+		byDay := map[int][]int64{}
+		for i, day := range spreadDays(len(cardIDs), 1, args.Days) {
+			byDay[day] = append(byDay[day], cardIDs[i])
+		}
+		for day := 1; day <= args.Days; day++ {
+			for _, chunk := range chunkInts(byDay[day], chunkSize) {
+				if _, err := s.ankiRequest(ctx, "setDueDate", map[string]interface{}{"cards": chunk, "days": strconv.Itoa(day)}); err != nil {
+					return requestError(fmt.Sprintf("Error setting due date after rescheduling %d cards", rescheduled), err), nil
+				}
+				rescheduled += len(chunk)
+			}
+		}
+		result["days"] = args.Days
+	}
+	result["rescheduled"] = rescheduled
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+const (
+	// maxTagDistance is the largest edit distance at which a tag is
+	// suggested as a correction.
+	maxTagDistance = 2
+	maxSuggestions = 5
+)
+
+// editDistance returns the Levenshtein distance between a and b, counted in
+// runes.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
+
+// similarTags returns the tags within maxTagDistance of tag, ignoring case,
+// closest first.
+func similarTags(tag string, tags []string) []string {
+	type candidate struct {
+		tag      string
+		distance int
+	}
+	var candidates []candidate
+	lower := strings.ToLower(tag)
+	for _, t := range tags {
+		if d := editDistance(lower, strings.ToLower(t)); d <= maxTagDistance {
+			candidates = append(candidates, candidate{t, d})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].distance != candidates[j].distance {
+			return candidates[i].distance < candidates[j].distance
+		}
+		return candidates[i].tag < candidates[j].tag
+	})
+	if len(candidates) > maxSuggestions {
+		candidates = candidates[:maxSuggestions]
+	}
+	suggestions := make([]string, len(candidates))
+	for i, c := range candidates {
+		suggestions[i] = c.tag
+	}
+	return suggestions
+}
+
+func (s *AnkiServer) handleTagExists(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[TagExistsArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if args.Tag == "" {
+		return invalidArgument("tag is required"), nil
+	}
+
+	result, err := s.ankiRequest(ctx, "getTags", nil)
+	if err != nil {
+		return requestError("Error getting tags", err), nil
+	}
+	tagList, _ := result.([]interface{})
+	tags := make([]string, 0, len(tagList))
+	for _, tag := range tagList {
+		if t, ok := tag.(string); ok {
+			tags = append(tags, t)
+		}
+	}
+
+	response := map[string]interface{}{
+		"tag":    args.Tag,
+		"exists": false,
+	}
+	// Anki treats tags that differ only by case as the same tag
+	for _, t := range tags {
+		if strings.EqualFold(t, args.Tag) {
+			response["exists"] = true
+			response["canonical"] = t
+			break
+		}
+	}
+	if response["exists"] == false {
+		response["suggestions"] = similarTags(args.Tag, tags)
+	}
+
+	resultJSON, _ := s.marshalResult(response)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+func (s *AnkiServer) handleDeadTemplates(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[DeadTemplatesArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if args.ModelName == "" {
+		return invalidArgument("model_name is required"), nil
+	}
+
+	templates, err := s.modelTemplates(ctx, args.ModelName)
+	if err != nil {
+		return requestError("Error getting templates", err), nil
+	}
+	names := make([]string, 0, len(templates))
+	for name := range templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	noteIDs, err := s.findIDs(ctx, "findNotes", searchTerm("note", args.ModelName))
+	if err != nil {
+		return requestError("Error finding notes", err), nil
+	}
+
+	queries := make([]string, len(names))
+	for i, name := range names {
+		queries[i] = searchTerm("note", args.ModelName) + " " + searchTerm("card", name)
+	}
+	cardIDs, err := s.findIDsConcurrently(ctx, "findCards", queries)
+	if err != nil {
+		return requestError("Error finding cards", err), nil
+	}
+
+	dead := []string{}
+	counts := make([]map[string]interface{}, len(names))
+	for i, name := range names {
+		counts[i] = map[string]interface{}{"template": name, "cards": len(cardIDs[i])}
+		if len(cardIDs[i]) == 0 {
+			dead = append(dead, name)
+		}
+	}
+
+	result := map[string]interface{}{
+		"model":          args.ModelName,
+		"notes":          len(noteIDs),
+		"templates":      counts,
+		"dead_templates": dead,
+	}
+	if len(noteIDs) == 0 {
+		result["message"] = "The model has no notes, so no template produces cards"
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+func (s *AnkiServer) handleDueDistribution(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[DueDistributionArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if args.Query == "" {
+		return invalidArgument("query is required"), nil
+	}
+	days := args.Days
+	if days == 0 {
+		days = defaultTrendDays
+	}
+	if days < 1 || days > maxTrendDays {
+		return invalidArgument(fmt.Sprintf("days must be between 1 and %d", maxTrendDays)), nil
+	}
+
+	// The last query collects overdue cards, which prop:due=0 leaves out
+	queries := make([]string, days+1)
+	for i := 0; i < days; i++ {
+		queries[i] = fmt.Sprintf("(%s) prop:due=%d", args.Query, i)
+	}
+	queries[days] = fmt.Sprintf("(%s) prop:due<0", args.Query)
+	cardIDs, err := s.findIDsConcurrently(ctx, "findCards", queries)
+	if err != nil {
+		return requestError("Error finding cards", err), nil
+	}
+
+	counts := make([]int, days)
+	total := 0
+	for i := range counts {
+		counts[i] = len(cardIDs[i])
+		total += counts[i]
+	}
+
+	result := map[string]interface{}{
+		"query":   args.Query,
+		"days":    days,
+		"start":   time.Now().Format(dateLayout),
+		"overdue": len(cardIDs[days]),
+		"total":   total,
+		"counts":  counts,
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+func (s *AnkiServer) handleCrossModelDuplicates(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[CrossModelDuplicatesArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if args.Field == "" {
+		return invalidArgument("field is required"), nil
+	}
+
+	// "field:_*" matches notes whose field is non-empty, whatever their model;
+	// searchTerm would escape the wildcards
+	query := strings.TrimSuffix(searchTerm(args.Field, ""), `"`) + `_*"`
+	noteIDs, err := s.findIDs(ctx, "findNotes", query)
+	if err != nil {
+		return requestError("Error finding notes", err), nil
+	}
+	notes, err := s.notesInfo(ctx, noteIDs)
+	if err != nil {
+		return requestError("Error getting notes info", err), nil
+	}
+
+	modelByNote := make(map[int64]string, len(notes))
+	for _, note := range notes {
+		noteID, _ := note["noteId"].(float64)
+		modelByNote[int64(noteID)], _ = note["modelName"].(string)
+	}
+
+	clusters := []map[string]interface{}{}
+	for _, cluster := range duplicateClusters(notes, args.Field) {
+		ids := cluster["note_ids"].([]int64)
+		seen := map[string]bool{}
+		var models []string
+		entries := make([]map[string]interface{}, len(ids))
+		for i, id := range ids {
+			model := modelByNote[id]
+			entries[i] = map[string]interface{}{"note_id": id, "model": model}
+			if !seen[model] {
+				seen[model] = true
+				models = append(models, model)
+			}
+		}
+		if len(models) < 2 {
+			continue
+		}
+		sort.Strings(models)
+		clusters = append(clusters, map[string]interface{}{
+			"value":  cluster["value"],
+			"models": models,
+			"notes":  entries,
+		})
+	}
+
+	result := map[string]interface{}{
+		"field":         args.Field,
+		"notes_checked": len(notes),
+		"clusters":      clusters,
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+func (s *AnkiServer) handleStoreMediaFile(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[StoreMediaArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if err := validateMediaFilename(args.Filename); err != nil {
+		return invalidArgument(err.Error()), nil
+	}
+
+	sources := 0
+	request := map[string]interface{}{"filename": args.Filename}
+	if args.Data != "" {
+		if _, err := base64.StdEncoding.DecodeString(args.Data); err != nil {
+			return invalidArgument("data must be base64-encoded"), nil
+		}
+		request["data"] = args.Data
+		sources++
+	}
+	if args.Path != "" {
+		if !filepath.IsAbs(args.Path) {
+			return invalidArgument("path must be absolute"), nil
+		}
+		request["path"] = args.Path
+		sources++
+	}
+	if args.URL != "" {
+		if u, err := url.Parse(args.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return invalidArgument("url must be an http or https URL"), nil
+		}
+		request["url"] = args.URL
+		sources++
+	}
+	if sources != 1 {
+		return invalidArgument("Provide exactly one of data, path or url"), nil
+	}
+	// AnkiConnect replaces an existing file of the same name unless told not
+	// to, in which case it stores the new file under a fresh name
+	if args.DeleteExisting != nil {
+		request["deleteExisting"] = *args.DeleteExisting
+	}
+
+	storedName, err := s.ankiRequest(ctx, "storeMediaFile", request)
+	if err != nil {
+		return requestError("Error storing media file", err), nil
+	}
+
+	resultJSON, _ := s.marshalResult(map[string]interface{}{
+		"filename":  args.Filename,
+		"stored_as": storedName,
+	})
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+// Rough per-item sizes used when real file sizes are unavailable.
+const (
+	estimatedMediaFileBytes = 50 * 1024
+	estimatedNoteBytes      = 1024
+	estimatedCardBytes      = 512
+)
+
+func (s *AnkiServer) handleBackupSizeEstimate(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[BackupSizeEstimateArgs]) (*mcp.CallToolResult, error) {
+	mediaFiles, err := s.mediaFileNames(ctx, "*")
+	if err != nil {
+		return requestError("Error listing media files", err), nil
+	}
+	noteIDs, err := s.findIDs(ctx, "findNotes", allQuery)
+	if err != nil {
+		return requestError("Error finding notes", err), nil
+	}
+	cardIDs, err := s.findIDs(ctx, "findCards", allQuery)
+	if err != nil {
+		return requestError("Error finding cards", err), nil
+	}
+
+	// The media folder can only be measured when Anki runs on this machine;
+	// otherwise fall back to an average file size
+	mediaBytes := int64(len(mediaFiles)) * estimatedMediaFileBytes
+	mediaMeasured := false
+	if dir, err := s.ankiRequest(ctx, "getMediaDirPath", nil); err == nil {
+		if path, ok := dir.(string); ok {
+			var total int64
+			measured := 0
+			for _, name := range mediaFiles {
+				if info, err := os.Stat(filepath.Join(path, name)); err == nil {
+					total += info.Size()
+					measured++
 				}
 			}
+			if measured == len(mediaFiles) {
+				mediaBytes = total
+				mediaMeasured = true
+			}
+		}
+	}
+	collectionBytes := int64(len(noteIDs))*estimatedNoteBytes + int64(len(cardIDs))*estimatedCardBytes
+
+	result := map[string]interface{}{
+		"media_files":               len(mediaFiles),
+		"media_bytes":               mediaBytes,
+		"media_measured":            mediaMeasured,
+		"notes":                     len(noteIDs),
+		"cards":                     len(cardIDs),
+		"collection_bytes_estimate": collectionBytes,
+		"total_bytes_estimate":      mediaBytes + collectionBytes,
+		"total_megabytes_estimate":  float64(mediaBytes+collectionBytes) / (1024 * 1024),
+		"message":                   "This is an estimate: the collection size is derived from note and card counts, and media sizes are averaged unless the media folder is readable",
+	}
+
+	resultJSON, _ := s.marshalResult(result)
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+func (s *AnkiServer) handleRetrieveMediaFile(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[RetrieveMediaArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if err := validateMediaFilename(args.Filename); err != nil {
+		return invalidArgument(err.Error()), nil
+	}
+
+	result, err := s.ankiRequest(ctx, "retrieveMediaFile", map[string]interface{}{"filename": args.Filename})
+	if err != nil {
+		return requestError("Error retrieving media file", err), nil
+	}
+	// AnkiConnect answers false rather than an error for missing files
+	data, ok := result.(string)
+	if !ok {
+		return toolError(codeNotFound, "media file not found"), nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return toolError(codeUnexpectedResponse, "retrieveMediaFile returned invalid base64"), nil
+	}
+
+	resultJSON, _ := s.marshalResult(map[string]interface{}{
+		"filename": args.Filename,
+		"data":     data,
+		"size":     len(decoded),
+	})
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+func (s *AnkiServer) handleDeleteMediaFile(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[DeleteMediaArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if err := validateMediaFilename(args.Filename); err != nil {
+		return invalidArgument(err.Error()), nil
+	}
+
+	// deleteMediaFile succeeds silently for missing files, so check first.
+	// The name is used as a pattern, so glob characters could match other
+	// files and only an exact match counts.
+	names, err := s.mediaFileNames(ctx, args.Filename)
+	if err != nil {
+		return requestError("Error listing media files", err), nil
+	}
+	found := false
+	for _, name := range names {
+		if name == args.Filename {
+			found = true
+			break
 		}
+	}
+	if !found {
+		return toolError(codeNotFound, "media file not found"), nil
+	}
+
+	if _, err := s.ankiRequest(ctx, "deleteMediaFile", map[string]interface{}{"filename": args.Filename}); err != nil {
+		return requestError("Error deleting media file", err), nil
+	}
+
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: fmt.Sprintf("Deleted media file %s", args.Filename)}},
+	}, nil
+}
+
+func (s *AnkiServer) handleCreateDeck(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[CreateDeckArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	name := strings.TrimSpace(args.Name)
+	if name == "" {
+		return invalidArgument("name is required"), nil
+	}
+	if err := validateDeckPath(name); err != nil {
+		return invalidArgument(err.Error()), nil
+	}
+
+	result, err := s.ankiRequest(ctx, "createDeck", map[string]interface{}{"deck": name})
+	if err != nil {
+		return requestError("Error creating deck", err), nil
+	}
+	id, ok := result.(float64)
+	if !ok {
+		return toolError(codeUnexpectedResponse, "createDeck did not return a deck ID"), nil
+	}
+
+	resultJSON, _ := s.marshalResult(map[string]interface{}{
+		"deck":    name,
+		"deck_id": int64(id),
+	})
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+	}, nil
+}
+
+var (
+	mediaTagPattern   = regexp.MustCompile(`(?i)<img[^>]*>|\[sound:[^\]]+\]`)
+	mediaPlaceholder  = regexp.MustCompile("\x00(\\d+)\x00")
+	htmlBreakPattern  = regexp.MustCompile(`(?i)<br\s*/?>|</(?:div|p|li)>`)
+	htmlItemPattern   = regexp.MustCompile(`(?i)<li[^>]*>`)
+	htmlBoldPattern   = regexp.MustCompile(`(?i)</?(?:b|strong)>`)
+	htmlItalicPattern = regexp.MustCompile(`(?i)</?(?:i|em)>`)
+	htmlCodePattern   = regexp.MustCompile(`(?i)</?code>`)
+	htmlLinkPattern   = regexp.MustCompile(`(?is)<a[^>]*?\shref\s*=\s*"([^"]*)"[^>]*>(.*?)</a>`)
+	blankLinesPattern = regexp.MustCompile(`\n{3,}`)
+	mdCodePattern     = regexp.MustCompile("`([^`]+)`")
+	mdBoldPattern     = regexp.MustCompile(`\*\*(.+?)\*\*`)
+	mdItalicPattern   = regexp.MustCompile(`\*([^*]+)\*`)
+	mdLinkPattern     = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+)
 
-		if len(resultIDs) == 0 {
-			data = []interface{}{}
-		} else {
-			notesData, err := s.ankiRequest(ctx, "notesInfo", map[string]interface{}{"notes": resultIDs})
-			if err != nil {
-				return &mcp.CallToolResult{
-					Content: []mcp.Content{&mcp.TextContent{Text: fmt.Sprintf("Error getting notes info: %v", err)}},
-					IsError: true,
-				}, nil
-			}
-			if notesData == nil {
-				data = []interface{}{}
-			} else {
-				if notesSlice, ok := notesData.([]interface{}); ok {
-					data = notesSlice
-				} else {
-					return &mcp.CallToolResult{
-						Content: []mcp.Content{&mcp.TextContent{Text: "Unexpected response format from notesInfo"}},
-						IsError: true,
-					}, nil
-				}
+// protectMedia swaps <img> tags and [sound:] references for placeholders so
+// the format conversions can't alter them; restoreMedia puts them back.
+func protectMedia(value string) (string, []string) {
+	var media []string
+	value = mediaTagPattern.ReplaceAllStringFunc(value, func(tag string) string {
+		media = append(media, tag)
+		return fmt.Sprintf("\x00%d\x00", len(media)-1)
+	})
+	return value, media
+}
+
+func restoreMedia(value string, media []string) string {
+	return mediaPlaceholder.ReplaceAllStringFunc(value, func(placeholder string) string {
+		index, _ := strconv.Atoi(strings.Trim(placeholder, "\x00"))
+		return media[index]
+	})
+}
+
+// htmlToMarkdown converts the basic formatting Anki's editor produces into
+// Markdown. Media tags are kept verbatim, other tags are dropped.
+func htmlToMarkdown(value string) string {
+	value, media := protectMedia(value)
+	value = htmlLinkPattern.ReplaceAllString(value, "[$2]($1)")
+	value = htmlBreakPattern.ReplaceAllString(value, "\n")
+	value = htmlItemPattern.ReplaceAllString(value, "- ")
+	value = htmlBoldPattern.ReplaceAllString(value, "**")
+	value = htmlItalicPattern.ReplaceAllString(value, "*")
+	value = htmlCodePattern.ReplaceAllString(value, "`")
+	value = htmlTagPattern.ReplaceAllString(value, "")
+	value = strings.ReplaceAll(value, "&nbsp;", " ")
+	value = blankLinesPattern.ReplaceAllString(value, "\n\n")
+	return restoreMedia(strings.TrimSpace(value), media)
+}
+
+// markdownToHTML is the inverse of htmlToMarkdown: "- " lines become a list
+// and other line breaks become <br>.
+func markdownToHTML(value string) string {
+	value, media := protectMedia(strings.TrimSpace(value))
+
+	var out strings.Builder
+	inList := false
+	for i, line := range strings.Split(value, "\n") {
+		if item, ok := strings.CutPrefix(line, "- "); ok {
+			if !inList {
+				out.WriteString("<ul>")
+				inList = true
 			}
+			out.WriteString("<li>" + item + "</li>")
+			continue
+		}
+		if inList {
+			out.WriteString("</ul>")
+			inList = false
+		} else if i > 0 {
+			out.WriteString("<br>")
 		}
+		out.WriteString(line)
+	}
+	if inList {
+		out.WriteString("</ul>")
+	}
+
+	// Code spans are set aside like media so their content stays literal
+	value = mdCodePattern.ReplaceAllStringFunc(out.String(), func(span string) string {
+		media = append(media, "<code>"+strings.Trim(span, "`")+"</code>")
+		return fmt.Sprintf("\x00%d\x00", len(media)-1)
+	})
+	value = mdBoldPattern.ReplaceAllString(value, "<b>$1</b>")
+	value = mdItalicPattern.ReplaceAllString(value, "<i>$1</i>")
+	value = mdLinkPattern.ReplaceAllString(value, `<a href="$2">$1</a>`)
+	return restoreMedia(value, media)
+}
+
+func (s *AnkiServer) handleConvertFieldFormat(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[ConvertFieldFormatArgs]) (*mcp.CallToolResult, error) {
+	args := params.Arguments
+
+	if args.Query == "" || args.Field == "" {
+		return invalidArgument("query and field are required"), nil
+	}
+	var convert func(string) string
+	switch args.Direction {
+	case "html_to_md":
+		convert = htmlToMarkdown
+	case "md_to_html":
+		convert = markdownToHTML
+	default:
+		return invalidArgument("direction must be html_to_md or md_to_html"), nil
 	}
 
-	paginated, err := paginateList(data, args.Cursor, 100)
+	noteIDs, err := s.findIDs(ctx, "findNotes", args.Query)
+	if err != nil {
+		return requestError("Error finding notes", err), nil
+	}
+	notes, err := s.notesInfo(ctx, noteIDs)
 	if err != nil {
+		return requestError("Error getting notes info", err), nil
+	}
+
+	changes := []map[string]interface{}{}
+	for _, note := range notes {
+		value, ok := noteFields(note)[args.Field]
+		if !ok {
+			continue
+		}
+		if converted := convert(value); converted != value {
+			changes = append(changes, map[string]interface{}{
+				"note_id": note["noteId"],
+				"before":  value,
+				"after":   converted,
+			})
+		}
+	}
+
+	result := map[string]interface{}{
+		"query":         args.Query,
+		"field":         args.Field,
+		"direction":     args.Direction,
+		"notes_checked": len(notes),
+		"changes":       changes,
+		"updated":       0,
+	}
+
+	if !args.Confirm {
+		if len(changes) > 0 {
+			result["message"] = "Set confirm to true to write the converted values"
+		}
+		resultJSON, _ := s.marshalResult(result)
 		return &mcp.CallToolResult{
-			Content: []mcp.Content{&mcp.TextContent{Text: fmt.Sprintf("Error paginating results: %v", err)}},
-			IsError: true,
+			Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
 		}, nil
 	}
 
-	result := map[string]interface{}{
-		"search_type": args.SearchType,
-		"query":       args.Query,
-		"total_found": len(resultIDs),
-		"items":       paginated["items"],
-		"nextCursor":  paginated["nextCursor"],
+	updated := 0
+	for _, change := range changes {
+		_, err := s.ankiRequest(ctx, "updateNoteFields", map[string]interface{}{
+			"note": map[string]interface{}{
+				"id":     change["note_id"],
+				"fields": map[string]interface{}{args.Field: change["after"]},
+			},
+		})
+		if err != nil {
+			return requestError(fmt.Sprintf("Error updating note %v after updating %d notes", change["note_id"], updated), err), nil
+		}
+		updated++
 	}
+	result["updated"] = updated
 
-	resultJSON, _ := json.Marshal(result)
+	resultJSON, _ := s.marshalResult(result)
 	return &mcp.CallToolResult{
 		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
 	}, nil
 }
 
-func (s *AnkiServer) handleCreateNotes(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[CreateNotesArgs]) (*mcp.CallToolResult, error) {
+func (s *AnkiServer) handleDeleteDecks(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[DeleteDecksArgs]) (*mcp.CallToolResult, error) {
 	args := params.Arguments
 
-	result, err := s.ankiRequest(ctx, "addNotes", map[string]interface{}{"notes": args.Notes})
-	if err != nil {
-		return &mcp.CallToolResult{
-			Content: []mcp.Content{&mcp.TextContent{Text: fmt.Sprintf("Error creating notes: %v", err)}},
-			IsError: true,
-		}, nil
+	if len(args.Decks) == 0 {
+		return invalidArgument("decks is required"), nil
+	}
+	// Without cardsToo AnkiConnect leaves the cards behind, so default to
+	// removing them with the deck
+	cardsToo := true
+	if args.CardsToo != nil {
+		cardsToo = *args.CardsToo
+	}
+
+	if _, err := s.ankiRequest(ctx, "deleteDecks", map[string]interface{}{"decks": args.Decks, "cardsToo": cardsToo}); err != nil {
+		return requestError("Error deleting decks", err), nil
 	}
 
-	resultJSON, _ := json.Marshal(result)
 	return &mcp.CallToolResult{
-		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
+		Content: []mcp.Content{&mcp.TextContent{Text: fmt.Sprintf("Deleted decks: %s", strings.Join(args.Decks, ", "))}},
 	}, nil
 }
 
-func (s *AnkiServer) handleUpdateNote(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[UpdateNoteArgs]) (*mcp.CallToolResult, error) {
+// defaultLargeNoteBytes is the field content size above which
+// anki_large_notes reports a note by default.
+const defaultLargeNoteBytes = 10000
+
+// noteSize returns the total byte length of a note's field values and the
+// name of its largest field.
+func noteSize(note map[string]interface{}) (int, string) {
+	fields := noteFields(note)
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	total, largest := 0, ""
+	for _, name := range names {
+		size := len(fields[name])
+		total += size
+		if largest == "" || size > len(fields[largest]) {
+			largest = name
+		}
+	}
+	return total, largest
+}
+
+func (s *AnkiServer) handleLargeNotes(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[LargeNotesArgs]) (*mcp.CallToolResult, error) {
 	args := params.Arguments
 
-	_, err := s.ankiRequest(ctx, "updateNote", map[string]interface{}{"note": args.Note})
+	query := args.Query
+	if query == "" {
+		query = allQuery
+	}
+	threshold := args.Threshold
+	if threshold == 0 {
+		threshold = defaultLargeNoteBytes
+	}
+	if threshold < 0 {
+		return invalidArgument("threshold must be positive"), nil
+	}
+
+	noteIDs, err := s.findIDs(ctx, "findNotes", query)
 	if err != nil {
-		return &mcp.CallToolResult{
-			Content: []mcp.Content{&mcp.TextContent{Text: fmt.Sprintf("Error updating note: %v", err)}},
-			IsError: true,
-		}, nil
+		return requestError("Error finding notes", err), nil
+	}
+	notes, err := s.notesInfo(ctx, noteIDs)
+	if err != nil {
+		return requestError("Error getting notes info", err), nil
+	}
+
+	large := []map[string]interface{}{}
+	for _, note := range notes {
+		size, largest := noteSize(note)
+		if size <= threshold {
+			continue
+		}
+		large = append(large, map[string]interface{}{
+			"note_id":       note["noteId"],
+			"model":         note["modelName"],
+			"bytes":         size,
+			"largest_field": largest,
+			"preview":       cardPreview(note),
+		})
+	}
+	sort.SliceStable(large, func(i, j int) bool {
+		return large[i]["bytes"].(int) > large[j]["bytes"].(int)
+	})
+
+	result := map[string]interface{}{
+		"query":         query,
+		"threshold":     threshold,
+		"notes_checked": len(notes),
+		"total":         len(large),
+		"notes":         large,
 	}
 
+	resultJSON, _ := s.marshalResult(result)
 	return &mcp.CallToolResult{
-		Content: []mcp.Content{&mcp.TextContent{Text: "Note updated successfully"}},
+		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
 	}, nil
 }
 
-func (s *AnkiServer) handleManageTags(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[ManageTagsArgs]) (*mcp.CallToolResult, error) {
+func (s *AnkiServer) handleChangeDeck(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[MoveCardsArgs]) (*mcp.CallToolResult, error) {
 	args := params.Arguments
 
-	// Convert note IDs to integers
-	var noteIDs []int
-	for _, id := range args.NoteIDs {
-		switch v := id.(type) {
-		case string:
-			if intID, err := strconv.Atoi(v); err == nil {
-				noteIDs = append(noteIDs, intID)
-			}
-		case float64:
-			noteIDs = append(noteIDs, int(v))
-		case int:
-			noteIDs = append(noteIDs, v)
-		}
+	deck := strings.TrimSpace(args.Deck)
+	if deck == "" {
+		return invalidArgument("deck is required"), nil
 	}
-
-	var err error
-	switch args.Action {
-	case "add":
-		_, err = s.ankiRequest(ctx, "addTags", map[string]interface{}{"notes": noteIDs, "tags": args.Tags})
-	case "delete":
-		_, err = s.ankiRequest(ctx, "removeTags", map[string]interface{}{"notes": noteIDs, "tags": args.Tags})
-	case "replace":
-		_, err = s.ankiRequest(ctx, "replaceTags", map[string]interface{}{
-			"notes":            noteIDs,
-			"tag_to_replace":   args.TagToReplace,
-			"replace_with_tag": args.ReplaceWithTag,
-		})
-	default:
-		return &mcp.CallToolResult{
-			Content: []mcp.Content{&mcp.TextContent{Text: fmt.Sprintf("Invalid action: %s. Must be 'add', 'delete', or 'replace'", args.Action)}},
-			IsError: true,
-		}, nil
+	cardIDs, dropped := coerceIDs(args.CardIDs)
+	if len(dropped) > 0 {
+		return invalidArgument(fmt.Sprintf("Invalid card IDs: %v", dropped)), nil
+	}
+	if len(cardIDs) == 0 {
+		return invalidArgument("card_ids is required"), nil
 	}
 
-	if err != nil {
-		return &mcp.CallToolResult{
-			Content: []mcp.Content{&mcp.TextContent{Text: fmt.Sprintf("Error managing tags: %v", err)}},
-			IsError: true,
-		}, nil
+	for _, chunk := range chunkInts(cardIDs, chunkSize) {
+		if _, err := s.ankiRequest(ctx, "changeDeck", map[string]interface{}{"cards": chunk, "deck": deck}); err != nil {
+			return requestError("Error moving cards", err), nil
+		}
 	}
 
 	return &mcp.CallToolResult{
-		Content: []mcp.Content{&mcp.TextContent{Text: "Tags managed successfully"}},
+		Content: []mcp.Content{&mcp.TextContent{Text: fmt.Sprintf("Moved %d cards to %s", len(cardIDs), deck)}},
 	}, nil
 }
 
-func (s *AnkiServer) handleChangeCardState(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[ChangeCardStateArgs]) (*mcp.CallToolResult, error) {
+// remainingCounts sums the new, learning and review counts of getDeckStats
+// entries.
+func remainingCounts(stats map[string]interface{}) map[string]int {
+	counts := map[string]int{"new": 0, "learning": 0, "review": 0}
+	for _, entry := range stats {
+		deckStats, _ := entry.(map[string]interface{})
+		newCount, _ := deckStats["new_count"].(float64)
+		learnCount, _ := deckStats["learn_count"].(float64)
+		reviewCount, _ := deckStats["review_count"].(float64)
+		counts["new"] += int(newCount)
+		counts["learning"] += int(learnCount)
+		counts["review"] += int(reviewCount)
+	}
+	return counts
+}
+
+func (s *AnkiServer) handleSessionProgress(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[SessionProgressArgs]) (*mcp.CallToolResult, error) {
 	args := params.Arguments
 
-	// Convert card IDs to integers
-	var cardIDs []int
-	for _, id := range args.CardIDs {
-		switch v := id.(type) {
-		case string:
-			if intID, err := strconv.Atoi(v); err == nil {
-				cardIDs = append(cardIDs, intID)
+	deck := args.Deck
+	if deck == "" {
+		currentCard, err := s.ankiRequest(ctx, "guiCurrentCard", nil)
+		if err != nil {
+			return requestError("Error getting current card", err), nil
+		}
+		if current, ok := currentCard.(map[string]interface{}); ok {
+			deck, _ = current["deckName"].(string)
+		}
+	}
+
+	// Without an active deck, the top-level decks cover the whole collection;
+	// their counts already include subdecks
+	decks := []string{deck}
+	if deck == "" {
+		result, err := s.ankiRequest(ctx, "deckNames", nil)
+		if err != nil {
+			return requestError("Error getting decks", err), nil
+		}
+		names, _ := result.([]interface{})
+		decks = nil
+		for _, name := range names {
+			if n, ok := name.(string); ok && !strings.Contains(n, "::") {
+				decks = append(decks, n)
 			}
-		case float64:
-			cardIDs = append(cardIDs, int(v))
-		case int:
-			cardIDs = append(cardIDs, v)
 		}
 	}
 
-	var result interface{}
-	var err error
+	stats, err := s.ankiRequest(ctx, "getDeckStats", map[string]interface{}{"decks": decks})
+	if err != nil {
+		return requestError("Error getting deck stats", err), nil
+	}
+	statsMap, _ := stats.(map[string]interface{})
+	if deck != "" && len(statsMap) == 0 {
+		return toolError(codeNotFound, fmt.Sprintf("Deck %s not found", deck)), nil
+	}
 
-	switch args.Action {
-	case "suspend":
-		result, err = s.ankiRequest(ctx, "suspend", map[string]interface{}{"cards": cardIDs})
-	case "unsuspend":
-		result, err = s.ankiRequest(ctx, "unsuspend", map[string]interface{}{"cards": cardIDs})
-	case "forget":
-		_, err = s.ankiRequest(ctx, "forgetCards", map[string]interface{}{"cards": cardIDs})
-		result = true
-	case "relearn":
-		_, err = s.ankiRequest(ctx, "relearnCards", map[string]interface{}{"cards": cardIDs})
-		result = true
-	case "set_due":
-		if args.Days == "" {
-			return &mcp.CallToolResult{
-				Content: []mcp.Content{&mcp.TextContent{Text: "days parameter required for set_due action"}},
-				IsError: true,
-			}, nil
+	// getNumCardsReviewedToday counts the whole collection, so a deck's
+	// progress counts the cards rated in it today instead
+	var done float64
+	if deck != "" {
+		ratedIDs, err := s.findIDs(ctx, "findCards", searchTerm("deck", deck)+" rated:1")
+		if err != nil {
+			return requestError("Error finding cards reviewed today", err), nil
 		}
-		result, err = s.ankiRequest(ctx, "setDueDate", map[string]interface{}{"cards": cardIDs, "days": args.Days})
-	case "set_ease":
-		if len(args.EaseFactors) != len(cardIDs) {
-			return &mcp.CallToolResult{
-				Content: []mcp.Content{&mcp.TextContent{Text: "ease_factors must match card_ids length for set_ease action"}},
-				IsError: true,
-			}, nil
+		done = float64(len(ratedIDs))
+	} else {
+		reviewedToday, err := s.ankiRequest(ctx, "getNumCardsReviewedToday", nil)
+		if err != nil {
+			return requestError("Error getting today's review count", err), nil
 		}
-		result, err = s.ankiRequest(ctx, "setEaseFactors", map[string]interface{}{"cards": cardIDs, "easeFactors": args.EaseFactors})
-	default:
-		return &mcp.CallToolResult{
-			Content: []mcp.Content{&mcp.TextContent{Text: fmt.Sprintf("Invalid action: %s", args.Action)}},
-			IsError: true,
-		}, nil
+		done, _ = reviewedToday.(float64)
 	}
 
-	if err != nil {
-		return &mcp.CallToolResult{
-			Content: []mcp.Content{&mcp.TextContent{Text: fmt.Sprintf("Error changing card state: %v", err)}},
-			IsError: true,
-		}, nil
+	remaining := remainingCounts(statsMap)
+	total := remaining["new"] + remaining["learning"] + remaining["review"]
+	result := map[string]interface{}{
+		"deck":      nil,
+		"done":      int(done),
+		"remaining": total,
+		"by_queue":  remaining,
+		"percent":   100.0,
+	}
+	if deck != "" {
+		result["deck"] = deck
+	}
+	if total > 0 {
+		result["percent"] = 100 * done / (done + float64(total))
 	}
 
-	resultJSON, _ := json.Marshal(result)
+	resultJSON, _ := s.marshalResult(result)
 	return &mcp.CallToolResult{
 		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
 	}, nil
 }
 
-func (s *AnkiServer) handleGUIControl(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[GUIControlArgs]) (*mcp.CallToolResult, error) {
+// learningStep returns the zero-based index of the step a learning card is
+// on. Anki stores the steps remaining until graduation in the last three
+// digits of left; the thousands count how many of them fit in today.
+func learningStep(left float64, steps int) int {
+	step := steps - int(left)%1000
+	if step < 0 {
+		return 0
+	}
+	return step
+}
+
+func (s *AnkiServer) handleCardsInStep(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[CardsInStepArgs]) (*mcp.CallToolResult, error) {
 	args := params.Arguments
 
-	var result interface{}
-	var err error
+	if args.Deck == "" {
+		return invalidArgument("deck is required"), nil
+	}
+	if args.Step < 0 {
+		return invalidArgument("step must not be negative"), nil
+	}
 
-	switch args.Action {
-	case "current_card":
-		result, err = s.ankiRequest(ctx, "guiCurrentCard", nil)
-	case "show_answer":
-		result, err = s.ankiRequest(ctx, "guiShowAnswer", nil)
-	case "answer":
-		if args.Ease == nil {
-			return &mcp.CallToolResult{
-				Content: []mcp.Content{&mcp.TextContent{Text: "ease parameter required for answer action"}},
-				IsError: true,
-			}, nil
+	cardIDs, err := s.findIDs(ctx, "findCards", searchTerm("deck", args.Deck)+" is:learn")
+	if err != nil {
+		return requestError("Error finding cards", err), nil
+	}
+	cards, err := s.cardsInfo(ctx, cardIDs)
+	if err != nil {
+		return requestError("Error getting cards info", err), nil
+	}
+
+	// Subdecks can use a different options group, so steps are looked up
+	// per deck; relearning cards follow the lapse steps
+	configs := make(map[string]map[string]interface{})
+	now := time.Now()
+	entries := []map[string]interface{}{}
+	for _, card := range cards {
+		deck, _ := card["deckName"].(string)
+		config, ok := configs[deck]
+		if !ok {
+			config, err = s.deckConfig(ctx, deck)
+			if err != nil {
+				return requestError("Error getting deck config", err), nil
+			}
+			configs[deck] = config
 		}
-		if *args.Ease < 1 || *args.Ease > 4 {
-			return &mcp.CallToolResult{
-				Content: []mcp.Content{&mcp.TextContent{Text: "ease must be 1 (Again), 2 (Hard), 3 (Good), or 4 (Easy)"}},
-				IsError: true,
-			}, nil
+		group := "new"
+		if card["type"] == float64(3) {
+			group = "lapse"
 		}
-		// Ensure the card is on the answer side
-		_, err = s.ankiRequest(ctx, "guiShowAnswer", nil)
-		if err != nil {
-			return &mcp.CallToolResult{
-				Content: []mcp.Content{&mcp.TextContent{Text: fmt.Sprintf("Error showing answer: %v", err)}},
-				IsError: true,
-			}, nil
+		settings, _ := config[group].(map[string]interface{})
+		delays, _ := settings["delays"].([]interface{})
+
+		left, _ := card["left"].(float64)
+		if learningStep(left, len(delays)) != args.Step {
+			continue
 		}
-		result, err = s.ankiRequest(ctx, "guiAnswerCard", map[string]interface{}{"ease": *args.Ease})
-	case "undo":
-		result, err = s.ankiRequest(ctx, "guiUndo", nil)
-	default:
-		return &mcp.CallToolResult{
-			Content: []mcp.Content{&mcp.TextContent{Text: fmt.Sprintf("Invalid action: %s. Available actions are: current_card, show_answer, answer, undo", args.Action)}},
-			IsError: true,
-		}, nil
+
+		queue, _ := card["queue"].(float64)
+		due, _ := card["due"].(float64)
+		entry := map[string]interface{}{
+			"card_id":    card["cardId"],
+			"deck":       deck,
+			"front":      cardPreview(card),
+			"steps":      formatSteps(delays),
+			"relearning": group == "lapse",
+		}
+		if queue == 1 {
+			dueAt := time.Unix(int64(due), 0)
+			entry["due"] = dueAt.Format(time.RFC3339)
+			entry["minutes_until_due"] = math.Max(0, math.Ceil(dueAt.Sub(now).Minutes()))
+		} else {
+			// Interday steps are due on a day number, see handleLearningQueue
+			entry["due"] = nil
+			entry["interday"] = true
+		}
+		entries = append(entries, entry)
 	}
 
-	if err != nil {
-		return &mcp.CallToolResult{
-			Content: []mcp.Content{&mcp.TextContent{Text: fmt.Sprintf("Error in GUI control: %v", err)}},
-			IsError: true,
-		}, nil
+	sort.Slice(entries, func(i, j int) bool {
+		mi, iok := entries[i]["minutes_until_due"].(float64)
+		mj, jok := entries[j]["minutes_until_due"].(float64)
+		if iok != jok {
+			return iok
+		}
+		return mi < mj
+	})
+
+	result := map[string]interface{}{
+		"deck":  args.Deck,
+		"step":  args.Step,
+		"total": len(entries),
+		"cards": entries,
 	}
 
-	resultJSON, _ := json.Marshal(result)
+	resultJSON, _ := s.marshalResult(result)
 	return &mcp.CallToolResult{
 		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
 	}, nil
 }
 
-func (s *AnkiServer) handleDeleteNotes(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[DeleteNotesArgs]) (*mcp.CallToolResult, error) {
-	args := params.Arguments
-
-	// Convert note IDs to integers
-	var noteIDs []int
-	for _, id := range args.NoteIDs {
-		switch v := id.(type) {
-		case string:
-			if intID, err := strconv.Atoi(v); err == nil {
-				noteIDs = append(noteIDs, intID)
+// tagSummary returns the sorted union and intersection of the tags on notes
+// along with how many notes carry each tag.
+func tagSummary(notes []map[string]interface{}) (union, intersection []string, counts map[string]int) {
+	counts = make(map[string]int)
+	for _, note := range notes {
+		tags, _ := note["tags"].([]interface{})
+		seen := make(map[string]bool, len(tags))
+		for _, tag := range tags {
+			name, _ := tag.(string)
+			if name == "" || seen[name] {
+				continue
 			}
-		case float64:
-			noteIDs = append(noteIDs, int(v))
-		case int:
-			noteIDs = append(noteIDs, v)
+			seen[name] = true
+			counts[name]++
 		}
 	}
 
-	_, err := s.ankiRequest(ctx, "deleteNotes", map[string]interface{}{"notes": noteIDs})
-	if err != nil {
-		return &mcp.CallToolResult{
-			Content: []mcp.Content{&mcp.TextContent{Text: fmt.Sprintf("Error deleting notes: %v", err)}},
-			IsError: true,
-		}, nil
+	union = []string{}
+	intersection = []string{}
+	for tag, count := range counts {
+		union = append(union, tag)
+		if count == len(notes) {
+			intersection = append(intersection, tag)
+		}
 	}
-
-	return &mcp.CallToolResult{
-		Content: []mcp.Content{&mcp.TextContent{Text: "Notes deleted successfully"}},
-	}, nil
+	sort.Strings(union)
+	sort.Strings(intersection)
+	return union, intersection, counts
 }
 
-func (s *AnkiServer) handleUpdateDeckConfig(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[UpdateDeckConfigArgs]) (*mcp.CallToolResult, error) {
+func (s *AnkiServer) handleNotesTags(ctx context.Context, ss *mcp.ServerSession, params *mcp.CallToolParamsFor[NotesTagsArgs]) (*mcp.CallToolResult, error) {
 	args := params.Arguments
 
-	result, err := s.ankiRequest(ctx, "saveDeckConfig", map[string]interface{}{"config": args.Config})
+	noteIDs, dropped := coerceIDs(args.NoteIDs)
+	if len(dropped) > 0 {
+		return invalidArgument(fmt.Sprintf("Invalid note IDs: %v", dropped)), nil
+	}
+	if len(noteIDs) == 0 {
+		return invalidArgument("note_ids is required"), nil
+	}
+
+	notes, err := s.notesInfo(ctx, noteIDs)
 	if err != nil {
-		return &mcp.CallToolResult{
-			Content: []mcp.Content{&mcp.TextContent{Text: fmt.Sprintf("Error updating deck config: %v", err)}},
-			IsError: true,
-		}, nil
+		return requestError("Error getting notes info", err), nil
+	}
+
+	// notesInfo returns an empty object for IDs that don't exist
+	var found []map[string]interface{}
+	for _, note := range notes {
+		if _, ok := note["noteId"]; ok {
+			found = append(found, note)
+		}
+	}
+	if len(found) == 0 {
+		return toolError(codeNotFound, "none of the notes were found"), nil
+	}
+
+	union, intersection, counts := tagSummary(found)
+	result := map[string]interface{}{
+		"notes":        len(found),
+		"missing":      len(noteIDs) - len(found),
+		"union":        union,
+		"intersection": intersection,
+		"counts":       counts,
 	}
 
-	resultJSON, _ := json.Marshal(result)
+	resultJSON, _ := s.marshalResult(result)
 	return &mcp.CallToolResult{
 		Content: []mcp.Content{&mcp.TextContent{Text: string(resultJSON)}},
 	}, nil
@@ -617,7 +7895,7 @@ func (s *AnkiServer) handleAllDecks(ctx context.Context, ss *mcp.ServerSession,
 		})
 	}
 
-	data, _ := json.Marshal(deckList)
+	data, _ := s.marshalResult(deckList)
 	return &mcp.ReadResourceResult{
 		Contents: []*mcp.ResourceContents{
 			{URI: params.URI, MIMEType: "application/json", Text: string(data)},
@@ -625,31 +7903,61 @@ func (s *AnkiServer) handleAllDecks(ctx context.Context, ss *mcp.ServerSession,
 	}, nil
 }
 
+// deckNameByID returns the name of the deck with the given ID.
+func (s *AnkiServer) deckNameByID(ctx context.Context, id int64) (string, error) {
+	result, err := s.ankiRequest(ctx, "deckNamesAndIds", nil)
+	if err != nil {
+		return "", err
+	}
+	decks, ok := result.(map[string]interface{})
+	if !ok {
+		return "", fmt.Errorf("%w from deckNamesAndIds", errUnexpectedResponse)
+	}
+	for name, deckID := range decks {
+		if f, _ := deckID.(float64); int64(f) == id {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("deck with ID %d %w", id, errNotFound)
+}
+
 func (s *AnkiServer) handleDeckConfig(ctx context.Context, ss *mcp.ServerSession, params *mcp.ReadResourceParams) (*mcp.ReadResourceResult, error) {
 	// Extract deck_id from URI
 	uri := params.URI
 	deckID := strings.TrimPrefix(uri, "anki://decks/")
 	deckID = strings.TrimSuffix(deckID, "/config")
 
-	var config interface{}
-	var err error
-
-	// Try as ID first if it looks numeric, otherwise try as name
-	if _, err := strconv.Atoi(deckID); err == nil {
-		config, err = s.ankiRequest(ctx, "getDeckConfig", map[string]interface{}{"deck": deckID})
-	} else {
-		config, err = s.ankiRequest(ctx, "getDeckConfig", map[string]interface{}{"deck": deckID})
+	// getDeckConfig only accepts names, so numeric segments are resolved
+	// through deckNamesAndIds first; one that isn't an ID may still be the
+	// name of a deck such as "2024"
+	deck := deckID
+	var idErr error
+	if id, parseErr := strconv.ParseInt(deckID, 10, 64); parseErr == nil {
+		name, err := s.deckNameByID(ctx, id)
+		switch {
+		case err == nil:
+			deck = name
+		case errors.Is(err, errNotFound):
+			idErr = err
+		default:
+			return nil, err
+		}
 	}
 
+	config, err := s.ankiRequest(ctx, "getDeckConfig", map[string]interface{}{"deck": deck})
 	if err != nil {
 		return nil, err
 	}
+	// Neither a deck ID nor a deck name
+	if _, ok := config.(map[string]interface{}); !ok && idErr != nil {
+		return nil, idErr
+	}
 
 	if config == nil {
 		config = map[string]interface{}{}
 	}
 
-	data, _ := json.Marshal(config)
+	data, _ := s.marshalResult(config)
 	return &mcp.ReadResourceResult{
 		Contents: []*mcp.ResourceContents{
 			{URI: params.URI, MIMEType: "application/json", Text: string(data)},
@@ -672,7 +7980,7 @@ func (s *AnkiServer) handleDeckStats(ctx context.Context, ss *mcp.ServerSession,
 		stats = map[string]interface{}{}
 	}
 
-	data, _ := json.Marshal(stats)
+	data, _ := s.marshalResult(stats)
 	return &mcp.ReadResourceResult{
 		Contents: []*mcp.ResourceContents{
 			{URI: params.URI, MIMEType: "application/json", Text: string(data)},
@@ -709,7 +8017,7 @@ func (s *AnkiServer) handleAllModels(ctx context.Context, ss *mcp.ServerSession,
 		models = []interface{}{}
 	}
 
-	data, _ := json.Marshal(models)
+	data, _ := s.marshalResult(models)
 	return &mcp.ReadResourceResult{
 		Contents: []*mcp.ResourceContents{
 			{URI: params.URI, MIMEType: "application/json", Text: string(data)},
@@ -731,6 +8039,8 @@ func (s *AnkiServer) handleModelInfo(ctx context.Context, ss *mcp.ServerSession,
 		fieldsOnTemplates = map[string]interface{}{}
 	}
 
+	// Keyed by template name with plain lists below, so there are no keys
+	// for marshalResult to normalize
 	data, _ := json.Marshal(fieldsOnTemplates)
 	return &mcp.ReadResourceResult{
 		Contents: []*mcp.ResourceContents{
@@ -750,9 +8060,9 @@ func (s *AnkiServer) handleCardsInfo(ctx context.Context, ss *mcp.ServerSession,
 		return nil, fmt.Errorf("no card IDs provided")
 	}
 
-	var cardIDs []int
+	var cardIDs []int64
 	for _, idStr := range cardIDList {
-		if id, err := strconv.Atoi(idStr); err == nil {
+		if id, err := strconv.ParseInt(idStr, 10, 64); err == nil {
 			cardIDs = append(cardIDs, id)
 		}
 	}
@@ -781,7 +8091,7 @@ func (s *AnkiServer) handleCardsInfo(ctx context.Context, ss *mcp.ServerSession,
 		result = cardsData
 	}
 
-	data, _ := json.Marshal(result)
+	data, _ := s.marshalResult(result)
 	return &mcp.ReadResourceResult{
 		Contents: []*mcp.ResourceContents{
 			{URI: params.URI, MIMEType: "application/json", Text: string(data)},
@@ -800,9 +8110,9 @@ func (s *AnkiServer) handleNotesInfo(ctx context.Context, ss *mcp.ServerSession,
 		return nil, fmt.Errorf("no note IDs provided")
 	}
 
-	var noteIDs []int
+	var noteIDs []int64
 	for _, idStr := range noteIDList {
-		if id, err := strconv.Atoi(idStr); err == nil {
+		if id, err := strconv.ParseInt(idStr, 10, 64); err == nil {
 			noteIDs = append(noteIDs, id)
 		}
 	}
@@ -831,7 +8141,7 @@ func (s *AnkiServer) handleNotesInfo(ctx context.Context, ss *mcp.ServerSession,
 		result = notesData
 	}
 
-	data, _ := json.Marshal(result)
+	data, _ := s.marshalResult(result)
 	return &mcp.ReadResourceResult{
 		Contents: []*mcp.ResourceContents{
 			{URI: params.URI, MIMEType: "application/json", Text: string(data)},
@@ -850,9 +8160,9 @@ func (s *AnkiServer) handleCardsReviews(ctx context.Context, ss *mcp.ServerSessi
 		return nil, fmt.Errorf("no card IDs provided")
 	}
 
-	var cardIDs []int
+	var cardIDs []int64
 	for _, idStr := range cardIDList {
-		if id, err := strconv.Atoi(idStr); err == nil {
+		if id, err := strconv.ParseInt(idStr, 10, 64); err == nil {
 			cardIDs = append(cardIDs, id)
 		}
 	}
@@ -866,7 +8176,115 @@ func (s *AnkiServer) handleCardsReviews(ctx context.Context, ss *mcp.ServerSessi
 		reviews = []interface{}{}
 	}
 
-	data, _ := json.Marshal(reviews)
+	data, _ := s.marshalResult(reviews)
+	return &mcp.ReadResourceResult{
+		Contents: []*mcp.ResourceContents{
+			{URI: params.URI, MIMEType: "application/json", Text: string(data)},
+		},
+	}, nil
+}
+
+// cardContext assembles a card together with its note and deck.
+func (s *AnkiServer) cardContext(ctx context.Context, cardID int64) (map[string]interface{}, error) {
+	cards, err := s.ankiRequest(ctx, "cardsInfo", map[string]interface{}{"cards": []int64{cardID}})
+	if err != nil {
+		return nil, err
+	}
+	cardsData, ok := cards.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w from cardsInfo", errUnexpectedResponse)
+	}
+	if len(cardsData) == 0 {
+		return nil, fmt.Errorf("card %d %w", cardID, errNotFound)
+	}
+	card, ok := cardsData[0].(map[string]interface{})
+	if !ok || len(card) == 0 {
+		return nil, fmt.Errorf("card %d %w", cardID, errNotFound)
+	}
+
+	noteID, ok := card["note"].(float64)
+	if !ok {
+		return nil, fmt.Errorf("card %d has no note", cardID)
+	}
+	notes, err := s.ankiRequest(ctx, "notesInfo", map[string]interface{}{"notes": []int64{int64(noteID)}})
+	if err != nil {
+		return nil, err
+	}
+	notesData, ok := notes.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w from notesInfo", errUnexpectedResponse)
+	}
+	if len(notesData) == 0 {
+		return nil, fmt.Errorf("note %d %w", int64(noteID), errNotFound)
+	}
+
+	deckName, _ := card["deckName"].(string)
+	decks, err := s.ankiRequest(ctx, "deckNamesAndIds", nil)
+	if err != nil {
+		return nil, err
+	}
+	deckMap, ok := decks.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w from deckNamesAndIds", errUnexpectedResponse)
+	}
+
+	return map[string]interface{}{
+		"card": card,
+		"note": notesData[0],
+		"deck": map[string]interface{}{
+			"name": deckName,
+			"id":   deckMap[deckName],
+		},
+	}, nil
+}
+
+func (s *AnkiServer) handleCardContext(ctx context.Context, ss *mcp.ServerSession, params *mcp.ReadResourceParams) (*mcp.ReadResourceResult, error) {
+	// Extract card_id from URI
+	uri := params.URI
+	cardIDStr := strings.TrimPrefix(uri, "anki://cards/")
+	cardIDStr = strings.TrimSuffix(cardIDStr, "/context")
+
+	cardIDList := parseIDsFromPath(cardIDStr)
+	if len(cardIDList) != 1 {
+		return nil, fmt.Errorf("exactly one card ID must be provided")
+	}
+	cardID, err := strconv.ParseInt(cardIDList[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid card ID: %s", cardIDList[0])
+	}
+
+	result, err := s.cardContext(ctx, cardID)
+	if err != nil {
+		return nil, err
+	}
+
+	data, _ := s.marshalResult(result)
+	return &mcp.ReadResourceResult{
+		Contents: []*mcp.ResourceContents{
+			{URI: params.URI, MIMEType: "application/json", Text: string(data)},
+		},
+	}, nil
+}
+
+// handleMediaFiles serves both anki://media and anki://media/{pattern}. The
+// pattern segment is URL-escaped and defaults to "*".
+func (s *AnkiServer) handleMediaFiles(ctx context.Context, ss *mcp.ServerSession, params *mcp.ReadResourceParams) (*mcp.ReadResourceResult, error) {
+	segment := strings.TrimPrefix(strings.TrimPrefix(params.URI, "anki://media"), "/")
+	pattern, err := url.PathUnescape(segment)
+	if err != nil {
+		return nil, fmt.Errorf("invalid media pattern %q: %v", segment, err)
+	}
+	if pattern == "" {
+		pattern = "*"
+	}
+
+	names, err := s.mediaFileNames(ctx, pattern)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	data, _ := s.marshalResult(names)
 	return &mcp.ReadResourceResult{
 		Contents: []*mcp.ResourceContents{
 			{URI: params.URI, MIMEType: "application/json", Text: string(data)},
@@ -884,7 +8302,7 @@ func (s *AnkiServer) handleAllTags(ctx context.Context, ss *mcp.ServerSession, p
 		tags = []interface{}{}
 	}
 
-	data, _ := json.Marshal(tags)
+	data, _ := s.marshalResult(tags)
 	return &mcp.ReadResourceResult{
 		Contents: []*mcp.ResourceContents{
 			{URI: params.URI, MIMEType: "application/json", Text: string(data)},
@@ -903,7 +8321,7 @@ func (s *AnkiServer) handleCurrentSession(ctx context.Context, ss *mcp.ServerSes
 		"timestamp":    time.Now().Unix(),
 	}
 
-	data, _ := json.Marshal(result)
+	data, _ := s.marshalResult(result)
 	return &mcp.ReadResourceResult{
 		Contents: []*mcp.ResourceContents{
 			{URI: params.URI, MIMEType: "application/json", Text: string(data)},
@@ -926,7 +8344,7 @@ func (s *AnkiServer) handleCollectionStats(ctx context.Context, ss *mcp.ServerSe
 		"generated_at": time.Now().Unix(),
 	}
 
-	data, _ := json.Marshal(result)
+	data, _ := s.marshalResult(result)
 	return &mcp.ReadResourceResult{
 		Contents: []*mcp.ResourceContents{
 			{URI: params.URI, MIMEType: "application/json", Text: string(data)},
@@ -949,7 +8367,7 @@ func (s *AnkiServer) handleDailyStats(ctx context.Context, ss *mcp.ServerSession
 		"date":  time.Now().Format("2006-01-02"),
 	}
 
-	data, _ := json.Marshal(result)
+	data, _ := s.marshalResult(result)
 	return &mcp.ReadResourceResult{
 		Contents: []*mcp.ResourceContents{
 			{URI: params.URI, MIMEType: "application/json", Text: string(data)},
@@ -961,6 +8379,19 @@ func main() {
 	flag.Parse()
 
 	ankiServer := NewAnkiServer(*ankiConnectURL)
+	ankiServer.defaultDeck = *defaultDeck
+	ankiServer.defaultModel = *defaultModel
+	if *maxRetries < 0 {
+		log.Fatalf("invalid -max-retries value %d: must not be negative", *maxRetries)
+	}
+	ankiServer.maxRetries = *maxRetries
+
+	switch *keyCase {
+	case "", "snake", "camel":
+		ankiServer.keyCase = *keyCase
+	default:
+		log.Fatalf("invalid -normalize-keys value %q: must be 'snake' or 'camel'", *keyCase)
+	}
 
 	// Create MCP server
 	server := mcp.NewServer(&mcp.Implementation{
@@ -973,7 +8404,7 @@ func main() {
 	// Add tools
 	mcp.AddTool(server, &mcp.Tool{
 		Name:        "anki_search",
-		Description: "Search cards or notes using Anki's search syntax with pagination",
+		Description: "Search cards or notes using Anki's search syntax with pagination (page_size 1-500, default 100)",
 	}, ankiServer.handleSearch)
 
 	mcp.AddTool(server, &mcp.Tool{
@@ -1011,6 +8442,465 @@ func main() {
 		Description: "Update deck configuration",
 	}, ankiServer.handleUpdateDeckConfig)
 
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_empty_decks",
+		Description: "List decks that contain no cards, optionally deleting them (requires confirm)",
+	}, ankiServer.handleEmptyDecks)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_scheduler",
+		Description: "Get the active scheduler version (v1/v2/v3), or switch it with set",
+	}, ankiServer.handleScheduler)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_find_notes_by_values",
+		Description: "Look up notes of a model by a field's values, returning note IDs per value",
+	}, ankiServer.handleFindNotesByValues)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_find_broken_media",
+		Description: "Find notes whose fields reference media files missing from the collection",
+	}, ankiServer.handleFindBrokenMedia)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_find_orphan_media",
+		Description: "List media files not referenced by any note or note model template, optionally deleting them (requires confirm)",
+	}, ankiServer.handleFindOrphanMedia)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_store_media_from_urls",
+		Description: "Download and store media files from URLs, reporting success per file",
+	}, ankiServer.handleStoreMediaFromURLs)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_workload_forecast",
+		Description: "Forecast how many cards fall due on each of the next N days",
+	}, ankiServer.handleWorkloadForecast)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_add_reverse",
+		Description: "Convert Basic notes matching a query to Basic (and reversed card); previews unless confirm is set",
+	}, ankiServer.handleAddReverse)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_backup",
+		Description: "Back up the collection as timestamped .apkg files, one per top-level deck, into a directory that exists on the machine running Anki",
+	}, ankiServer.handleBackup)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_due_today",
+		Description: "Count cards due today grouped by deck, optionally limited to a deck and its subdecks",
+	}, ankiServer.handleDueToday)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_session_pace",
+		Description: "Report today's study pace: average seconds per card and cards per minute",
+	}, ankiServer.handleSessionPace)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_handle_leeches",
+		Description: "Suspend, reset, or reschedule cards tagged as leeches",
+	}, ankiServer.handleHandleLeeches)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_model_summary",
+		Description: "Summarize every note type with its field, template, and note counts",
+	}, ankiServer.handleModelSummary)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_find_field_issues",
+		Description: "Find notes whose fields are missing, unexpected, or have an empty first field relative to their model",
+	}, ankiServer.handleFindFieldIssues)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_set_field_style",
+		Description: "Set the editor font and/or font size of a model field",
+	}, ankiServer.handleSetFieldStyle)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_export_deck_config",
+		Description: "Export the full options group JSON used by a deck",
+	}, ankiServer.handleExportDeckConfig)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_import_deck_config",
+		Description: "Create a new options group from exported JSON, optionally assigning it to decks",
+	}, ankiServer.handleImportDeckConfig)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_reviews_in_range",
+		Description: "Count reviews between two dates (YYYY-MM-DD, inclusive) with a per-day breakdown",
+	}, ankiServer.handleReviewsInRange)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_audit_formatting",
+		Description: "Report formatting issues (div wrappers, &nbsp;, stray whitespace, mixed bold tags) in notes, optionally fixing them",
+	}, ankiServer.handleAuditFormatting)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_spread_due",
+		Description: "Spread cards' due dates evenly across a range of days to avoid a single-day pileup",
+	}, ankiServer.handleSpreadDue)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_current_card_detail",
+		Description: "Get the card currently under review with its full note, deck, and tags",
+	}, ankiServer.handleCurrentCardDetail)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_modified_notes",
+		Description: "List notes edited in the last N days, most recently modified first",
+	}, ankiServer.handleModifiedNotes)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_pause_new",
+		Description: "Stop new cards in a deck by suspending them",
+	}, ankiServer.handlePauseNew)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_resume_new",
+		Description: "Resume new cards in a deck by unsuspending all suspended new cards",
+	}, ankiServer.handleResumeNew)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_deck_health",
+		Description: "Report a deck's new/young/mature card counts, lapse rate, and average ease",
+	}, ankiServer.handleDeckHealth)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_clone_deck",
+		Description: "Create a deck using another deck's options group, optionally copying its notes",
+	}, ankiServer.handleCloneDeck)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_changes_since",
+		Description: "Get notes and cards modified at or after a Unix timestamp, with a new high-water mark for incremental sync; items at the mark can repeat, so dedupe by ID",
+	}, ankiServer.handleChangesSince)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_get_preference",
+		Description: "Get a single preference value by dotted key, e.g. newSpread",
+	}, ankiServer.handleGetPreference)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_autoreview",
+		Description: "Answer up to count cards in the GUI review queue with the given ease (default 3, Good)",
+	}, ankiServer.handleAutoreview)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_streak",
+		Description: "Get the current and longest streaks of consecutive study days",
+	}, ankiServer.handleStreak)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_split_by_tag",
+		Description: "Split a deck into Deck::tag subdecks by note tag; previews unless confirm is set",
+	}, ankiServer.handleSplitByTag)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_flagged_cards",
+		Description: "List flagged cards grouped by flag color, with a short front preview, optionally limited to a deck",
+	}, ankiServer.handleFlaggedCards)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_normalize_tags",
+		Description: "Find and repair malformed tags (stray whitespace or colons, case variants) on notes matching a query; previews unless confirm is set",
+	}, ankiServer.handleNormalizeTags)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_grade_card",
+		Description: "Grade a specific due card by ID with ease 1-4 without using the GUI, returning its new scheduling",
+	}, ankiServer.handleGradeCard)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_note_creation_histogram",
+		Description: "Count notes by the month they were created, optionally limited to a deck",
+	}, ankiServer.handleNoteCreationHistogram)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_backlog_estimate",
+		Description: "Estimate how long it will take to clear a deck's overdue reviews, from recent review times and the daily review limit",
+	}, ankiServer.handleBacklogEstimate)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_create_deck_tree",
+		Description: "Create several decks from full paths such as Lang::JP::Vocab, including any missing parents",
+	}, ankiServer.handleCreateDeckTree)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_hardest_cards",
+		Description: "Rank cards matching a query by how often they were answered Again, returning the top cards with their fronts",
+	}, ankiServer.handleHardestCards)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_tag_retention",
+		Description: "Compute the mature review retention percentage for cards with a tag",
+	}, ankiServer.handleTagRetention)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_render_template",
+		Description: "Render a model's card templates with sample field values to preview the front and back HTML",
+	}, ankiServer.handleRenderTemplate)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_consolidate_models",
+		Description: "Convert all notes of one model to another, mapping fields by name and reporting fields that would be lost; previews unless confirm is set",
+	}, ankiServer.handleConsolidateModels)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_find_identical_sides",
+		Description: "Find notes matching a query whose first two fields have the same text once HTML is removed",
+	}, ankiServer.handleFindIdenticalSides)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_button_trend",
+		Description: "Break down reviews per day by the button pressed (again, hard, good, easy) over the last N days",
+	}, ankiServer.handleButtonTrend)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_explain_deck_config",
+		Description: "Summarize a deck's options group in plain language: daily limits, learning steps, intervals and ease",
+	}, ankiServer.handleExplainDeckConfig)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_set_due_date",
+		Description: "Schedule cards for a calendar date (YYYY-MM-DD) today or later",
+	}, ankiServer.handleSetDueDate)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_tag_deck",
+		Description: "Add a tag to every note in a deck, including its subdecks unless include_subdecks is false",
+	}, ankiServer.handleTagDeck)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_unused_models",
+		Description: "List note types that have no notes; deletes them if delete is set and AnkiConnect supports it",
+	}, ankiServer.handleUnusedModels)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_compare_decks",
+		Description: "Compare two decks side by side: due counts, maturity, lapse rate, average ease and mature retention",
+	}, ankiServer.handleCompareDecks)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_rebuild_filtered",
+		Description: "Rebuild a filtered deck, pulling in the cards that currently match its search",
+	}, ankiServer.handleRebuildFiltered)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_empty_filtered",
+		Description: "Empty a filtered deck, returning its cards to their home decks",
+	}, ankiServer.handleEmptyFiltered)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_suspended_due",
+		Description: "List suspended cards that would otherwise be due, with their decks and fronts; unsuspends them if unsuspend is set",
+	}, ankiServer.handleSuspendedDue)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_new_rate",
+		Description: "Compare how many new cards a deck actually introduced per day recently against its configured new cards/day",
+	}, ankiServer.handleNewRate)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_export_decks",
+		Description: "Export all decks as CSV with the full path, ID and one column per hierarchy level",
+	}, ankiServer.handleExportDecks)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_deck_duplicates",
+		Description: "Find notes in a deck whose given field has the same text; with confirm, keeps the oldest of each cluster and deletes the rest",
+	}, ankiServer.handleDeckDuplicates)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_set_card_values",
+		Description: "Set low-level scheduling values (ivl, factor, due, reps, lapses) on a card and return the updated card",
+	}, ankiServer.handleSetCardValues)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_learning_queue",
+		Description: "List cards in learning or relearning steps, soonest due first, with their remaining steps",
+	}, ankiServer.handleLearningQueue)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_bulk_set_field",
+		Description: "Set one field to a specific value per note from a map of note ID to new value, reporting success per note",
+	}, ankiServer.handleBulkSetField)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_config_usage",
+		Description: "List the decks that use an options group, given its ID or name",
+	}, ankiServer.handleConfigUsage)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_never_reviewed",
+		Description: "List cards matching a query that have no review history at all, with their fronts",
+	}, ankiServer.handleNeverReviewed)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_shuffle_new",
+		Description: "Randomize the order in which a deck's new cards will be introduced",
+	}, ankiServer.handleShuffleNew)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_note_history",
+		Description: "Summarize a note's history: creation and last modification time, and how often its cards were reviewed",
+	}, ankiServer.handleNoteHistory)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_audit_cloze",
+		Description: "Check cloze notes in a deck or query for malformed cloze markup: unbalanced braces, invalid indices, empty deletions",
+	}, ankiServer.handleAuditCloze)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_most_reviewed",
+		Description: "List the cards matching a query with the most reviews, with their fronts and review counts",
+	}, ankiServer.handleMostReviewed)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_suspend_chronic_fails",
+		Description: "Suspend cards matching a query whose latest reviews were answered Again more than threshold times in a row",
+	}, ankiServer.handleSuspendChronicFails)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_subdecks",
+		Description: "List the direct subdecks of a deck with their IDs, or all descendants if recursive is set",
+	}, ankiServer.handleSubdecks)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_collection_retention",
+		Description: "Compute the collection's mature review retention over the last N days, sampling cards in large collections",
+	}, ankiServer.handleCollectionRetention)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_ease_distribution",
+		Description: "Histogram of ease factors for cards matching a query, flagging clustering at the minimum ease",
+	}, ankiServer.handleEaseDistribution)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_defer_today",
+		Description: "Push up to count of a deck's due review cards, longest intervals first, out by one or two days to lighten today's load",
+	}, ankiServer.handleDeferToday)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_notes_added_by_deck",
+		Description: "Count the notes added in the last N days per deck",
+	}, ankiServer.handleNotesAddedByDeck)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_mark_leech",
+		Description: "Add or remove the leech tag on notes by ID or query, optionally suspending their cards when marking",
+	}, ankiServer.handleMarkLeech)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_reschedule_model",
+		Description: "Reset or spread over N days all cards of a note type; previews the card count unless confirm is set",
+	}, ankiServer.handleRescheduleModel)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_tag_exists",
+		Description: "Check whether a tag exists, suggesting similarly spelled tags when it doesn't",
+	}, ankiServer.handleTagExists)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_dead_templates",
+		Description: "List a model's card templates that have produced no cards",
+	}, ankiServer.handleDeadTemplates)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_due_distribution",
+		Description: "Count cards matching a query due on each of the next N days, starting today, plus those overdue",
+	}, ankiServer.handleDueDistribution)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_cross_model_duplicates",
+		Description: "Find notes of different models that share the same value in a field, labelled with their models",
+	}, ankiServer.handleCrossModelDuplicates)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_store_media_file",
+		Description: "Store a media file in Anki's collection from base64 data, an absolute local path or a URL",
+	}, ankiServer.handleStoreMediaFile)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_backup_size_estimate",
+		Description: "Estimate how large a backup of the collection and its media would be",
+	}, ankiServer.handleBackupSizeEstimate)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_retrieve_media_file",
+		Description: "Retrieve a media file from Anki's collection as base64, with its decoded size in bytes",
+	}, ankiServer.handleRetrieveMediaFile)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_cards_in_step",
+		Description: "List learning cards in a deck that are at a given zero-based learning step, with time until due",
+	}, ankiServer.handleCardsInStep)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_notes_tags",
+		Description: "Report the union and intersection of tags across a set of notes, with per-tag counts",
+	}, ankiServer.handleNotesTags)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_delete_media_file",
+		Description: "Delete a file from Anki's media folder, failing if it doesn't exist",
+	}, ankiServer.handleDeleteMediaFile)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_create_deck",
+		Description: "Create a deck and return its ID. Idempotent: if the deck already exists, its existing ID is returned",
+	}, ankiServer.handleCreateDeck)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_convert_field_format",
+		Description: "Convert a field between HTML and Markdown (direction html_to_md or md_to_html) on notes matching a query, keeping media tags intact. Previews the changes unless confirm is true",
+	}, ankiServer.handleConvertFieldFormat)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_delete_decks",
+		Description: "Delete decks. cards_too defaults to true and removes the cards they contain",
+	}, ankiServer.handleDeleteDecks)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_large_notes",
+		Description: "Find notes whose total field content exceeds a byte threshold (default 10000), largest first, with a preview",
+	}, ankiServer.handleLargeNotes)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_change_deck",
+		Description: "Move cards to a deck, creating the deck if it doesn't exist",
+	}, ankiServer.handleChangeDeck)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_session_progress",
+		Description: "Report today's study progress: cards done, cards remaining by queue and percent complete, for a deck, the deck being reviewed or the whole collection",
+	}, ankiServer.handleSessionProgress)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_create_note",
+		Description: "Create a single note and return its ID. Duplicates and missing fields are reported as errors",
+	}, ankiServer.handleCreateNote)
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "anki_can_add_notes",
+		Description: "Check which notes could be added, in input order, with the reason for each note that would be rejected when AnkiConnect provides one",
+	}, ankiServer.handleCanAddNotes)
+
+	// anki_set_deck_description needs an action stock AnkiConnect lacks, so
+	// it is only offered when the running AnkiConnect reports it
+	reflectCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	supported, err := ankiServer.supportsAction(reflectCtx, "setDeckDescription")
+	cancel()
+	if err != nil {
+		log.Printf("Not offering anki_set_deck_description: could not check AnkiConnect's actions: %v", err)
+	} else if supported {
+		mcp.AddTool(server, &mcp.Tool{
+			Name:        "anki_set_deck_description",
+			Description: "Set the description shown on a deck's overview screen, optionally rendered as markdown",
+		}, ankiServer.handleSetDeckDescription)
+	}
+
 	// Add resources
 	server.AddResource(&mcp.Resource{
 		Name:        "all_decks",
@@ -1068,6 +8958,27 @@ func main() {
 		MIMEType:    "application/json",
 	}, ankiServer.handleCardsReviews)
 
+	server.AddResourceTemplate(&mcp.ResourceTemplate{
+		Name:        "card_context",
+		Description: "Get a card together with its note and deck in one lookup",
+		URITemplate: "anki://cards/{card_id}/context",
+		MIMEType:    "application/json",
+	}, ankiServer.handleCardContext)
+
+	server.AddResource(&mcp.Resource{
+		Name:        "all_media",
+		Description: "List all media file names in the collection",
+		URI:         "anki://media",
+		MIMEType:    "application/json",
+	}, ankiServer.handleMediaFiles)
+
+	server.AddResourceTemplate(&mcp.ResourceTemplate{
+		Name:        "media_files",
+		Description: "List media file names matching a URL-escaped glob pattern",
+		URITemplate: "anki://media/{pattern}",
+		MIMEType:    "application/json",
+	}, ankiServer.handleMediaFiles)
+
 	server.AddResource(&mcp.Resource{
 		Name:        "all_tags",
 		Description: "Get all available tags",
@@ -2,8 +2,18 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
 )
 
 func TestNewAnkiServer(t *testing.T) {
@@ -91,6 +101,9 @@ func TestPaginateList(t *testing.T) {
 	if result["nextCursor"] == nil {
 		t.Error("Expected nextCursor to be present")
 	}
+	if result["start_index"] != 0 || result["page_size"] != 3 || result["has_more"] != true {
+		t.Errorf("Unexpected first page metadata: %v", result)
+	}
 
 	// Test second page
 	nextCursor := result["nextCursor"].(string)
@@ -107,6 +120,59 @@ func TestPaginateList(t *testing.T) {
 	if pageItems2[0] != "d" || pageItems2[1] != "e" || pageItems2[2] != "f" {
 		t.Errorf("Expected items ['d', 'e', 'f'], got %v", pageItems2)
 	}
+	if result2["start_index"] != 3 || result2["has_more"] != true {
+		t.Errorf("Unexpected second page metadata: %v", result2)
+	}
+
+	// Test last page
+	result3, err := paginateList(items, "", 10)
+	if err != nil {
+		t.Fatalf("paginateList failed: %v", err)
+	}
+	if result3["has_more"] != false || result3["nextCursor"] != nil {
+		t.Errorf("Expected no more pages, got %v", result3)
+	}
+}
+
+func TestPaginateListLargePage(t *testing.T) {
+	items := []interface{}{"a", "b", "c"}
+
+	result, err := paginateList(items, "", 500)
+	if err != nil {
+		t.Fatalf("paginateList failed: %v", err)
+	}
+	if pageItems := result["items"].([]interface{}); len(pageItems) != 3 {
+		t.Errorf("Expected all 3 items, got %v", pageItems)
+	}
+	if result["nextCursor"] != nil {
+		t.Errorf("Expected no nextCursor, got %v", result["nextCursor"])
+	}
+
+	// A cursor from a page of a larger result stays usable
+	cursor, _ := encodeCursor(map[string]interface{}{"start_index": 10})
+	result, err = paginateList(items, cursor, 2)
+	if err != nil {
+		t.Fatalf("paginateList failed: %v", err)
+	}
+	if pageItems := result["items"].([]interface{}); len(pageItems) != 0 {
+		t.Errorf("Expected no items past the end, got %v", pageItems)
+	}
+}
+
+func TestClampPageSize(t *testing.T) {
+	tests := map[int]int{
+		0:    100,
+		-5:   1,
+		1:    1,
+		250:  250,
+		500:  500,
+		1000: 500,
+	}
+	for input, expected := range tests {
+		if got := clampPageSize(input); got != expected {
+			t.Errorf("clampPageSize(%d) = %d, expected %d", input, got, expected)
+		}
+	}
 }
 
 func TestAnkiRequestTimeout(t *testing.T) {
@@ -122,3 +188,1949 @@ func TestAnkiRequestTimeout(t *testing.T) {
 		t.Error("Expected timeout error, got nil")
 	}
 }
+
+func TestApplyNoteDefaults(t *testing.T) {
+	server := NewAnkiServer("http://localhost:8765")
+	server.defaultDeck = "Default"
+	server.defaultModel = "Basic"
+
+	note := map[string]interface{}{"fields": map[string]interface{}{"Front": "a"}}
+	server.applyNoteDefaults(note)
+	if note["deckName"] != "Default" {
+		t.Errorf("Expected deckName to be 'Default', got %v", note["deckName"])
+	}
+	if note["modelName"] != "Basic" {
+		t.Errorf("Expected modelName to be 'Basic', got %v", note["modelName"])
+	}
+
+	// Existing values must not be overwritten
+	note = map[string]interface{}{"deckName": "Japanese", "modelName": "Cloze"}
+	server.applyNoteDefaults(note)
+	if note["deckName"] != "Japanese" || note["modelName"] != "Cloze" {
+		t.Errorf("Expected existing values to be kept, got %v", note)
+	}
+}
+
+func TestSearchTerm(t *testing.T) {
+	tests := []struct {
+		key      string
+		value    string
+		expected string
+	}{
+		{"deck", "Default", `"deck:Default"`},
+		{"deck", "My Deck::Sub", `"deck:My Deck::Sub"`},
+		{"deck", `Say "hi"`, `"deck:Say \"hi\""`},
+		{"deck", "a_b*c", `"deck:a\_b\*c"`},
+		{"tag", `back\slash`, `"tag:back\\slash"`},
+	}
+
+	for _, test := range tests {
+		result := searchTerm(test.key, test.value)
+		if result != test.expected {
+			t.Errorf("searchTerm(%q, %q) = %s, expected %s", test.key, test.value, result, test.expected)
+		}
+	}
+}
+
+func TestSchedulerVersion(t *testing.T) {
+	tests := []struct {
+		prefs    map[string]interface{}
+		expected int
+	}{
+		{map[string]interface{}{}, 1},
+		{map[string]interface{}{"schedVer": float64(1)}, 1},
+		{map[string]interface{}{"schedVer": float64(2)}, 2},
+		{map[string]interface{}{"schedVer": float64(2), "v3Scheduler": true}, 3},
+		{map[string]interface{}{"schedVer": float64(2), "v3Scheduler": false}, 2},
+	}
+
+	for _, test := range tests {
+		if result := schedulerVersion(test.prefs); result != test.expected {
+			t.Errorf("schedulerVersion(%v) = %d, expected %d", test.prefs, result, test.expected)
+		}
+	}
+}
+
+func TestChunkInts(t *testing.T) {
+	ids := []int64{1, 2, 3, 4, 5, 6, 7}
+
+	chunks := chunkInts(ids, 3)
+	if len(chunks) != 3 {
+		t.Fatalf("Expected 3 chunks, got %d", len(chunks))
+	}
+	if len(chunks[0]) != 3 || len(chunks[1]) != 3 || len(chunks[2]) != 1 {
+		t.Errorf("Unexpected chunk sizes: %v", chunks)
+	}
+	if chunks[2][0] != 7 {
+		t.Errorf("Expected last chunk to be [7], got %v", chunks[2])
+	}
+
+	if chunks := chunkInts(nil, 3); len(chunks) != 0 {
+		t.Errorf("Expected no chunks for empty input, got %v", chunks)
+	}
+}
+
+func TestKeyCaseConversion(t *testing.T) {
+	snakeTests := map[string]string{
+		"deckName":    "deck_name",
+		"cardsToo":    "cards_too",
+		"total_found": "total_found",
+		"Front":       "Front",
+		"JLPT":        "JLPT",
+		"noteId":      "note_id",
+	}
+	for input, expected := range snakeTests {
+		if result := snakeCase(input); result != expected {
+			t.Errorf("snakeCase(%q) = %q, expected %q", input, result, expected)
+		}
+	}
+
+	camelTests := map[string]string{
+		"deck_name":  "deckName",
+		"new_count":  "newCount",
+		"nextCursor": "nextCursor",
+		"items":      "items",
+	}
+	for input, expected := range camelTests {
+		if result := camelCase(input); result != expected {
+			t.Errorf("camelCase(%q) = %q, expected %q", input, result, expected)
+		}
+	}
+}
+
+func TestMarshalResultNormalizesKeys(t *testing.T) {
+	server := NewAnkiServer("http://localhost:8765")
+	value := map[string]interface{}{
+		"deckName": "My Deck",
+		"cards":    []interface{}{map[string]interface{}{"cardId": 1}},
+		"My Deck":  1,
+	}
+
+	data, err := server.marshalResult(value)
+	if err != nil {
+		t.Fatalf("marshalResult failed: %v", err)
+	}
+	if string(data) != `{"My Deck":1,"cards":[{"cardId":1}],"deckName":"My Deck"}` {
+		t.Errorf("Expected keys to be unchanged by default, got %s", data)
+	}
+
+	server.keyCase = "snake"
+	data, err = server.marshalResult(value)
+	if err != nil {
+		t.Fatalf("marshalResult failed: %v", err)
+	}
+	if string(data) != `{"My Deck":1,"cards":[{"card_id":1}],"deck_name":"My Deck"}` {
+		t.Errorf("Unexpected snake_case output: %s", data)
+	}
+}
+
+func TestMarshalResultKeepsDataKeys(t *testing.T) {
+	server := NewAnkiServer("http://localhost:8765")
+	server.keyCase = "snake"
+
+	// A notesInfo entry: field names are user data and must survive
+	notes := []interface{}{map[string]interface{}{
+		"noteId":    float64(1698765432109),
+		"modelName": "Basic",
+		"tags":      []interface{}{"myTag"},
+		"fields": map[string]interface{}{
+			"FrontSide": map[string]interface{}{"value": "front", "order": 0},
+			"myField":   map[string]interface{}{"value": "extra", "order": 1},
+		},
+	}}
+	data, err := server.marshalResult(notes)
+	if err != nil {
+		t.Fatalf("marshalResult failed: %v", err)
+	}
+	expected := `[{"fields":{"FrontSide":{"order":0,"value":"front"},"myField":{"order":1,"value":"extra"}},"model_name":"Basic","note_id":1698765432109,"tags":["myTag"]}]`
+	if string(data) != expected {
+		t.Errorf("Unexpected notesInfo output:\n%s\nexpected\n%s", data, expected)
+	}
+
+	value := map[string]interface{}{
+		"fieldMapping": map[string]interface{}{"FrontSide": "questionText"},
+		"matches":      map[string]interface{}{"someValue": []interface{}{1}},
+		"byDeck":       map[string]interface{}{"JapaneseVocab": map[string]interface{}{"newCount": 1}},
+	}
+	data, err = server.marshalResult(value)
+	if err != nil {
+		t.Fatalf("marshalResult failed: %v", err)
+	}
+	expected = `{"by_deck":{"JapaneseVocab":{"new_count":1}},"field_mapping":{"FrontSide":"questionText"},"matches":{"someValue":[1]}}`
+	if string(data) != expected {
+		t.Errorf("Unexpected output:\n%s\nexpected\n%s", data, expected)
+	}
+}
+
+func TestMediaReferences(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{"plain text", nil},
+		{`<img src="cat.jpg">`, []string{"cat.jpg"}},
+		{`<img alt="x" src='dog.png' />`, []string{"dog.png"}},
+		{`<IMG SRC=bird.gif>`, []string{"bird.gif"}},
+		{`<img src="a&amp;b.jpg">[sound:hello.mp3]`, []string{"a&b.jpg", "hello.mp3"}},
+		{`<img src="https://example.com/x.png">`, nil},
+		{`<audio controls src="a.ogg"></audio><video><source src="b.webm" type="video/webm"></video>`, []string{"a.ogg", "b.webm"}},
+		{`<object data="c.svg"></object>`, []string{"c.svg"}},
+		{`<img alt="see src=x.png" src="my%20cat.jpg">`, []string{"my cat.jpg"}},
+		{`@font-face { font-family: f; src: url("font.ttf"), url(other.woff); }`, []string{"font.ttf", "other.woff"}},
+		{`<div style="background: url('bg.png')"></div>`, []string{"bg.png"}},
+	}
+
+	for _, test := range tests {
+		result := mediaReferences(test.input)
+		if len(result) != len(test.expected) {
+			t.Errorf("mediaReferences(%q) returned %v, expected %v", test.input, result, test.expected)
+			continue
+		}
+		for i, expected := range test.expected {
+			if result[i] != expected {
+				t.Errorf("mediaReferences(%q)[%d] = %q, expected %q", test.input, i, result[i], expected)
+			}
+		}
+	}
+}
+
+func TestValidateMediaFilename(t *testing.T) {
+	valid := []string{"cat.jpg", "hello world.mp3", "_template.css"}
+	for _, name := range valid {
+		if err := validateMediaFilename(name); err != nil {
+			t.Errorf("validateMediaFilename(%q) returned error: %v", name, err)
+		}
+	}
+
+	invalid := []string{"", "  ", "dir/cat.jpg", `dir\cat.jpg`, "..", "."}
+	for _, name := range invalid {
+		if err := validateMediaFilename(name); err == nil {
+			t.Errorf("validateMediaFilename(%q) expected error, got nil", name)
+		}
+	}
+}
+
+func TestFieldIssues(t *testing.T) {
+	modelFields := []string{"Front", "Back"}
+
+	if issues := fieldIssues(map[string]string{"Front": "a", "Back": ""}, modelFields); issues != nil {
+		t.Errorf("Expected no issues, got %v", issues)
+	}
+
+	issues := fieldIssues(map[string]string{"Front": "<div> </div>", "Extra": "x"}, modelFields)
+	if issues == nil {
+		t.Fatal("Expected issues, got nil")
+	}
+	if missing := issues["missing_fields"].([]string); len(missing) != 1 || missing[0] != "Back" {
+		t.Errorf("Expected missing_fields [Back], got %v", missing)
+	}
+	if unexpected := issues["unexpected_fields"].([]string); len(unexpected) != 1 || unexpected[0] != "Extra" {
+		t.Errorf("Expected unexpected_fields [Extra], got %v", unexpected)
+	}
+	if empty := issues["empty_required_fields"].([]string); len(empty) != 1 || empty[0] != "Front" {
+		t.Errorf("Expected empty_required_fields [Front], got %v", empty)
+	}
+}
+
+func TestFormattingIssues(t *testing.T) {
+	tests := []struct {
+		input    string
+		issues   []string
+		expected string
+	}{
+		{"clean", nil, "clean"},
+		{"<div>wrapped</div>", []string{"div_wrapper"}, "wrapped"},
+		{"a&nbsp;b", []string{"nbsp"}, "a b"},
+		{"text<br><br>", []string{"surrounding_whitespace"}, "text"},
+		{" text", []string{"surrounding_whitespace"}, "text"},
+		{"<b>a</b> <strong>b</strong>", []string{"mixed_bold"}, "<b>a</b> <b>b</b>"},
+		{"<div>a</div><div>b</div>", nil, "<div>a</div><div>b</div>"},
+	}
+
+	for _, test := range tests {
+		issues := formattingIssues(test.input)
+		if strings.Join(issues, ",") != strings.Join(test.issues, ",") {
+			t.Errorf("formattingIssues(%q) = %v, expected %v", test.input, issues, test.issues)
+		}
+		if fixed := fixFormatting(test.input); fixed != test.expected {
+			t.Errorf("fixFormatting(%q) = %q, expected %q", test.input, fixed, test.expected)
+		}
+	}
+}
+
+func TestSpreadDays(t *testing.T) {
+	days := spreadDays(6, 1, 3)
+	counts := map[int]int{}
+	for _, day := range days {
+		if day < 1 || day > 3 {
+			t.Errorf("Day %d out of range [1, 3]", day)
+		}
+		counts[day]++
+	}
+	for day := 1; day <= 3; day++ {
+		if counts[day] != 2 {
+			t.Errorf("Expected 2 cards on day %d, got %d", day, counts[day])
+		}
+	}
+
+	if days := spreadDays(2, 0, 9); days[0] != 0 || days[1] != 5 {
+		t.Errorf("Expected [0 5], got %v", days)
+	}
+	if days := spreadDays(0, 0, 9); len(days) != 0 {
+		t.Errorf("Expected no days, got %v", days)
+	}
+}
+
+func TestFieldDiscrepancies(t *testing.T) {
+	requested := map[string]interface{}{"Front": "question", "Back": "answer", "Extra": "x"}
+	actual := map[string]string{"Front": "question", "Back": ""}
+
+	discrepancies := fieldDiscrepancies(requested, actual)
+	if len(discrepancies) != 2 {
+		t.Fatalf("Expected 2 discrepancies, got %v", discrepancies)
+	}
+	if discrepancies[0]["field"] != "Back" || discrepancies[0]["actual"] != "" {
+		t.Errorf("Expected Back mismatch first, got %v", discrepancies[0])
+	}
+	if discrepancies[1]["field"] != "Extra" || discrepancies[1]["error"] != "field missing" {
+		t.Errorf("Expected Extra to be missing, got %v", discrepancies[1])
+	}
+
+	if discrepancies := fieldDiscrepancies(map[string]interface{}{"Front": "q"}, map[string]string{"Front": "q"}); len(discrepancies) != 0 {
+		t.Errorf("Expected no discrepancies, got %v", discrepancies)
+	}
+}
+
+func TestCardHealthStats(t *testing.T) {
+	cards := []map[string]interface{}{
+		{"type": float64(0), "interval": float64(0), "reps": float64(0), "lapses": float64(0), "factor": float64(0)},
+		{"type": float64(2), "interval": float64(5), "reps": float64(4), "lapses": float64(1), "factor": float64(2300)},
+		{"type": float64(2), "interval": float64(30), "reps": float64(6), "lapses": float64(0), "factor": float64(2700)},
+	}
+
+	stats := cardHealthStats(cards)
+	if stats["total"] != 3 || stats["new"] != 1 || stats["young"] != 1 || stats["mature"] != 1 {
+		t.Errorf("Unexpected buckets: %v", stats)
+	}
+	if stats["lapse_rate"] != 0.1 {
+		t.Errorf("Expected lapse_rate 0.1, got %v", stats["lapse_rate"])
+	}
+	if stats["average_ease"] != 250.0 {
+		t.Errorf("Expected average_ease 250, got %v", stats["average_ease"])
+	}
+
+	empty := cardHealthStats(nil)
+	if empty["lapse_rate"] != nil || empty["average_ease"] != nil {
+		t.Errorf("Expected nil metrics for no cards, got %v", empty)
+	}
+}
+
+func TestAnkiRequestTypedErrors(t *testing.T) {
+	server, _ := newAnkiStub(t, nil)
+	_, err := server.ankiRequest(context.Background(), "bogus", nil)
+	var ankiErr *AnkiConnectError
+	if !errors.As(err, &ankiErr) {
+		t.Fatalf("Expected AnkiConnectError, got %v", err)
+	}
+	if ankiErr.Action != "bogus" || ankiErr.Message != "unsupported action" {
+		t.Errorf("Unexpected AnkiConnectError: %+v", ankiErr)
+	}
+	if code := errorCode(err); code != codeUnsupported {
+		t.Errorf("Expected code %s, got %s", codeUnsupported, code)
+	}
+
+	unreachable := NewAnkiServer("http://127.0.0.1:1")
+	_, err = unreachable.ankiRequest(context.Background(), "version", nil)
+	if code := errorCode(err); code != codeConnection {
+		t.Errorf("Expected code %s, got %s (%v)", codeConnection, code, err)
+	}
+}
+
+func TestToolErrorPayload(t *testing.T) {
+	result := requestError("Error finding cards", &AnkiConnectError{Action: "findCards", Message: "bad query"})
+	if !result.IsError {
+		t.Fatal("Expected IsError to be true")
+	}
+	if len(result.Content) != 2 {
+		t.Fatalf("Expected 2 content items, got %d", len(result.Content))
+	}
+	if text := result.Content[0].(*mcp.TextContent).Text; text != "Error finding cards: AnkiConnect error: bad query" {
+		t.Errorf("Unexpected human-readable text: %s", text)
+	}
+
+	var payload map[string]string
+	if err := json.Unmarshal([]byte(result.Content[1].(*mcp.TextContent).Text), &payload); err != nil {
+		t.Fatalf("Error payload is not JSON: %v", err)
+	}
+	if payload["code"] != codeAnkiConnect || payload["message"] != "Error finding cards: AnkiConnect error: bad query" {
+		t.Errorf("Unexpected payload: %v", payload)
+	}
+
+	if code := errorCode(fmt.Errorf("deck X %w", errNotFound)); code != codeNotFound {
+		t.Errorf("Expected code %s, got %s", codeNotFound, code)
+	}
+}
+
+func TestLookupPath(t *testing.T) {
+	data := map[string]interface{}{
+		"newSpread": float64(0),
+		"limits": map[string]interface{}{
+			"new": map[string]interface{}{"perDay": float64(20)},
+		},
+	}
+
+	if value, ok := lookupPath(data, "newSpread"); !ok || value != float64(0) {
+		t.Errorf("Expected newSpread to be 0, got %v (%v)", value, ok)
+	}
+	if value, ok := lookupPath(data, "limits.new.perDay"); !ok || value != float64(20) {
+		t.Errorf("Expected limits.new.perDay to be 20, got %v (%v)", value, ok)
+	}
+	for _, key := range []string{"missing", "limits.missing", "newSpread.deeper"} {
+		if _, ok := lookupPath(data, key); ok {
+			t.Errorf("Expected lookupPath(%q) to fail", key)
+		}
+	}
+}
+
+func TestComputeStreaks(t *testing.T) {
+	today := time.Date(2024, 3, 10, 15, 0, 0, 0, time.Local)
+	byDay := map[string]int{
+		"2024-03-01": 5,
+		"2024-03-02": 5,
+		"2024-03-03": 5,
+		"2024-03-04": 5,
+		"2024-03-06": 5,
+		"2024-03-08": 5,
+		"2024-03-09": 5,
+	}
+
+	// Not studied yet today: the streak counts back from yesterday
+	current, longest := computeStreaks(byDay, today)
+	if current != 2 || longest != 4 {
+		t.Errorf("Expected current 2 and longest 4, got %d and %d", current, longest)
+	}
+
+	byDay["2024-03-10"] = 1
+	current, longest = computeStreaks(byDay, today)
+	if current != 3 || longest != 4 {
+		t.Errorf("Expected current 3 and longest 4, got %d and %d", current, longest)
+	}
+
+	current, longest = computeStreaks(map[string]int{"2024-03-07": 3}, today)
+	if current != 0 || longest != 1 {
+		t.Errorf("Expected current 0 and longest 1, got %d and %d", current, longest)
+	}
+}
+
+func TestCardPreview(t *testing.T) {
+	card := map[string]interface{}{
+		"fields": map[string]interface{}{
+			"Back":  map[string]interface{}{"value": "answer", "order": float64(1)},
+			"Front": map[string]interface{}{"value": "<b>What&amp;why</b> ", "order": float64(0)},
+		},
+	}
+	if got := cardPreview(card); got != "What&why" {
+		t.Errorf("Expected %q, got %q", "What&why", got)
+	}
+
+	long := strings.Repeat("é", previewLength+5)
+	card["fields"].(map[string]interface{})["Front"] = map[string]interface{}{"value": long, "order": float64(0)}
+	if got := cardPreview(card); got != strings.Repeat("é", previewLength)+"…" {
+		t.Errorf("Expected truncated preview, got %q", got)
+	}
+}
+
+func TestNormalizeTag(t *testing.T) {
+	tests := map[string]string{
+		"spanish":             "spanish",
+		" spanish ":           "spanish",
+		"lang:::spanish":      "lang::spanish",
+		"::lang::spanish::":   "lang::spanish",
+		"lang::::verbs:::irr": "lang::verbs::irr",
+		":::":                 "",
+	}
+	for input, expected := range tests {
+		if got := normalizeTag(input); got != expected {
+			t.Errorf("normalizeTag(%q) = %q, expected %q", input, got, expected)
+		}
+	}
+}
+
+func TestCanonicalTagCase(t *testing.T) {
+	canonical := canonicalTagCase(map[string]int{"Verbs": 1, "verbs": 5, "Nouns": 2, "nouns": 2, "misc": 1})
+	expected := map[string]string{"Verbs": "verbs", "verbs": "verbs", "Nouns": "Nouns", "nouns": "Nouns", "misc": "misc"}
+	for tag, want := range expected {
+		if canonical[tag] != want {
+			t.Errorf("canonical[%q] = %q, expected %q", tag, canonical[tag], want)
+		}
+	}
+}
+
+func TestCreationHistogram(t *testing.T) {
+	millis := func(year int, month time.Month, day int) int64 {
+		return time.Date(year, month, day, 12, 0, 0, 0, time.UTC).UnixMilli()
+	}
+	ids := []int64{millis(2024, 3, 1), millis(2024, 1, 15), millis(2024, 1, 20)}
+
+	buckets := creationHistogram(ids, time.UTC)
+	expected := []struct {
+		month string
+		notes int
+	}{{"2024-01", 2}, {"2024-02", 0}, {"2024-03", 1}}
+	if len(buckets) != len(expected) {
+		t.Fatalf("Expected %d buckets, got %v", len(expected), buckets)
+	}
+	for i, want := range expected {
+		if buckets[i]["month"] != want.month || buckets[i]["notes"] != want.notes {
+			t.Errorf("Bucket %d: expected %s=%d, got %v", i, want.month, want.notes, buckets[i])
+		}
+	}
+
+	if buckets := creationHistogram(nil, time.UTC); len(buckets) != 0 {
+		t.Errorf("Expected no buckets, got %v", buckets)
+	}
+}
+
+func TestValidateDeckPath(t *testing.T) {
+	for _, path := range []string{"Lang", "Lang::JP::Vocab", "My Deck::Sub Deck"} {
+		if err := validateDeckPath(path); err != nil {
+			t.Errorf("Expected %q to be valid, got %v", path, err)
+		}
+	}
+	for _, path := range []string{"", "Lang::", "::Lang", "Lang::::JP", "Lang:: ::JP"} {
+		if err := validateDeckPath(path); err == nil {
+			t.Errorf("Expected %q to be rejected", path)
+		}
+	}
+}
+
+func TestRankByAgain(t *testing.T) {
+	review := func(ease float64) map[string]interface{} {
+		return map[string]interface{}{"ease": ease}
+	}
+	reviews := map[string][]map[string]interface{}{
+		"1": {review(1), review(3), review(3), review(1)},
+		"2": {review(1), review(1)},
+		"3": {review(3), review(4)},
+		"4": {review(1), review(2), review(3)},
+	}
+
+	ranked := rankByAgain(reviews)
+	expected := []cardDifficulty{{2, 2, 2}, {1, 2, 4}, {4, 1, 3}}
+	if len(ranked) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, ranked)
+	}
+	for i := range expected {
+		if ranked[i] != expected[i] {
+			t.Errorf("Position %d: expected %v, got %v", i, expected[i], ranked[i])
+		}
+	}
+}
+
+func TestMatureRetention(t *testing.T) {
+	review := func(reviewType, lastInterval, ease float64) map[string]interface{} {
+		return map[string]interface{}{"type": reviewType, "lastIvl": lastInterval, "ease": ease}
+	}
+	reviews := map[string][]map[string]interface{}{
+		"1": {review(1, 30, 3), review(1, 45, 1), review(1, 10, 1)},
+		"2": {review(1, 21, 4), review(0, -600, 1), review(2, 30, 3)},
+	}
+
+	passed, total := matureRetention(reviews)
+	if passed != 2 || total != 3 {
+		t.Errorf("Expected 2 of 3 mature reviews passed, got %d of %d", passed, total)
+	}
+}
+
+func TestRenderTemplate(t *testing.T) {
+	fields := map[string]string{"Front": "<b>hola</b>", "Back": "hello", "Extra": " ", "FrontSide": "<b>hola</b>"}
+	tests := []struct {
+		tmpl     string
+		expected string
+	}{
+		{"{{Front}}", "<b>hola</b>"},
+		{"{{FrontSide}}<hr id=answer>{{Back}}", "<b>hola</b><hr id=answer>hello"},
+		{"{{text:Front}}", "hola"},
+		{"{{type:Back}}", ""},
+		{"{{#Back}}[{{Back}}]{{/Back}}", "[hello]"},
+		{"{{#Extra}}[{{Extra}}]{{/Extra}}done", "done"},
+		{"{{^Extra}}no extra{{/Extra}}", "no extra"},
+		{"{{#Back}}a{{#Extra}}b{{/Extra}}c{{/Back}}", "ac"},
+		{"{{ Missing }}!", "!"},
+	}
+	for _, test := range tests {
+		if got := renderTemplate(test.tmpl, fields); got != test.expected {
+			t.Errorf("renderTemplate(%q) = %q, expected %q", test.tmpl, got, test.expected)
+		}
+	}
+}
+
+func TestMapFieldsByName(t *testing.T) {
+	mapping, unmapped := mapFieldsByName(
+		[]string{"Front", "back", "Notes", "Source"},
+		[]string{"Front", "Back", "Source", "Extra"},
+	)
+	expected := map[string]string{"Front": "Front", "back": "Back", "Source": "Source"}
+	if len(mapping) != len(expected) {
+		t.Errorf("Expected mapping %v, got %v", expected, mapping)
+	}
+	for from, to := range expected {
+		if mapping[from] != to {
+			t.Errorf("Expected %s -> %s, got %q", from, to, mapping[from])
+		}
+	}
+	if len(unmapped) != 1 || unmapped[0] != "Notes" {
+		t.Errorf("Expected [Notes] unmapped, got %v", unmapped)
+	}
+
+	// An exact match wins over an earlier case-insensitive one
+	mapping, unmapped = mapFieldsByName([]string{"front", "Front"}, []string{"Front"})
+	if mapping["Front"] != "Front" || len(unmapped) != 1 || unmapped[0] != "front" {
+		t.Errorf("Expected exact match to take precedence, got %v and %v", mapping, unmapped)
+	}
+}
+
+func TestOrderedFieldValues(t *testing.T) {
+	note := map[string]interface{}{
+		"fields": map[string]interface{}{
+			"Extra": map[string]interface{}{"value": "c", "order": float64(2)},
+			"Front": map[string]interface{}{"value": "a", "order": float64(0)},
+			"Back":  map[string]interface{}{"value": "b", "order": float64(1)},
+		},
+	}
+	values := orderedFieldValues(note)
+	if strings.Join(values, ",") != "a,b,c" {
+		t.Errorf("Expected [a b c], got %v", values)
+	}
+}
+
+func TestButtonsByDay(t *testing.T) {
+	at := func(day int, ease float64) map[string]interface{} {
+		id := time.Date(2024, 3, day, 10, 0, 0, 0, time.UTC).UnixMilli()
+		return map[string]interface{}{"id": float64(id), "ease": ease}
+	}
+	reviews := map[string][]map[string]interface{}{
+		"1": {at(1, 1), at(3, 3)},
+		"2": {at(1, 3), at(1, 4), at(9, 2)},
+	}
+
+	days := buttonsByDay(reviews, time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 3, 0, 0, 0, 0, time.UTC))
+	if len(days) != 3 {
+		t.Fatalf("Expected 3 days, got %v", days)
+	}
+	first := days[0]
+	if first["date"] != "2024-03-01" || first["again"] != 1 || first["good"] != 1 || first["easy"] != 1 || first["total"] != 3 {
+		t.Errorf("Unexpected first day: %v", first)
+	}
+	if days[1]["total"] != 0 {
+		t.Errorf("Expected no reviews on 2024-03-02, got %v", days[1])
+	}
+	if days[2]["good"] != 1 || days[2]["total"] != 1 {
+		t.Errorf("Unexpected last day: %v", days[2])
+	}
+}
+
+func TestExplainDeckConfig(t *testing.T) {
+	config := map[string]interface{}{
+		"name": "Default",
+		"new": map[string]interface{}{
+			"perDay":        float64(20),
+			"delays":        []interface{}{float64(1), float64(10), float64(1440)},
+			"ints":          []interface{}{float64(1), float64(4)},
+			"initialFactor": float64(2500),
+		},
+		"rev": map[string]interface{}{"perDay": float64(200)},
+	}
+
+	settings := explainDeckConfig(config)
+	byKey := map[string]map[string]interface{}{}
+	for _, setting := range settings {
+		byKey[setting["key"].(string)] = setting
+	}
+	if len(settings) != 6 {
+		t.Errorf("Expected 6 settings, got %d: %v", len(settings), settings)
+	}
+	if got := byKey["new.delays"]["explanation"]; got != "new cards are shown again after 1m 10m 1d" {
+		t.Errorf("Unexpected learning steps explanation: %v", got)
+	}
+	if got := byKey["new.ints.1"]["value"]; got != float64(4) {
+		t.Errorf("Expected easy interval 4, got %v", got)
+	}
+	if got := byKey["new.initialFactor"]["explanation"]; got != "250% interval multiplier for graduated cards" {
+		t.Errorf("Unexpected starting ease explanation: %v", got)
+	}
+	if _, ok := byKey["lapse.delays"]; ok {
+		t.Error("Expected missing settings to be skipped")
+	}
+}
+
+func TestDaysUntil(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("time zone data not available")
+	}
+	today := time.Date(2024, 3, 9, 0, 0, 0, 0, loc)
+	tests := map[string]int{"2024-03-09": 0, "2024-03-10": 1, "2024-03-11": 2, "2024-04-09": 31, "2024-03-01": -8}
+	for input, expected := range tests {
+		date, _ := time.ParseInLocation(dateLayout, input, loc)
+		if got := daysUntil(date, today); got != expected {
+			t.Errorf("daysUntil(%s) = %d, expected %d", input, got, expected)
+		}
+	}
+}
+
+func TestIntroductionsByDay(t *testing.T) {
+	at := func(day int, reviewType float64) map[string]interface{} {
+		id := time.Date(2024, 3, day, 10, 0, 0, 0, time.UTC).UnixMilli()
+		return map[string]interface{}{"id": float64(id), "type": reviewType}
+	}
+	reviews := map[string][]map[string]interface{}{
+		"1": {at(2, 1), at(1, 0)},
+		"2": {at(2, 0), at(3, 1)},
+		"3": {at(2, 2)},
+		"4": {at(20, 0)},
+	}
+
+	days := introductionsByDay(reviews, time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 3, 0, 0, 0, 0, time.UTC))
+	expected := []int{1, 1, 0}
+	if len(days) != len(expected) {
+		t.Fatalf("Expected %d days, got %v", len(expected), days)
+	}
+	for i, want := range expected {
+		if days[i]["introduced"] != want {
+			t.Errorf("Day %s: expected %d, got %v", days[i]["date"], want, days[i]["introduced"])
+		}
+	}
+}
+
+func TestDecksCSV(t *testing.T) {
+	text, err := decksCSV(map[string]int64{
+		"Lang::JP::Vocab":  3,
+		"Default":          1,
+		"Lang":             2,
+		"Reading, Writing": 4,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := "path,id,level_1,level_2,level_3\n" +
+		"Default,1,Default,,\n" +
+		"Lang,2,Lang,,\n" +
+		"Lang::JP::Vocab,3,Lang,JP,Vocab\n" +
+		"\"Reading, Writing\",4,\"Reading, Writing\",,\n"
+	if text != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, text)
+	}
+}
+
+func TestDuplicateClusters(t *testing.T) {
+	note := func(id float64, front string) map[string]interface{} {
+		return map[string]interface{}{
+			"noteId": id,
+			"fields": map[string]interface{}{"Front": map[string]interface{}{"value": front}},
+		}
+	}
+	notes := []map[string]interface{}{
+		note(3, "<b>Hola</b>"),
+		note(1, "hola"),
+		note(2, "adiós"),
+		note(5, "  Buenos   días"),
+		note(4, "buenos días"),
+		note(6, ""),
+		note(7, ""),
+	}
+
+	clusters := duplicateClusters(notes, "Front")
+	if len(clusters) != 2 {
+		t.Fatalf("Expected 2 clusters, got %v", clusters)
+	}
+	if clusters[0]["value"] != "buenos días" || fmt.Sprint(clusters[0]["note_ids"]) != "[4 5]" {
+		t.Errorf("Unexpected first cluster: %v", clusters[0])
+	}
+	if clusters[1]["value"] != "hola" || fmt.Sprint(clusters[1]["note_ids"]) != "[1 3]" {
+		t.Errorf("Unexpected second cluster: %v", clusters[1])
+	}
+	if clusters := duplicateClusters(notes, "Back"); len(clusters) != 0 {
+		t.Errorf("Expected no clusters for a missing field, got %v", clusters)
+	}
+}
+
+func TestCardValueKeys(t *testing.T) {
+	keys, err := cardValueKeys(map[string]int{"lapses": 0, "ivl": 10, "factor": 2500})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if strings.Join(keys, ",") != "factor,ivl,lapses" {
+		t.Errorf("Expected sorted keys, got %v", keys)
+	}
+
+	if _, err := cardValueKeys(map[string]int{"ivl": 1, "odid": 5}); err == nil {
+		t.Error("Expected unknown key to be rejected")
+	}
+	if _, err := cardValueKeys(nil); err == nil {
+		t.Error("Expected empty values to be rejected")
+	}
+}
+
+func TestClozeFieldNames(t *testing.T) {
+	templates := map[string]interface{}{
+		"Cloze": map[string]interface{}{
+			"Front": "{{cloze:Text}}",
+			"Back":  "{{cloze:Text}}<br>{{Back Extra}}{{text:cloze:Extra}}",
+		},
+	}
+	if fields := clozeFieldNames(templates); strings.Join(fields, ",") != "Extra,Text" {
+		t.Errorf("Expected [Extra Text], got %v", fields)
+	}
+	basic := map[string]interface{}{"Card 1": map[string]interface{}{"Front": "{{Front}}", "Back": "{{Back}}"}}
+	if fields := clozeFieldNames(basic); len(fields) != 0 {
+		t.Errorf("Expected no cloze fields, got %v", fields)
+	}
+}
+
+func TestClozeIssues(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{"The {{c1::capital}} of {{c2::France::country}}", ""},
+		{"{{c1::outer {{c2::inner}}}}", ""},
+		{"no deletions here", "no_cloze"},
+		{"{{c1::Paris}", "unbalanced_braces"},
+		{"{{c0::Paris}}", "invalid_index"},
+		{"{{cx::Paris}}", "invalid_index"},
+		{"{{c1:Paris}}", "malformed_marker"},
+		{"{c1::Paris}} and {{c2::Lyon}}", "unbalanced_braces,malformed_marker"},
+		{"{{c1::<b> </b>}}", "empty_cloze"},
+	}
+	for _, test := range tests {
+		if got := strings.Join(clozeIssues(test.value), ","); got != test.expected {
+			t.Errorf("clozeIssues(%q) = %q, expected %q", test.value, got, test.expected)
+		}
+	}
+}
+
+func TestTrailingAgainRun(t *testing.T) {
+	review := func(id, ease float64) map[string]interface{} {
+		return map[string]interface{}{"id": id, "ease": ease}
+	}
+	tests := []struct {
+		reviews  []map[string]interface{}
+		expected int
+	}{
+		{nil, 0},
+		{[]map[string]interface{}{review(1, 1), review(2, 1), review(3, 3)}, 0},
+		{[]map[string]interface{}{review(4, 1), review(1, 1), review(2, 3), review(3, 1)}, 2},
+		{[]map[string]interface{}{review(1, 1), review(2, 1), review(3, 1)}, 3},
+	}
+	for i, test := range tests {
+		if got := trailingAgainRun(test.reviews); got != test.expected {
+			t.Errorf("Case %d: expected %d, got %d", i, test.expected, got)
+		}
+	}
+}
+
+func TestSubdecksOf(t *testing.T) {
+	decks := map[string]int64{
+		"Lang":            1,
+		"Lang::JP":        2,
+		"Lang::JP::Vocab": 3,
+		"Lang::ES":        4,
+		"Lang2":           5,
+		"Lang2::Sub":      6,
+	}
+	names := func(subdecks []map[string]interface{}) string {
+		var result []string
+		for _, deck := range subdecks {
+			result = append(result, deck["name"].(string))
+		}
+		return strings.Join(result, ",")
+	}
+
+	if got := names(subdecksOf(decks, "Lang", false)); got != "Lang::ES,Lang::JP" {
+		t.Errorf("Expected direct children, got %s", got)
+	}
+	if got := names(subdecksOf(decks, "Lang", true)); got != "Lang::ES,Lang::JP,Lang::JP::Vocab" {
+		t.Errorf("Expected all descendants, got %s", got)
+	}
+	if got := subdecksOf(decks, "Lang::JP::Vocab", true); len(got) != 0 {
+		t.Errorf("Expected no subdecks, got %v", got)
+	}
+}
+
+func TestReviewsSince(t *testing.T) {
+	reviews := map[string][]map[string]interface{}{
+		"1": {{"id": float64(100)}, {"id": float64(200)}},
+		"2": {{"id": float64(50)}},
+	}
+	filtered := reviewsSince(reviews, 150)
+	if len(filtered) != 1 || len(filtered["1"]) != 1 || filtered["1"][0]["id"] != float64(200) {
+		t.Errorf("Expected only the review at 200, got %v", filtered)
+	}
+}
+
+func TestEaseHistogram(t *testing.T) {
+	buckets, atMinimum := easeHistogram([]int{1300, 1300, 1450, 1500, 2500, 2500, 2999, 3100})
+	expected := []int{3, 1, 0, 3, 1}
+	for i, want := range expected {
+		if buckets[i]["cards"] != want {
+			t.Errorf("Bucket %s: expected %d, got %v", buckets[i]["range"], want, buckets[i]["cards"])
+		}
+	}
+	if atMinimum != 2 {
+		t.Errorf("Expected 2 cards at minimum ease, got %d", atMinimum)
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"", "", 0},
+		{"verbs", "verbs", 0},
+		{"verbs", "verb", 1},
+		{"kitten", "sitting", 3},
+		{"", "abc", 3},
+		{"café", "cafe", 1},
+	}
+	for _, test := range tests {
+		if got := editDistance(test.a, test.b); got != test.expected {
+			t.Errorf("editDistance(%q, %q) = %d, expected %d", test.a, test.b, got, test.expected)
+		}
+	}
+}
+
+func TestSimilarTags(t *testing.T) {
+	tags := []string{"vocabulary", "Verbs", "verbs::irregular", "grammar", "nouns", "adverbs", "herb"}
+	suggestions := similarTags("verb", tags)
+	if strings.Join(suggestions, ",") != "Verbs,herb" {
+		t.Errorf("Expected [Verbs herb], got %v", suggestions)
+	}
+	if suggestions := similarTags("zzzz", tags); len(suggestions) != 0 {
+		t.Errorf("Expected no suggestions, got %v", suggestions)
+	}
+}
+
+// newAnkiStub starts a stand-in for AnkiConnect that answers each action with
+// the given result JSON, or with an AnkiConnect error for values starting
+// with "error: ". Unknown actions fail as unsupported. The params of every
+// request are recorded by action.
+func newAnkiStub(t *testing.T, results map[string]string) (*AnkiServer, map[string][]map[string]interface{}) {
+	t.Helper()
+	var mu sync.Mutex
+	calls := map[string][]map[string]interface{}{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Action string                 `json:"action"`
+			Params map[string]interface{} `json:"params"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		calls[body.Action] = append(calls[body.Action], body.Params)
+		mu.Unlock()
+
+		result, ok := results[body.Action]
+		switch {
+		case !ok:
+			w.Write([]byte(`{"result": null, "error": "unsupported action"}`))
+		case strings.HasPrefix(result, "error: "):
+			message, _ := json.Marshal(strings.TrimPrefix(result, "error: "))
+			fmt.Fprintf(w, `{"result": null, "error": %s}`, message)
+		default:
+			fmt.Fprintf(w, `{"result": %s, "error": null}`, result)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return NewAnkiServer(ts.URL), calls
+}
+
+func TestHandleStoreMediaFile(t *testing.T) {
+	server, calls := newAnkiStub(t, map[string]string{"storeMediaFile": `"_cat.png"`})
+
+	deleteExisting := false
+	result, _ := server.handleStoreMediaFile(context.Background(), nil, &mcp.CallToolParamsFor[StoreMediaArgs]{
+		Arguments: StoreMediaArgs{Filename: "_cat.png", Data: "aGVsbG8=", DeleteExisting: &deleteExisting},
+	})
+	if result.IsError {
+		t.Fatalf("Unexpected error: %s", result.Content[0].(*mcp.TextContent).Text)
+	}
+	if received := calls["storeMediaFile"][0]; received["data"] != "aGVsbG8=" || received["deleteExisting"] != false {
+		t.Errorf("Unexpected params sent to AnkiConnect: %v", received)
+	}
+	var payload map[string]interface{}
+	json.Unmarshal([]byte(result.Content[0].(*mcp.TextContent).Text), &payload)
+	if payload["stored_as"] != "_cat.png" {
+		t.Errorf("Expected stored_as _cat.png, got %v", payload)
+	}
+
+	invalid := []StoreMediaArgs{
+		{Filename: "_cat.png"},
+		{Filename: "_cat.png", Data: "aGVsbG8=", URL: "https://example.com/cat.png"},
+		{Filename: "img/cat.png", Data: "aGVsbG8="},
+		{Filename: "_cat.png", Data: "not base64!"},
+	}
+	for _, args := range invalid {
+		result, _ := server.handleStoreMediaFile(context.Background(), nil, &mcp.CallToolParamsFor[StoreMediaArgs]{Arguments: args})
+		if !result.IsError {
+			t.Errorf("Expected an error for %+v", args)
+		}
+	}
+}
+
+func TestHandleFindOrphanMedia(t *testing.T) {
+	server, calls := newAnkiStub(t, map[string]string{
+		"getMediaFilesNames": `["note.png", "clip.mp4", "logo.png", "font.ttf", "_script.js", "latex-1a2b.png", "unused.mp3"]`,
+		"findNotes":          `[1]`,
+		"notesInfo":          `[{"noteId": 1, "fields": {"Front": {"value": "<img src=\"note.png\">"}, "Back": {"value": "<video><source src=\"clip.mp4\"></video>"}}}]`,
+		"modelNamesAndIds":   `{"Basic": 1}`,
+		"modelTemplates":     `{"Card 1": {"Front": "<img src=\"logo.png\">{{Front}}", "Back": "{{Back}}"}}`,
+		"modelStyling":       `{"css": "@font-face { font-family: f; src: url(font.ttf); }"}`,
+		"deleteMediaFile":    `null`,
+	})
+
+	result, _ := server.handleFindOrphanMedia(context.Background(), nil, &mcp.CallToolParamsFor[FindOrphanMediaArgs]{
+		Arguments: FindOrphanMediaArgs{Delete: true, Confirm: true},
+	})
+	if result.IsError {
+		t.Fatalf("Unexpected error: %s", result.Content[0].(*mcp.TextContent).Text)
+	}
+	var payload struct {
+		OrphanMedia []string `json:"orphan_media"`
+		Deleted     int      `json:"deleted"`
+	}
+	json.Unmarshal([]byte(result.Content[0].(*mcp.TextContent).Text), &payload)
+	if strings.Join(payload.OrphanMedia, ",") != "unused.mp3" || payload.Deleted != 1 {
+		t.Errorf("Expected only unused.mp3 to be orphaned and deleted, got %+v", payload)
+	}
+	if deleted := calls["deleteMediaFile"]; len(deleted) != 1 || deleted[0]["filename"] != "unused.mp3" {
+		t.Errorf("Unexpected deletions: %v", deleted)
+	}
+
+	// Without the model templates nothing can be ruled out, so nothing is deleted
+	broken, calls := newAnkiStub(t, map[string]string{
+		"getMediaFilesNames": `["unused.mp3"]`,
+		"findNotes":          `[]`,
+		"notesInfo":          `[]`,
+		"deleteMediaFile":    `null`,
+	})
+	result, _ = broken.handleFindOrphanMedia(context.Background(), nil, &mcp.CallToolParamsFor[FindOrphanMediaArgs]{
+		Arguments: FindOrphanMediaArgs{Delete: true, Confirm: true},
+	})
+	if !result.IsError || len(calls["deleteMediaFile"]) != 0 {
+		t.Errorf("Expected an error and no deletions, got %+v", result)
+	}
+}
+
+func TestHandleSuspendedDue(t *testing.T) {
+	now := time.Now().Unix()
+	cards := map[float64]string{
+		1: `{"cardId": 1, "type": 2, "queue": -1, "due": 100, "deckName": "Default", "question": "overdue"}`,
+		2: `{"cardId": 2, "type": 2, "queue": -1, "due": 200, "deckName": "Default", "question": "later"}`,
+		3: fmt.Sprintf(`{"cardId": 3, "type": 1, "queue": -1, "due": %d, "deckName": "Default", "question": "learning"}`, now-60),
+		4: fmt.Sprintf(`{"cardId": 4, "type": 3, "queue": -1, "due": %d, "deckName": "Default", "question": "relearning"}`, now+3600),
+	}
+	tests := []struct {
+		name     string
+		hasRef   bool
+		relative int
+		expected string
+		undated  int
+	}{
+		{"probed", true, 5, "1,3", 0},
+		{"searched", true, 30, "1,3", 0},
+		{"all suspended", false, 0, "3", 2},
+	}
+	for _, test := range tests {
+		// Today is day 105; the unsuspended reference card 999 is due the
+		// given number of days from today
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var body struct {
+				Action string                 `json:"action"`
+				Params map[string]interface{} `json:"params"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			result := `[]`
+			switch body.Action {
+			case "findCards":
+				query, _ := body.Params["query"].(string)
+				var offset int
+				switch {
+				case strings.HasPrefix(query, "is:suspended"):
+					result = `[1, 2, 3, 4]`
+				case !test.hasRef:
+				case query == scheduledReviews:
+					result = `[999]`
+				case strings.HasPrefix(query, scheduledReviews+" prop:due="):
+					fmt.Sscanf(strings.TrimPrefix(query, scheduledReviews+" prop:due="), "%d", &offset)
+					if offset == test.relative {
+						result = `[999]`
+					}
+				case strings.HasPrefix(query, "cid:999 prop:due<="):
+					fmt.Sscanf(query, "cid:999 prop:due<=%d", &offset)
+					if offset >= test.relative {
+						result = `[999]`
+					}
+				}
+			case "cardsInfo":
+				var items []string
+				for _, id := range body.Params["cards"].([]interface{}) {
+					if id == float64(999) {
+						items = append(items, fmt.Sprintf(`{"cardId": 999, "type": 2, "queue": 2, "due": %d}`, 105+test.relative))
+					} else {
+						items = append(items, cards[id.(float64)])
+					}
+				}
+				result = "[" + strings.Join(items, ",") + "]"
+			case "unsuspend":
+				result = `true`
+			}
+			fmt.Fprintf(w, `{"result": %s, "error": null}`, result)
+		}))
+		defer ts.Close()
+
+		server := NewAnkiServer(ts.URL)
+		result, _ := server.handleSuspendedDue(context.Background(), nil, &mcp.CallToolParamsFor[SuspendedDueArgs]{
+			Arguments: SuspendedDueArgs{Unsuspend: true},
+		})
+		if result.IsError {
+			t.Fatalf("%s: unexpected error: %s", test.name, result.Content[0].(*mcp.TextContent).Text)
+		}
+		var payload struct {
+			Cards []struct {
+				CardID int64 `json:"card_id"`
+			} `json:"cards"`
+			Unsuspended  int `json:"unsuspended"`
+			UndatedCards int `json:"undated_cards"`
+		}
+		json.Unmarshal([]byte(result.Content[0].(*mcp.TextContent).Text), &payload)
+		var ids []string
+		for _, card := range payload.Cards {
+			ids = append(ids, fmt.Sprint(card.CardID))
+		}
+		if got := strings.Join(ids, ","); got != test.expected || payload.Unsuspended != len(ids) {
+			t.Errorf("%s: expected cards %s to be due and unsuspended, got %+v", test.name, test.expected, payload)
+		}
+		if payload.UndatedCards != test.undated {
+			t.Errorf("%s: expected %d undated cards, got %d", test.name, test.undated, payload.UndatedCards)
+		}
+	}
+}
+
+func TestHandleChangesSince(t *testing.T) {
+	since := time.Now().Add(-time.Hour).Unix()
+	server, calls := newAnkiStub(t, map[string]string{
+		"findNotes":    `[1, 2]`,
+		"findCards":    `[10, 11]`,
+		"notesModTime": fmt.Sprintf(`[{"noteId": 1, "mod": %d}, {"noteId": 2, "mod": %d}]`, since, since-1),
+		"cardsModTime": fmt.Sprintf(`[{"cardId": 10, "mod": %d}, {"cardId": 11, "mod": %d}]`, since-1, since+5),
+		"notesInfo":    `[{"noteId": 1}]`,
+		"cardsInfo":    `[{"cardId": 11}]`,
+	})
+
+	result, _ := server.handleChangesSince(context.Background(), nil, &mcp.CallToolParamsFor[ChangesSinceArgs]{
+		Arguments: ChangesSinceArgs{Timestamp: since},
+	})
+	if result.IsError {
+		t.Fatalf("Unexpected error: %s", result.Content[0].(*mcp.TextContent).Text)
+	}
+	if query := calls["findCards"][0]["query"]; query != allQuery {
+		t.Errorf("Expected every card to be checked, got query %v", query)
+	}
+	if notes := fmt.Sprint(calls["notesInfo"][0]["notes"]); notes != "[1]" {
+		t.Errorf("Expected the note modified at the timestamp, got %s", notes)
+	}
+	if cards := fmt.Sprint(calls["cardsInfo"][0]["cards"]); cards != "[11]" {
+		t.Errorf("Expected the card-only change, got %s", cards)
+	}
+	var payload map[string]interface{}
+	json.Unmarshal([]byte(result.Content[0].(*mcp.TextContent).Text), &payload)
+	if payload["high_water_mark"] != float64(since+5) {
+		t.Errorf("Expected high_water_mark %d, got %v", since+5, payload["high_water_mark"])
+	}
+}
+
+func TestHandleRebuildFiltered(t *testing.T) {
+	tests := []struct {
+		config  string
+		rebuilt bool
+	}{
+		{`{"id": 1651445861967, "name": "Review", "dyn": 1}`, true},
+		{`{"id": 1651445861967, "name": "Review", "dyn": true}`, true},
+		{`{"id": 1, "name": "Default", "dyn": false}`, false},
+		{`{"id": 1, "name": "Default"}`, false},
+		{`false`, false},
+	}
+	for _, test := range tests {
+		server, calls := newAnkiStub(t, map[string]string{
+			"getDeckConfig":       test.config,
+			"rebuildFilteredDeck": `null`,
+		})
+		result, _ := server.handleRebuildFiltered(context.Background(), nil, &mcp.CallToolParamsFor[FilteredDeckArgs]{
+			Arguments: FilteredDeckArgs{Deck: "Review"},
+		})
+		if rebuilt := len(calls["rebuildFilteredDeck"]) > 0; rebuilt != test.rebuilt || result.IsError == test.rebuilt {
+			t.Errorf("%s: expected rebuilt %v, got %v (%+v)", test.config, test.rebuilt, rebuilt, result)
+		}
+	}
+}
+
+func TestHandleBackup(t *testing.T) {
+	server, calls := newAnkiStub(t, map[string]string{
+		"deckNames":     `["A/B", "A_B", "Default", "Default::Sub"]`,
+		"findCards":     `[5]`,
+		"cardsInfo":     `[{"cardId": 5, "deckName": "Default::Review"}]`,
+		"exportPackage": `true`,
+	})
+
+	result, _ := server.handleBackup(context.Background(), nil, &mcp.CallToolParamsFor[BackupArgs]{
+		Arguments: BackupArgs{Directory: "backups"},
+	})
+	if result.IsError {
+		t.Fatalf("Unexpected error: %s", result.Content[0].(*mcp.TextContent).Text)
+	}
+	var decks, paths []string
+	for _, params := range calls["exportPackage"] {
+		decks = append(decks, params["deck"].(string))
+		path := params["path"].(string)
+		paths = append(paths, path[strings.LastIndex(path, "-")+1:])
+	}
+	if strings.Join(decks, ",") != "A/B,A_B,Default,Default::Review" {
+		t.Errorf("Unexpected exported decks: %v", decks)
+	}
+	if strings.Join(paths, ",") != "A_B.apkg,2.apkg,Default.apkg,Default__Review.apkg" {
+		t.Errorf("Expected unique file names, got %v", paths)
+	}
+
+	result, _ = server.handleBackup(context.Background(), nil, &mcp.CallToolParamsFor[BackupArgs]{})
+	if !result.IsError {
+		t.Error("Expected an error without a directory")
+	}
+}
+
+func TestHandleSessionProgress(t *testing.T) {
+	server, calls := newAnkiStub(t, map[string]string{
+		"getDeckStats":             `{"1": {"name": "Japanese", "new_count": 5, "learn_count": 2, "review_count": 3}}`,
+		"findCards":                `[1, 2, 3, 4, 5, 6, 7, 8, 9, 10]`,
+		"getNumCardsReviewedToday": `50`,
+	})
+
+	result, _ := server.handleSessionProgress(context.Background(), nil, &mcp.CallToolParamsFor[SessionProgressArgs]{
+		Arguments: SessionProgressArgs{Deck: "Japanese"},
+	})
+	if result.IsError {
+		t.Fatalf("Unexpected error: %s", result.Content[0].(*mcp.TextContent).Text)
+	}
+	if query := calls["findCards"][0]["query"]; query != `"deck:Japanese" rated:1` {
+		t.Errorf("Expected today's reviews in the deck to be searched, got %v", query)
+	}
+	var payload map[string]interface{}
+	json.Unmarshal([]byte(result.Content[0].(*mcp.TextContent).Text), &payload)
+	if payload["done"] != float64(10) || payload["remaining"] != float64(10) || payload["percent"] != float64(50) {
+		t.Errorf("Expected 10 done of 20 in the deck, got %v", payload)
+	}
+}
+
+func TestHandleReviewsInRange(t *testing.T) {
+	server, calls := newAnkiStub(t, map[string]string{
+		"getNumCardsReviewedByDay": `[["2024-03-09", 4], ["2024-03-11", 6]]`,
+	})
+
+	result, _ := server.handleReviewsInRange(context.Background(), nil, &mcp.CallToolParamsFor[ReviewsInRangeArgs]{
+		Arguments: ReviewsInRangeArgs{Start: "2024-03-09", End: "2024-03-11"},
+	})
+	if result.IsError {
+		t.Fatalf("Unexpected error: %s", result.Content[0].(*mcp.TextContent).Text)
+	}
+	var payload map[string]interface{}
+	json.Unmarshal([]byte(result.Content[0].(*mcp.TextContent).Text), &payload)
+	if payload["total"] != float64(10) || len(payload["by_day"].([]interface{})) != 3 {
+		t.Errorf("Expected 10 reviews over 3 days, got %v", payload)
+	}
+
+	result, _ = server.handleReviewsInRange(context.Background(), nil, &mcp.CallToolParamsFor[ReviewsInRangeArgs]{
+		Arguments: ReviewsInRangeArgs{Start: "2000-01-01", End: "2024-03-11"},
+	})
+	if !result.IsError || len(calls["getNumCardsReviewedByDay"]) != 1 {
+		t.Errorf("Expected an error without a request for a range over %d days, got %+v", maxTrendDays, result)
+	}
+}
+
+func TestHandleImportDeckConfig(t *testing.T) {
+	config := map[string]interface{}{
+		"new":   map[string]interface{}{"perDay": 20},
+		"rev":   map[string]interface{}{"perDay": 200},
+		"lapse": map[string]interface{}{"leechFails": 8},
+	}
+	for _, saved := range []string{`true`, `false`} {
+		server, calls := newAnkiStub(t, map[string]string{
+			"cloneDeckConfigId": `1651445861967`,
+			"saveDeckConfig":    saved,
+			"setDeckConfigId":   `true`,
+		})
+		result, _ := server.handleImportDeckConfig(context.Background(), nil, &mcp.CallToolParamsFor[ImportDeckConfigArgs]{
+			Arguments: ImportDeckConfigArgs{Name: "Imported", Config: config, Decks: []string{"Default"}},
+		})
+		if failed := saved == `false`; result.IsError != failed {
+			t.Errorf("saveDeckConfig %s: expected IsError %v, got %+v", saved, failed, result)
+		}
+		if assigned := len(calls["setDeckConfigId"]) > 0; assigned != (saved == `true`) {
+			t.Errorf("saveDeckConfig %s: unexpected setDeckConfigId calls %v", saved, calls["setDeckConfigId"])
+		}
+	}
+}
+
+func TestHandleNormalizeTags(t *testing.T) {
+	var actions []string
+	notesInfoCalls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Action string `json:"action"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		actions = append(actions, body.Action)
+		result := `null`
+		switch body.Action {
+		case "findNotes":
+			result = `[1, 2, 3]`
+		case "notesInfo":
+			// The second read is after the rename, where Anki kept the
+			// lowercase spelling but fixed the stray colons
+			notesInfoCalls++
+			if notesInfoCalls == 1 {
+				result = `[{"noteId": 1, "tags": ["japanese", "verb::"]}, {"noteId": 2, "tags": ["Japanese"]}, {"noteId": 3, "tags": ["Japanese"]}]`
+			} else {
+				result = `[{"noteId": 1, "tags": ["japanese", "verb"]}]`
+			}
+		}
+		fmt.Fprintf(w, `{"result": %s, "error": null}`, result)
+	}))
+	defer ts.Close()
+
+	server := NewAnkiServer(ts.URL)
+	result, _ := server.handleNormalizeTags(context.Background(), nil, &mcp.CallToolParamsFor[NormalizeTagsArgs]{
+		Arguments: NormalizeTagsArgs{Confirm: true},
+	})
+	if result.IsError {
+		t.Fatalf("Unexpected error: %s", result.Content[0].(*mcp.TextContent).Text)
+	}
+	if sequence := strings.Join(actions, ","); sequence != "findNotes,notesInfo,removeTags,removeTags,clearUnusedTags,addTags,addTags,notesInfo" {
+		t.Errorf("Unexpected request sequence: %s", sequence)
+	}
+	var payload struct {
+		Changes []struct {
+			Before  string `json:"before"`
+			Renamed int    `json:"renamed"`
+		} `json:"changes"`
+		Renamed int    `json:"renamed"`
+		Message string `json:"message"`
+	}
+	json.Unmarshal([]byte(result.Content[0].(*mcp.TextContent).Text), &payload)
+	if len(payload.Changes) != 2 || payload.Changes[0].Renamed != 0 || payload.Changes[1].Renamed != 1 {
+		t.Errorf("Expected only the colon fix to count as renamed, got %+v", payload.Changes)
+	}
+	if payload.Renamed != 1 || payload.Message == "" {
+		t.Errorf("Expected 1 rename and a message about the rest, got %+v", payload)
+	}
+}
+
+func TestHandleAddReverse(t *testing.T) {
+	tests := []struct {
+		name         string
+		sourceFields string
+		converted    bool
+		expected     string
+	}{
+		{"renamed", `["Question", "Answer"]`, true, "Back=answer,Front=question"},
+		{"extra", `["Front", "Back", "Source"]`, false, ""},
+	}
+	for _, test := range tests {
+		var updates []map[string]interface{}
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var body struct {
+				Action string                 `json:"action"`
+				Params map[string]interface{} `json:"params"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			result := `null`
+			switch body.Action {
+			case "findNotes":
+				result = `[1]`
+			case "modelFieldNames":
+				result = `["Front", "Back"]`
+				if body.Params["modelName"] == basicModel {
+					result = test.sourceFields
+				}
+			case "notesInfo":
+				result = `[{"noteId": 1, "tags": [], "fields": {"Question": {"value": "question", "order": 0}, "Answer": {"value": "answer", "order": 1}, "Front": {"value": "question", "order": 0}, "Back": {"value": "answer", "order": 1}, "Source": {"value": "book", "order": 2}}}]`
+			case "updateNoteModel":
+				updates = append(updates, body.Params["note"].(map[string]interface{}))
+			}
+			fmt.Fprintf(w, `{"result": %s, "error": null}`, result)
+		}))
+		defer ts.Close()
+
+		server := NewAnkiServer(ts.URL)
+		result, _ := server.handleAddReverse(context.Background(), nil, &mcp.CallToolParamsFor[AddReverseArgs]{
+			Arguments: AddReverseArgs{Confirm: true},
+		})
+		if result.IsError == test.converted || (len(updates) == 1) != test.converted {
+			t.Fatalf("%s: expected converted %v, got %+v with updates %v", test.name, test.converted, result, updates)
+		}
+		if !test.converted {
+			continue
+		}
+		fields, _ := updates[0]["fields"].(map[string]interface{})
+		var pairs []string
+		for name, value := range fields {
+			pairs = append(pairs, fmt.Sprintf("%s=%v", name, value))
+		}
+		sort.Strings(pairs)
+		if got := strings.Join(pairs, ","); got != test.expected {
+			t.Errorf("%s: expected fields %s, got %s", test.name, test.expected, got)
+		}
+	}
+}
+
+func TestHandleSplitByTag(t *testing.T) {
+	// Note 1 has card 10 in Deck; note 2 has card 11 in Deck::Grammar::Verbs
+	var moved []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Action string                 `json:"action"`
+			Params map[string]interface{} `json:"params"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		query, _ := body.Params["query"].(string)
+		withoutSubdecks := strings.Contains(query, `-"deck:Deck::*"`)
+		result := `null`
+		switch body.Action {
+		case "findNotes":
+			result = `[1, 2]`
+			if withoutSubdecks {
+				result = `[1]`
+			}
+		case "findCards":
+			result = `[10, 11]`
+			if withoutSubdecks {
+				result = `[10]`
+			}
+		case "notesInfo":
+			var notes []string
+			for _, id := range body.Params["notes"].([]interface{}) {
+				notes = append(notes, fmt.Sprintf(`{"noteId": %v, "tags": ["verbs"]}`, id))
+			}
+			result = "[" + strings.Join(notes, ",") + "]"
+		case "changeDeck":
+			moved = append(moved, fmt.Sprint(body.Params["cards"]))
+		}
+		fmt.Fprintf(w, `{"result": %s, "error": null}`, result)
+	}))
+	defer ts.Close()
+
+	server := NewAnkiServer(ts.URL)
+	result, _ := server.handleSplitByTag(context.Background(), nil, &mcp.CallToolParamsFor[SplitByTagArgs]{
+		Arguments: SplitByTagArgs{Deck: "Deck", Confirm: true},
+	})
+	if result.IsError {
+		t.Fatalf("Unexpected error: %s", result.Content[0].(*mcp.TextContent).Text)
+	}
+	if got := strings.Join(moved, ","); got != "[10]" {
+		t.Errorf("Expected only card 10 to be moved, got %s", got)
+	}
+}
+
+func TestSupportsAction(t *testing.T) {
+	tests := []struct {
+		reflected string
+		expected  bool
+	}{
+		{`{"scopes": ["actions"], "actions": ["setDeckDescription"]}`, true},
+		{`{"scopes": ["actions"], "actions": []}`, false},
+	}
+	for _, test := range tests {
+		server, calls := newAnkiStub(t, map[string]string{"apiReflect": test.reflected})
+		supported, err := server.supportsAction(context.Background(), "setDeckDescription")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if supported != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.reflected, test.expected, supported)
+		}
+		if actions := fmt.Sprint(calls["apiReflect"][0]["actions"]); actions != "[setDeckDescription]" {
+			t.Errorf("Expected apiReflect to be asked about setDeckDescription, got %s", actions)
+		}
+	}
+}
+
+func TestHandleRetrieveMediaFile(t *testing.T) {
+	server, _ := newAnkiStub(t, map[string]string{"retrieveMediaFile": `"aGVsbG8="`})
+	result, _ := server.handleRetrieveMediaFile(context.Background(), nil, &mcp.CallToolParamsFor[RetrieveMediaArgs]{
+		Arguments: RetrieveMediaArgs{Filename: "hello.txt"},
+	})
+	if result.IsError {
+		t.Fatalf("Unexpected error: %s", result.Content[0].(*mcp.TextContent).Text)
+	}
+	var payload map[string]interface{}
+	json.Unmarshal([]byte(result.Content[0].(*mcp.TextContent).Text), &payload)
+	if payload["filename"] != "hello.txt" || payload["data"] != "aGVsbG8=" || payload["size"] != float64(5) {
+		t.Errorf("Unexpected payload: %v", payload)
+	}
+
+	missing, _ := newAnkiStub(t, map[string]string{"retrieveMediaFile": `false`})
+	result, _ = missing.handleRetrieveMediaFile(context.Background(), nil, &mcp.CallToolParamsFor[RetrieveMediaArgs]{
+		Arguments: RetrieveMediaArgs{Filename: "missing.txt"},
+	})
+	if !result.IsError || result.Content[0].(*mcp.TextContent).Text != "media file not found" {
+		t.Errorf("Expected a not found error, got %+v", result)
+	}
+}
+
+func TestHandleMediaFiles(t *testing.T) {
+	server, calls := newAnkiStub(t, map[string]string{"getMediaFilesNames": `["b.png", "a.png"]`})
+
+	tests := map[string]string{
+		"anki://media":                "*",
+		"anki://media/":               "*",
+		"anki://media/%2A.png":        "*.png",
+		"anki://media/my%20file%3F.*": "my file?.*",
+	}
+	for uri, expected := range tests {
+		result, err := server.handleMediaFiles(context.Background(), nil, &mcp.ReadResourceParams{URI: uri})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", uri, err)
+		}
+		requests := calls["getMediaFilesNames"]
+		if pattern := requests[len(requests)-1]["pattern"]; pattern != expected {
+			t.Errorf("%s: expected pattern %q, got %v", uri, expected, pattern)
+		}
+		if text := result.Contents[0].Text; text != `["a.png","b.png"]` {
+			t.Errorf("%s: expected sorted names, got %s", uri, text)
+		}
+	}
+}
+
+func TestLearningStep(t *testing.T) {
+	tests := []struct {
+		left     float64
+		steps    int
+		expected int
+	}{
+		{2002, 2, 0},
+		{1001, 2, 1},
+		{3, 3, 0},
+		{1, 3, 2},
+		{1005, 2, 0},
+	}
+	for _, test := range tests {
+		if got := learningStep(test.left, test.steps); got != test.expected {
+			t.Errorf("learningStep(%v, %d) = %d, expected %d", test.left, test.steps, got, test.expected)
+		}
+	}
+}
+
+func TestTagSummary(t *testing.T) {
+	notes := []map[string]interface{}{
+		{"tags": []interface{}{"verbs", "french", "verbs"}},
+		{"tags": []interface{}{"french", "nouns"}},
+		{"tags": []interface{}{"french"}},
+	}
+
+	union, intersection, counts := tagSummary(notes)
+	if got := strings.Join(union, ","); got != "french,nouns,verbs" {
+		t.Errorf("Expected union french,nouns,verbs, got %s", got)
+	}
+	if got := strings.Join(intersection, ","); got != "french" {
+		t.Errorf("Expected intersection french, got %s", got)
+	}
+	if got := fmt.Sprint(counts); got != "map[french:3 nouns:1 verbs:1]" {
+		t.Errorf("Unexpected counts %s", got)
+	}
+}
+
+func TestHandleDeleteMediaFile(t *testing.T) {
+	server, calls := newAnkiStub(t, map[string]string{
+		"getMediaFilesNames": `["hello.txt"]`,
+		"deleteMediaFile":    `null`,
+	})
+	result, _ := server.handleDeleteMediaFile(context.Background(), nil, &mcp.CallToolParamsFor[DeleteMediaArgs]{
+		Arguments: DeleteMediaArgs{Filename: "hello.txt"},
+	})
+	if result.IsError {
+		t.Fatalf("Unexpected error: %s", result.Content[0].(*mcp.TextContent).Text)
+	}
+	if deleted := calls["deleteMediaFile"]; len(deleted) != 1 || deleted[0]["filename"] != "hello.txt" {
+		t.Errorf("Expected hello.txt to be deleted, got %v", deleted)
+	}
+
+	// A glob match on another file doesn't count as the file existing
+	missing, calls := newAnkiStub(t, map[string]string{
+		"getMediaFilesNames": `["missing.txt.bak"]`,
+		"deleteMediaFile":    `null`,
+	})
+	result, _ = missing.handleDeleteMediaFile(context.Background(), nil, &mcp.CallToolParamsFor[DeleteMediaArgs]{
+		Arguments: DeleteMediaArgs{Filename: "missing.txt"},
+	})
+	if !result.IsError || result.Content[0].(*mcp.TextContent).Text != "media file not found" {
+		t.Errorf("Expected a not found error, got %+v", result)
+	}
+	if deleted := calls["deleteMediaFile"]; len(deleted) != 0 {
+		t.Errorf("Expected no delete for a missing file, got %v", deleted)
+	}
+}
+
+func TestHandleCreateDeck(t *testing.T) {
+	server, calls := newAnkiStub(t, map[string]string{"createDeck": `1651445861967`})
+
+	result, _ := server.handleCreateDeck(context.Background(), nil, &mcp.CallToolParamsFor[CreateDeckArgs]{
+		Arguments: CreateDeckArgs{Name: "  Japanese::Vocab "},
+	})
+	if result.IsError {
+		t.Fatalf("Unexpected error: %s", result.Content[0].(*mcp.TextContent).Text)
+	}
+	if text := result.Content[0].(*mcp.TextContent).Text; text != `{"deck":"Japanese::Vocab","deck_id":1651445861967}` {
+		t.Errorf("Unexpected result: %s", text)
+	}
+	if created := calls["createDeck"]; len(created) != 1 || created[0]["deck"] != "Japanese::Vocab" {
+		t.Errorf("Expected a trimmed deck name, got %v", created)
+	}
+
+	result, _ = server.handleCreateDeck(context.Background(), nil, &mcp.CallToolParamsFor[CreateDeckArgs]{
+		Arguments: CreateDeckArgs{Name: "   "},
+	})
+	if !result.IsError {
+		t.Error("Expected an error for a blank name")
+	}
+	if created := calls["createDeck"]; len(created) != 1 {
+		t.Errorf("Expected no request for a blank name, got %v", created)
+	}
+}
+
+func TestHTMLToMarkdown(t *testing.T) {
+	tests := map[string]string{
+		"<b>bold</b> and <i>italic</i>":                   "**bold** and *italic*",
+		"<div>one</div><div>two</div>":                    "one\ntwo",
+		"line<br>break<br/>":                              "line\nbreak",
+		`<a href="https://example.com">link</a>`:          "[link](https://example.com)",
+		"<ul><li>a</li><li>b</li></ul>":                   "- a\n- b",
+		`<img src="cat*.png"> <i>cat</i> [sound:cat.mp3]`: `<img src="cat*.png"> *cat* [sound:cat.mp3]`,
+		"a&nbsp;b <span style=\"color: red\">c</span>":    "a b c",
+	}
+	for input, expected := range tests {
+		if got := htmlToMarkdown(input); got != expected {
+			t.Errorf("htmlToMarkdown(%q) = %q, expected %q", input, got, expected)
+		}
+	}
+}
+
+func TestMarkdownToHTML(t *testing.T) {
+	tests := map[string]string{
+		"**bold** and *italic*":       "<b>bold</b> and <i>italic</i>",
+		"one\ntwo":                    "one<br>two",
+		"[link](https://example.com)": `<a href="https://example.com">link</a>`,
+		"intro\n- a\n- b\nafter":      "intro<ul><li>a</li><li>b</li></ul>after",
+		"`x*y*z`":                     "<code>x*y*z</code>",
+	}
+	for input, expected := range tests {
+		if got := markdownToHTML(input); got != expected {
+			t.Errorf("markdownToHTML(%q) = %q, expected %q", input, got, expected)
+		}
+	}
+
+	// Media tags must survive a round trip untouched
+	original := `<b>cat</b><br><img src="a_*b*_.png" alt="[x](y)"><br>[sound:**meow**.mp3]`
+	if got := markdownToHTML(htmlToMarkdown(original)); got != original {
+		t.Errorf("Round trip changed the field: %q", got)
+	}
+}
+
+func TestHandleDeleteDecks(t *testing.T) {
+	server, calls := newAnkiStub(t, map[string]string{"deleteDecks": `null`})
+
+	keep := false
+	tests := []struct {
+		cardsToo *bool
+		expected bool
+	}{
+		{nil, true},
+		{&keep, false},
+	}
+	for i, test := range tests {
+		result, _ := server.handleDeleteDecks(context.Background(), nil, &mcp.CallToolParamsFor[DeleteDecksArgs]{
+			Arguments: DeleteDecksArgs{Decks: []string{"Old", "Older"}, CardsToo: test.cardsToo},
+		})
+		if result.IsError {
+			t.Fatalf("Unexpected error: %s", result.Content[0].(*mcp.TextContent).Text)
+		}
+		if cardsToo := calls["deleteDecks"][i]["cardsToo"]; cardsToo != test.expected {
+			t.Errorf("Expected cardsToo %v, got %v", test.expected, cardsToo)
+		}
+		if text := result.Content[0].(*mcp.TextContent).Text; text != "Deleted decks: Old, Older" {
+			t.Errorf("Unexpected message: %s", text)
+		}
+	}
+
+	result, _ := server.handleDeleteDecks(context.Background(), nil, &mcp.CallToolParamsFor[DeleteDecksArgs]{})
+	if !result.IsError {
+		t.Error("Expected an error for no decks")
+	}
+}
+
+func TestNoteSize(t *testing.T) {
+	note := map[string]interface{}{
+		"fields": map[string]interface{}{
+			"Front": map[string]interface{}{"value": "héllo", "order": float64(0)},
+			"Back":  map[string]interface{}{"value": "<b>a long answer</b>", "order": float64(1)},
+			"Extra": map[string]interface{}{"value": "", "order": float64(2)},
+		},
+	}
+
+	size, largest := noteSize(note)
+	if size != 26 {
+		t.Errorf("Expected 26 bytes, got %d", size)
+	}
+	if largest != "Back" {
+		t.Errorf("Expected Back to be the largest field, got %s", largest)
+	}
+}
+
+func TestCoerceIDs(t *testing.T) {
+	tests := []struct {
+		name    string
+		ids     []interface{}
+		parsed  string
+		dropped string
+	}{
+		{"strings", []interface{}{"1", "1698765432"}, "[1 1698765432]", "[]"},
+		{"floats", []interface{}{float64(1), float64(2)}, "[1 2]", "[]"},
+		{"ints", []interface{}{3, 4}, "[3 4]", "[]"},
+		{"mixed", []interface{}{float64(1), "2", 3}, "[1 2 3]", "[]"},
+		{"garbage", []interface{}{"x", true, nil, float64(1.5), "2.0"}, "[]", "[x true <nil> 1.5 2.0]"},
+		{"partial", []interface{}{"1", "abc"}, "[1]", "[abc]"},
+		{"empty", nil, "[]", "[]"},
+	}
+	for _, test := range tests {
+		parsed, dropped := coerceIDs(test.ids)
+		if got := fmt.Sprint(parsed); got != test.parsed {
+			t.Errorf("%s: expected parsed %s, got %s", test.name, test.parsed, got)
+		}
+		if got := fmt.Sprint(dropped); got != test.dropped {
+			t.Errorf("%s: expected dropped %s, got %s", test.name, test.dropped, got)
+		}
+	}
+}
+
+func TestRemainingCounts(t *testing.T) {
+	stats := map[string]interface{}{
+		"1": map[string]interface{}{"name": "A", "new_count": float64(10), "learn_count": float64(2), "review_count": float64(30)},
+		"2": map[string]interface{}{"name": "B", "new_count": float64(5), "learn_count": float64(0), "review_count": float64(1)},
+	}
+
+	counts := remainingCounts(stats)
+	if counts["new"] != 15 || counts["learning"] != 2 || counts["review"] != 31 {
+		t.Errorf("Unexpected counts: %v", counts)
+	}
+}
+
+func TestIDRoundTrip(t *testing.T) {
+	const id = 1698765432109
+
+	for _, input := range []interface{}{"1698765432109", float64(id)} {
+		parsed, dropped := coerceIDs([]interface{}{input})
+		if len(dropped) != 0 || len(parsed) != 1 || parsed[0] != id {
+			t.Errorf("coerceIDs(%v) = %v, %v", input, parsed, dropped)
+		}
+	}
+
+	server, calls := newAnkiStub(t, map[string]string{
+		"findNotes": `[1698765432109]`,
+		"notesInfo": `[{"noteId": 1698765432109}]`,
+	})
+
+	ids, err := server.findIDs(context.Background(), "findNotes", "deck:Default")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(ids) != 1 || ids[0] != id {
+		t.Errorf("Expected [%d], got %v", int64(id), ids)
+	}
+
+	result, err := server.handleNotesInfo(context.Background(), nil, &mcp.ReadResourceParams{URI: "anki://notes/1698765432109/info"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if requested, _ := calls["notesInfo"][0]["notes"].([]interface{}); len(requested) != 1 || requested[0] != float64(id) {
+		t.Errorf("Expected notesInfo to be asked for %d, got %v", int64(id), requested)
+	}
+	if text := result.Contents[0].Text; !strings.Contains(text, "1698765432109") {
+		t.Errorf("Expected the note ID in the result, got %s", text)
+	}
+}
+
+func TestHandleCreateNote(t *testing.T) {
+	server, calls := newAnkiStub(t, map[string]string{"addNote": `1698765432109`})
+
+	result, _ := server.handleCreateNote(context.Background(), nil, &mcp.CallToolParamsFor[AddNoteArgs]{
+		Arguments: AddNoteArgs{DeckName: "Default", ModelName: "Basic", Fields: map[string]string{"Front": "hello", "Back": "world"}, Tags: []string{"greeting"}},
+	})
+	if result.IsError {
+		t.Fatalf("Unexpected error: %s", result.Content[0].(*mcp.TextContent).Text)
+	}
+	if text := result.Content[0].(*mcp.TextContent).Text; text != `{"note_id":1698765432109}` {
+		t.Errorf("Unexpected result: %s", text)
+	}
+	if note, _ := calls["addNote"][0]["note"].(map[string]interface{}); note["deckName"] != "Default" || note["modelName"] != "Basic" {
+		t.Errorf("Unexpected note sent: %v", note)
+	}
+
+	duplicate, _ := newAnkiStub(t, map[string]string{"addNote": "error: cannot create note because it is a duplicate"})
+	result, _ = duplicate.handleCreateNote(context.Background(), nil, &mcp.CallToolParamsFor[AddNoteArgs]{
+		Arguments: AddNoteArgs{DeckName: "Default", ModelName: "Basic", Fields: map[string]string{"Front": "duplicate"}},
+	})
+	if !result.IsError || !strings.Contains(result.Content[0].(*mcp.TextContent).Text, "duplicate") {
+		t.Errorf("Expected the duplicate error, got %+v", result)
+	}
+}
+
+func TestHandleCanAddNotes(t *testing.T) {
+	notes := []map[string]interface{}{
+		{"deckName": "Default", "modelName": "Basic", "fields": map[string]interface{}{"Front": "new"}},
+		{"deckName": "Default", "modelName": "Basic", "fields": map[string]interface{}{"Front": "duplicate"}},
+	}
+	tests := []struct {
+		name    string
+		results map[string]string
+		reason  interface{}
+	}{
+		{"detailed", map[string]string{
+			"canAddNotesWithErrorDetail": `[{"canAdd": true}, {"canAdd": false, "error": "cannot create note because it is a duplicate"}]`,
+		}, "cannot create note because it is a duplicate"},
+		{"fallback", map[string]string{"canAddNotes": `[true, false]`}, nil},
+	}
+	for _, test := range tests {
+		server, _ := newAnkiStub(t, test.results)
+		result, _ := server.handleCanAddNotes(context.Background(), nil, &mcp.CallToolParamsFor[CanAddNotesArgs]{
+			Arguments: CanAddNotesArgs{Notes: notes},
+		})
+		if result.IsError {
+			t.Fatalf("%s: unexpected error: %s", test.name, result.Content[0].(*mcp.TextContent).Text)
+		}
+		var payload struct {
+			Addable int                      `json:"addable"`
+			Notes   []map[string]interface{} `json:"notes"`
+		}
+		json.Unmarshal([]byte(result.Content[0].(*mcp.TextContent).Text), &payload)
+		if payload.Addable != 1 || len(payload.Notes) != 2 {
+			t.Fatalf("%s: unexpected payload %+v", test.name, payload)
+		}
+		if payload.Notes[0]["canAdd"] != true || payload.Notes[1]["canAdd"] != false {
+			t.Errorf("%s: results out of order: %v", test.name, payload.Notes)
+		}
+		if payload.Notes[1]["reason"] != test.reason {
+			t.Errorf("%s: expected reason %v, got %v", test.name, test.reason, payload.Notes[1]["reason"])
+		}
+	}
+}
+
+func TestHandleDeckConfig(t *testing.T) {
+	server, calls := newAnkiStub(t, map[string]string{
+		"deckNamesAndIds": `{"Default": 1, "Japanese": 1698765432109, "2024": 1700000000000}`,
+		"getDeckConfig":   `{"id": 1, "name": "Default"}`,
+	})
+
+	uris := []string{"anki://decks/1698765432109/config", "anki://decks/Japanese/config", "anki://decks/2024/config"}
+	for _, uri := range uris {
+		if _, err := server.handleDeckConfig(context.Background(), nil, &mcp.ReadResourceParams{URI: uri}); err != nil {
+			t.Fatalf("%s: unexpected error: %v", uri, err)
+		}
+	}
+	var requested []string
+	for _, params := range calls["getDeckConfig"] {
+		requested = append(requested, fmt.Sprint(params["deck"]))
+	}
+	if strings.Join(requested, ",") != "Japanese,Japanese,2024" {
+		t.Errorf("Expected getDeckConfig to be called with deck names, got %v", requested)
+	}
+
+	// An unknown ID that isn't a deck name either
+	missing, _ := newAnkiStub(t, map[string]string{
+		"deckNamesAndIds": `{"Default": 1}`,
+		"getDeckConfig":   `false`,
+	})
+	_, err := missing.handleDeckConfig(context.Background(), nil, &mcp.ReadResourceParams{URI: "anki://decks/42/config"})
+	if !errors.Is(err, errNotFound) {
+		t.Errorf("Expected a not found error for an unknown ID, got %v", err)
+	}
+}
+
+func TestAnkiRequestRetries(t *testing.T) {
+	attempts := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"result": 6, "error": null}`))
+	}))
+	defer ts.Close()
+	server := NewAnkiServer(ts.URL)
+	server.maxRetries = 2
+	server.retryDelay = time.Millisecond
+
+	result, err := server.ankiRequest(context.Background(), "version", nil)
+	if err != nil {
+		t.Fatalf("Expected success after retries, got %v", err)
+	}
+	if result != float64(6) || attempts != 3 {
+		t.Errorf("Expected result 6 after 3 attempts, got %v after %d", result, attempts)
+	}
+
+	// Giving up returns the last failure
+	attempts = 0
+	server.maxRetries = 1
+	_, err = server.ankiRequest(context.Background(), "version", nil)
+	var statusErr *HTTPStatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected an HTTP status error, got %v", err)
+	}
+	if code := errorCode(err); code != codeConnection || attempts != 2 {
+		t.Errorf("Expected code %s after 2 attempts, got %s after %d", codeConnection, code, attempts)
+	}
+}
+
+func TestAnkiRequestDoesNotRetryAnkiConnectErrors(t *testing.T) {
+	server, calls := newAnkiStub(t, map[string]string{"version": "error: collection is not available"})
+	server.maxRetries = 2
+	server.retryDelay = time.Millisecond
+
+	_, err := server.ankiRequest(context.Background(), "version", nil)
+	var ankiErr *AnkiConnectError
+	if !errors.As(err, &ankiErr) {
+		t.Errorf("Expected an AnkiConnectError, got %v", err)
+	}
+	if attempts := len(calls["version"]); attempts != 1 {
+		t.Errorf("Expected a single attempt, got %d", attempts)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	unreachable := NewAnkiServer("http://127.0.0.1:1")
+	_, err := unreachable.ankiRequest(context.Background(), "version", nil)
+	if !isRetryable("addNote", err) {
+		t.Errorf("Expected connection refused to be retryable: %v", err)
+	}
+	statusErr := &HTTPStatusError{StatusCode: http.StatusBadGateway}
+	if !isRetryable("findNotes", statusErr) {
+		t.Error("Expected a 5xx status to be retryable for a read-only action")
+	}
+	if isRetryable("addNote", statusErr) {
+		t.Error("Expected a 5xx status not to be retryable for a mutation")
+	}
+	if isRetryable("version", &AnkiConnectError{Action: "version", Message: "boom"}) {
+		t.Error("Expected AnkiConnect errors not to be retryable")
+	}
+	if isRetryable("version", &ResponseError{Err: errors.New("bad json")}) {
+		t.Error("Expected decode errors not to be retryable")
+	}
+}